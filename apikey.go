@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// apiKeyPrefix marks API keys so they are easy to recognise, for instance
+// by secret scanners
+const apiKeyPrefix = "pak_"
+
+const apiKeyHeader = "X-API-Key"
+
+// newAPIKey returns a random key and the hash to store for it
+func newAPIKey() (key, hash string, err error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", fmt.Errorf("apikey: unable to generate a key: %w", err)
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret[:])
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey needs no salt or stretching: keys are random and long enough
+// that they cannot be guessed from their hash
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// runAPIKeyCommand creates, lists and revokes API keys. New keys may only
+// be given roles the policy defines, and belong to the default tenant unless
+// -tenant names another.
+func runAPIKeyCommand(ctx context.Context, keys APIKeyStore, p *policy, args []string, out io.Writer) error {
+	usage := errors.New("usage: apikey create [-tenant <tenant>] <name> [role ...] | apikey list | apikey revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		args, tenant := args[1:], defaultTenant
+		if len(args) > 0 && args[0] == "-tenant" {
+			if len(args) < 2 {
+				return usage
+			}
+			args, tenant = args[2:], args[1]
+		}
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("apikey: %q is not a valid tenant id", tenant)
+		}
+		if len(args) < 1 || strings.TrimSpace(args[0]) == "" {
+			return usage
+		}
+		name, roles := args[0], args[1:]
+		if len(roles) == 0 {
+			roles = []string{roleViewer}
+		}
+		for _, role := range roles {
+			if !p.hasRole(role) {
+				return fmt.Errorf("apikey: unknown role %q, expected one of %s", role, strings.Join(p.roleNames(), ", "))
+			}
+		}
+
+		raw, hash, err := newAPIKey()
+		if err != nil {
+			return err
+		}
+		key, err := keys.CreateAPIKey(ctx, APIKey{Name: name, Hash: hash, Roles: roles, Tenant: tenant})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created API key %d %q for tenant %s with roles %s\n", key.Id, key.Name, key.Tenant, strings.Join(key.Roles, " "))
+		fmt.Fprintf(out, "%s\n", raw)
+		fmt.Fprintln(out, "store it somewhere safe now, it cannot be shown again")
+		return nil
+
+	case "list":
+		if len(args) != 1 {
+			return usage
+		}
+		list, err := keys.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tTENANT\tROLES\tCREATED\tREVOKED")
+		for _, key := range list {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", key.Id, key.Name, key.Tenant, strings.Join(key.Roles, " "), key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("apikey: %q is not a key id", args[1])
+		}
+		if err := keys.RevokeAPIKey(ctx, id); err != nil {
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				return fmt.Errorf("apikey: no live key with id %d", id)
+			}
+			return err
+		}
+		fmt.Fprintf(out, "revoked API key %d\n", id)
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunAPIKeyCommand(t *testing.T) {
+	ctx := context.Background()
+	store := NewSQLiteStore(setupTestDB(t))
+
+	var out bytes.Buffer
+	if err := runAPIKeyCommand(ctx, store, defaultPolicy(), []string{"create", "deploy", "editor"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], apiKeyPrefix) {
+		t.Fatalf("expected the new key on the second line, got %q", out.String())
+	}
+	key, err := store.APIKeyByHash(ctx, hashAPIKey(lines[1]))
+	if err != nil || key.Name != "deploy" || key.Tenant != defaultTenant || strings.Join(key.Roles, " ") != roleEditor {
+		t.Errorf("got %+v, %v", key, err)
+	}
+
+	out.Reset()
+	if err := runAPIKeyCommand(ctx, store, defaultPolicy(), []string{"create", "-tenant", "acme", "storefront"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(out.String(), "\n")
+	key, err = store.APIKeyByHash(ctx, hashAPIKey(lines[1]))
+	if err != nil || key.Tenant != "acme" || strings.Join(key.Roles, " ") != roleViewer {
+		t.Errorf("got %+v, %v", key, err)
+	}
+
+	for _, args := range [][]string{nil, {"create"}, {"create", "deploy", "superuser"}, {"create", "-tenant"}, {"create", "-tenant", "a/b", "deploy"}, {"revoke", "one"}, {"rotate"}} {
+		if err := runAPIKeyCommand(ctx, store, defaultPolicy(), args, &out); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+
+	out.Reset()
+	if err := runAPIKeyCommand(ctx, store, defaultPolicy(), []string{"revoke", "1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := runAPIKeyCommand(ctx, store, defaultPolicy(), []string{"revoke", "1"}, &out); err == nil {
+		t.Error("expected revoking a revoked key to fail")
+	}
+
+	out.Reset()
+	if err := runAPIKeyCommand(ctx, store, defaultPolicy(), []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "deploy") || strings.Contains(out.String(), lines[1]) {
+		t.Errorf("unexpected listing %q", out.String())
+	}
+}
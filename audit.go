@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anonymousActor is recorded for changes made by unauthenticated requests
+const anonymousActor = "anonymous"
+
+// requestIdPattern accepts the request ids proxies commonly generate, such
+// as UUIDs, while keeping arbitrary text out of the audit trail
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestContext tags every request with an id, taken from X-Request-Id
+// when the client or a proxy sent a usable one, echoes it in the response
+// and attaches it to the context so writes can be audited
+func requestContext() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader("X-Request-Id")
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		c.Header("X-Request-Id", requestId)
+
+		ctx := withAuditInfo(c.Request.Context(), auditInfo{Actor: anonymousActor, RequestId: requestId})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requestIdFallback numbers the requests whose id could not be random
+var requestIdFallback atomic.Uint64
+
+// newRequestId returns a random id. Should the system's random source fail,
+// the id is made of the time and a counter instead, which still keeps it
+// unique within this process, rather than failing the request.
+func newRequestId() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Printf("Unable to generate a random request id: %v", err)
+		binary.BigEndian.PutUint64(id[:8], uint64(now().UnixNano()))
+		binary.BigEndian.PutUint64(id[8:], requestIdFallback.Add(1))
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// ProductHistory is the paginated response of GET /products/{id}/history
+type ProductHistory struct {
+	Items      []AuditRecord `json:"items"`                 //	@Description	Changes on this page, newest first
+	NextCursor string        `json:"next_cursor,omitempty"` //	@Description	Opaque cursor for older changes, absent on the last page
+}
+
+func encodeHistoryCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeHistoryCursor(token string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errors.New("Invalid cursor")
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("Invalid cursor")
+	}
+	return id, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// principal is the authenticated caller of a request
+type principal struct {
+	// Actor names the caller in the audit trail
+	Actor string
+	Roles []string
+	// Tenant is the tenant the credentials were issued for
+	Tenant string
+	// Claims holds the verified claims of a bearer token, and is nil for
+	// API keys
+	Claims jwt.MapClaims
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authenticator identifies callers by API key or, when tokens is set, by
+// JWT bearer token, and checks their roles against a policy
+type authenticator struct {
+	keys   APIKeyStore
+	tokens *jwtVerifier
+	policy *policy
+}
+
+func newAuthenticator(keys APIKeyStore, tokens *jwtVerifier, p *policy) *authenticator {
+	return &authenticator{keys: keys, tokens: tokens, policy: p}
+}
+
+// authenticate identifies the caller from the X-API-Key or Authorization
+// header. Requests with neither carry on anonymously, for authorize to turn
+// away if need be; invalid credentials are refused outright.
+//
+// It also picks the tenant whose catalog the request works on: the one the
+// credentials belong to, or the default tenant for anonymous requests, which
+// need credentials to name any other in X-Tenant-Id. Credentials sent with
+// an X-Tenant-Id of another tenant are refused.
+func (a *authenticator) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var p principal
+		if raw := c.GetHeader(apiKeyHeader); raw != "" {
+			key, err := a.keys.APIKeyByHash(c.Request.Context(), hashAPIKey(raw))
+			if err != nil {
+				if errors.Is(err, ErrAPIKeyNotFound) {
+					a.unauthorized(c, "", "The API key is not valid or has been revoked")
+					return
+				}
+				internalError(c, "Unable to check the API key", err)
+				return
+			}
+			p = principal{Actor: "apikey:" + key.Name, Roles: key.Roles, Tenant: key.Tenant}
+		} else if scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " "); strings.EqualFold(scheme, "Bearer") {
+			if a.tokens == nil {
+				a.unauthorized(c, "", "Bearer tokens are not accepted; use an API key")
+				return
+			}
+			claims, err := a.tokens.Verify(c.Request.Context(), strings.TrimSpace(token))
+			if err != nil {
+				a.unauthorized(c, "invalid_token", "The bearer token is not valid: "+err.Error())
+				return
+			}
+			tenant, ok := tokenTenant(claims)
+			if !ok {
+				a.unauthorized(c, "invalid_token", "The bearer token's tenant claim is not a valid tenant id")
+				return
+			}
+			subject, _ := claims.GetSubject()
+			p = principal{Actor: "jwt:" + subject, Roles: tokenRoles(claims), Tenant: tenant, Claims: claims}
+		} else {
+			if requested := c.GetHeader(tenantHeader); requested != "" && requested != defaultTenant {
+				if !tenantPattern.MatchString(requested) {
+					badRequest(c, problemInvalidTenant, tenantHeader+" must be 1 to 64 letters, digits, dots, dashes or underscores")
+					return
+				}
+				a.unauthorized(c, "", "Requests to tenant "+strconv.Quote(requested)+" require its credentials")
+				return
+			}
+			c.Request = c.Request.WithContext(withTenant(c.Request.Context(), defaultTenant))
+			c.Next()
+			return
+		}
+
+		if requested := c.GetHeader(tenantHeader); requested != "" && requested != p.Tenant {
+			log.Printf("Access denied: %s %s by %s of tenant %s to tenant %q (request %s)",
+				c.Request.Method, c.Request.URL.Path, p.Actor, p.Tenant, requested, auditInfoFrom(c.Request.Context()).RequestId)
+			forbidden(c, "Your credentials are not valid for tenant "+strconv.Quote(requested))
+			return
+		}
+
+		ctx := c.Request.Context()
+		info := auditInfoFrom(ctx)
+		info.Actor = p.Actor
+		c.Request = c.Request.WithContext(withTenant(withAuditInfo(withPrincipal(ctx, p), info), p.Tenant))
+		c.Next()
+	}
+}
+
+// authorize lets a request through if one of its caller's roles grants
+// permission. Anonymous callers get a 401 unless the route is public.
+// Denials are logged.
+func (a *authenticator) authorize(permission string, public bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		p, ok := principalFrom(ctx)
+		if !ok {
+			if public {
+				c.Next()
+				return
+			}
+			logDenied(c, anonymousActor, nil, permission)
+			a.unauthorized(c, "", "This request requires credentials")
+			return
+		}
+		if !a.policy.allows(p.Roles, permission) {
+			logDenied(c, p.Actor, p.Roles, permission)
+			forbidden(c, fmt.Sprintf("None of your roles grants %s", permission))
+			return
+		}
+		c.Next()
+	}
+}
+
+func logDenied(c *gin.Context, actor string, roles []string, permission string) {
+	log.Printf("Access denied: %s %s by %s with roles %v lacks %s (request %s)",
+		c.Request.Method, c.Request.URL.Path, actor, roles, permission, auditInfoFrom(c.Request.Context()).RequestId)
+}
+
+// unauthorized challenges the client with every scheme it may authenticate
+// with. bearerError is the RFC 6750 error code for a rejected token.
+func (a *authenticator) unauthorized(c *gin.Context, bearerError, detail string) {
+	c.Writer.Header().Add("WWW-Authenticate", `ApiKey header="`+apiKeyHeader+`"`)
+	if a.tokens != nil {
+		challenge := "Bearer"
+		if bearerError != "" {
+			challenge += ` error="` + bearerError + `"`
+		}
+		c.Writer.Header().Add("WWW-Authenticate", challenge)
+	}
+	unauthorized(c, detail)
+}
+
+// tokenTenant reads the tenant claim. Tokens without one belong to the
+// default tenant.
+func tokenTenant(claims jwt.MapClaims) (string, bool) {
+	raw, present := claims["tenant"]
+	if !present {
+		return defaultTenant, true
+	}
+	tenant, ok := raw.(string)
+	return tenant, ok && tenantPattern.MatchString(tenant)
+}
+
+// tokenRoles reads the roles claim, either a list or a space separated
+// string
+func tokenRoles(claims jwt.MapClaims) []string {
+	switch raw := claims["roles"].(type) {
+	case string:
+		return strings.Fields(raw)
+	case []any:
+		var roles []string
+		for _, role := range raw {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// maxBatchOperations caps the size of one POST /products/batch
+	maxBatchOperations = 1000
+	// maxBatchBodyBytes leaves room for maxBatchOperations typical products
+	maxBatchBodyBytes = 8 << 20
+)
+
+// Batch modes
+const (
+	batchAtomic  = "atomic"
+	batchPartial = "partial"
+)
+
+// BatchRequest is the body of POST /products/batch
+type BatchRequest struct {
+	Mode       string           `json:"mode,omitempty" enums:"atomic,partial" example:"atomic"` //	@Description	atomic (the default) applies every operation or none; partial applies those that succeed
+	Operations []BatchOperation `json:"operations"`                                             //	@Description	The operations to run, in order
+}
+
+// BatchResponse lists the outcome of every operation of a batch, in order
+type BatchResponse struct {
+	Results []BatchItemResult `json:"results"` //	@Description	One result per operation
+}
+
+// BatchItemResult is the outcome of one operation of a batch
+type BatchItemResult struct {
+	Status  int      `json:"status" example:"201"` //	@Description	The HTTP status the operation would have had on its own
+	Product *Product `json:"product,omitempty"`    //	@Description	The created or updated product
+	Problem *Problem `json:"problem,omitempty"`    //	@Description	Why the operation failed
+}
+
+// checkBatchOperation validates an operation before it reaches the store.
+// Field names in the problem are relative to the operation.
+func checkBatchOperation(op BatchOperation) *Problem {
+	invalid := func(field, code, message string) *Problem {
+		p := newProblem(http.StatusBadRequest, problemValidation, "The operation is invalid")
+		p.Errors = []FieldError{{Field: field, Code: code, Message: message}}
+		return p
+	}
+
+	switch op.Op {
+	case batchCreate:
+		if op.Id != 0 || op.Version != 0 {
+			return invalid("id", "excluded", "must be left out of a create operation")
+		}
+	case batchUpdate, batchDelete:
+		if op.Id < 1 {
+			return invalid("id", "positive_integer", "must be a positive integer")
+		}
+		if op.Version < 0 {
+			return invalid("version", "gte", "must be greater than or equal to 0")
+		}
+	default:
+		return invalid("op", "oneof", "must be one of create, update or delete")
+	}
+
+	if op.Op == batchDelete {
+		if op.Product != nil {
+			return invalid("product", "excluded", "must be left out of a delete operation")
+		}
+		return nil
+	}
+	if op.Product == nil {
+		return invalid("product", "required", "is required")
+	}
+	if err := validate.Struct(op.Product); err != nil {
+		p := validationProblem(err)
+		if p == nil {
+			return invalid("product", "invalid", err.Error())
+		}
+		prefixFields(p, "product.")
+		return p
+	}
+	return nil
+}
+
+// batchItemProblem describes an error the store reported for one operation
+func batchItemProblem(op BatchOperation, err error) *Problem {
+	var p *Problem
+	switch {
+	case errors.Is(err, ErrProductConflict):
+		p = conflictProblem(err)
+		prefixFields(p, "product.")
+	case errors.Is(err, ErrVersionMismatch):
+		p = newProblem(http.StatusPreconditionFailed, problemPreconditionFailed, versionMismatchDetail)
+		p.Errors = []FieldError{{Field: "version", Code: "version", Message: "does not match the product's current version"}}
+	default:
+		p = newProblem(http.StatusNotFound, problemProductNotFound, fmt.Sprintf("No such product with id %d", op.Id))
+		p.Errors = []FieldError{{Field: "id", Code: "not_found", Message: "does not name an existing product"}}
+	}
+	return p
+}
+
+// batchSuccessStatus is the status an operation would have had on its own
+func batchSuccessStatus(op BatchOperation) int {
+	switch op.Op {
+	case batchCreate:
+		return http.StatusCreated
+	case batchDelete:
+		return http.StatusNoContent
+	}
+	return http.StatusOK
+}
+
+// operationFields returns the field errors of an operation's problem,
+// named from the root of the batch request
+func operationFields(index int, p *Problem) []FieldError {
+	fields := make([]FieldError, len(p.Errors))
+	for i, fieldErr := range p.Errors {
+		fieldErr.Field = fmt.Sprintf("operations[%d].%s", index, fieldErr.Field)
+		fields[i] = fieldErr
+	}
+	return fields
+}
+
+func prefixFields(p *Problem, prefix string) {
+	for i := range p.Errors {
+		p.Errors[i].Field = prefix + p.Errors[i].Field
+	}
+}
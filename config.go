@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// config is everything the server and its commands are configured with
+type config struct {
+	Port         int
+	Host         string
+	DatabaseFile string
+	DatabaseURL  string
+
+	RequireIfMatch bool
+	PublicReads    bool
+	// RBACPolicy is the path of a policy file replacing the default roles
+	RBACPolicy string
+
+	IdempotencyKeyTTL       time.Duration
+	DeletedProductRetention time.Duration
+
+	JWT         jwtConfig
+	JWKSRefresh time.Duration
+
+	RateLimits     map[string]RateLimit
+	TrustedProxies []string
+	CORS           corsConfig
+
+	// sources says where each setting's value came from, for config print
+	sources map[string]string
+}
+
+const defaultPort = 2400
+
+func defaultConfig() *config {
+	return &config{
+		Port:              defaultPort,
+		DatabaseFile:      "database.db",
+		IdempotencyKeyTTL: defaultIdempotencyTTL,
+		JWT:               jwtConfig{ClockSkew: defaultJWTClockSkew},
+		JWKSRefresh:       defaultJWKSRefresh,
+		RateLimits:        maps.Clone(defaultRateLimits),
+		CORS: corsConfig{
+			AllowedMethods: defaultCORSMethods,
+			AllowedHeaders: defaultCORSHeaders,
+			ExposedHeaders: defaultCORSExposedHeaders,
+			MaxAge:         defaultCORSMaxAge,
+		},
+		sources: map[string]string{},
+	}
+}
+
+// setting is one configuration value. It is named by its environment
+// variable; its flag and YAML key are derived from that name.
+type setting struct {
+	name    string
+	usage   string
+	boolean bool
+	// secret values are redacted by config print
+	secret bool
+	set    func(cfg *config, raw string) error
+	get    func(cfg *config) string
+}
+
+// flagName turns DATABASE_FILE into database-file
+func (s setting) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(s.name), "_", "-")
+}
+
+// yamlKey turns DATABASE_FILE into database_file
+func (s setting) yamlKey() string {
+	return strings.ToLower(s.name)
+}
+
+var settings = []setting{
+	{
+		name:  "PORT",
+		usage: "port to listen on",
+		set: func(cfg *config, raw string) error {
+			port, err := strconv.Atoi(raw)
+			if err != nil || port < 1 || port > 65535 {
+				return errors.New("must be a port number between 1 and 65535")
+			}
+			cfg.Port = port
+			return nil
+		},
+		get: func(cfg *config) string { return strconv.Itoa(cfg.Port) },
+	},
+	stringSetting("HOST", "host and port the API docs send requests to (default localhost:PORT)", func(cfg *config) *string { return &cfg.Host }),
+	stringSetting("DATABASE_FILE", "SQLite database file, unless DATABASE_URL is set", func(cfg *config) *string { return &cfg.DatabaseFile }),
+	{
+		name:   "DATABASE_URL",
+		usage:  "PostgreSQL connection string",
+		secret: true,
+		set:    func(cfg *config, raw string) error { cfg.DatabaseURL = raw; return nil },
+		get:    func(cfg *config) string { return cfg.DatabaseURL },
+	},
+	boolSetting("REQUIRE_IF_MATCH", "refuse changes to products without If-Match", func(cfg *config) *bool { return &cfg.RequireIfMatch }),
+	boolSetting("PUBLIC_READS", "let anonymous clients read products", func(cfg *config) *bool { return &cfg.PublicReads }),
+	stringSetting("RBAC_POLICY", "policy file replacing the default roles", func(cfg *config) *string { return &cfg.RBACPolicy }),
+	durationSetting("IDEMPOTENCY_KEY_TTL", "how long responses are replayed for a repeated Idempotency-Key", false, func(cfg *config) *time.Duration { return &cfg.IdempotencyKeyTTL }),
+	durationSetting("DELETED_PRODUCT_RETENTION", "how long deleted products are kept before they are purged automatically; 0, the default, never purges them", true, func(cfg *config) *time.Duration { return &cfg.DeletedProductRetention }),
+	stringSetting("JWT_JWKS", "path or URL of the key set bearer tokens are verified against", func(cfg *config) *string { return &cfg.JWT.JWKS }),
+	stringSetting("JWT_ISSUER", "iss claim bearer tokens must have", func(cfg *config) *string { return &cfg.JWT.Issuer }),
+	stringSetting("JWT_AUDIENCE", "aud claim bearer tokens must have", func(cfg *config) *string { return &cfg.JWT.Audience }),
+	durationSetting("JWT_CLOCK_SKEW", "leeway given to the times in bearer tokens", true, func(cfg *config) *time.Duration { return &cfg.JWT.ClockSkew }),
+	durationSetting("JWT_JWKS_REFRESH", "how often the key set is reloaded", false, func(cfg *config) *time.Duration { return &cfg.JWKSRefresh }),
+	rateLimitSetting(rateGroupRead, "requests per duration each client may make to read routes, such as 60/1m, or off"),
+	rateLimitSetting(rateGroupWrite, "requests per duration each client may make to write routes, such as 60/1m, or off"),
+	rateLimitSetting(rateGroupBulk, "requests per duration each client may make to bulk routes, such as 60/1m, or off"),
+	rateLimitSetting(rateGroupAuth, "requests with invalid credentials per duration each client IP may make, such as 20/1m, or off"),
+	{
+		name:  "TRUSTED_PROXIES",
+		usage: "proxies X-Forwarded-For is trusted from, as IP addresses or CIDR ranges",
+		set: func(cfg *config, raw string) error {
+			cfg.TrustedProxies = splitList(raw)
+			for _, proxy := range cfg.TrustedProxies {
+				if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+					return fmt.Errorf("%q is not an IP address or CIDR range", proxy)
+				}
+			}
+			return nil
+		},
+		get: func(cfg *config) string { return strings.Join(cfg.TrustedProxies, ",") },
+	},
+	listSetting("CORS_ALLOWED_ORIGINS", "origins browsers may call the API from, or *", func(cfg *config) *[]string { return &cfg.CORS.AllowedOrigins }),
+	{
+		name:  "CORS_ALLOWED_METHODS",
+		usage: "methods allowed from other origins",
+		set: func(cfg *config, raw string) error {
+			cfg.CORS.AllowedMethods = splitList(strings.ToUpper(raw))
+			return nil
+		},
+		get: func(cfg *config) string { return strings.Join(cfg.CORS.AllowedMethods, ",") },
+	},
+	listSetting("CORS_ALLOWED_HEADERS", "request headers allowed from other origins", func(cfg *config) *[]string { return &cfg.CORS.AllowedHeaders }),
+	listSetting("CORS_EXPOSED_HEADERS", "response headers scripts from other origins may read", func(cfg *config) *[]string { return &cfg.CORS.ExposedHeaders }),
+	boolSetting("CORS_ALLOW_CREDENTIALS", "let other origins send credentials", func(cfg *config) *bool { return &cfg.CORS.AllowCredentials }),
+	durationSetting("CORS_MAX_AGE", "how long browsers may cache preflight responses", true, func(cfg *config) *time.Duration { return &cfg.CORS.MaxAge }),
+}
+
+func stringSetting(name, usage string, field func(*config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set:   func(cfg *config, raw string) error { *field(cfg) = raw; return nil },
+		get:   func(cfg *config) string { return *field(cfg) },
+	}
+}
+
+func boolSetting(name, usage string, field func(*config) *bool) setting {
+	return setting{
+		name:    name,
+		usage:   usage,
+		boolean: true,
+		set: func(cfg *config, raw string) error {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return errors.New("must be true or false")
+			}
+			*field(cfg) = value
+			return nil
+		},
+		get: func(cfg *config) string { return strconv.FormatBool(*field(cfg)) },
+	}
+}
+
+// durationSetting reads a duration, which must be positive unless
+// allowZero is set
+func durationSetting(name, usage string, allowZero bool, field func(*config) *time.Duration) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(cfg *config, raw string) error {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 || (d == 0 && !allowZero) {
+				if allowZero {
+					return errors.New("must be a duration such as 1h30m, or 0")
+				}
+				return errors.New("must be a positive duration such as 1h30m")
+			}
+			*field(cfg) = d
+			return nil
+		},
+		get: func(cfg *config) string { return formatDuration(*field(cfg)) },
+	}
+}
+
+func listSetting(name, usage string, field func(*config) *[]string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set:   func(cfg *config, raw string) error { *field(cfg) = splitList(raw); return nil },
+		get:   func(cfg *config) string { return strings.Join(*field(cfg), ",") },
+	}
+}
+
+func rateLimitSetting(group, usage string) setting {
+	return setting{
+		name:  "RATE_LIMIT_" + strings.ToUpper(group),
+		usage: usage,
+		set: func(cfg *config, raw string) error {
+			limit, err := parseRateLimit(raw)
+			if err != nil {
+				return errors.New("must be a number of requests per duration such as 60/1m, or off")
+			}
+			cfg.RateLimits[group] = limit
+			return nil
+		},
+		get: func(cfg *config) string { return cfg.RateLimits[group].String() },
+	}
+}
+
+// loadConfig reads the settings from, in increasing order of precedence:
+// their defaults, a YAML config file, a .env file, the environment, and
+// command-line flags. An explicitly empty value overrides the sources
+// below it like any other, and puts the setting back to its default. The
+// config file is named by -config or CONFIG_FILE, and is optional; so is
+// .env, unless -env-file names another file. Every invalid setting is
+// reported at once. The arguments left after the flags are returned.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*config, []string, error) {
+	flags := flag.NewFlagSet("productapi", flag.ContinueOnError)
+	configFile := flags.String("config", "", "YAML config file")
+	envFile := flags.String("env-file", "", "file of environment variables (default .env)")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		flags.Var(settingFlag{s, flagValues}, s.flagName(), s.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	dotenvPath := ".env"
+	if *envFile != "" {
+		dotenvPath = *envFile
+	}
+	dotenv, err := godotenv.Read(dotenvPath)
+	if err != nil {
+		if *envFile != "" || !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, fmt.Errorf("config: %w", err)
+		}
+		dotenv = map[string]string{}
+	}
+
+	if *configFile == "" {
+		if path, ok := lookupEnv("CONFIG_FILE"); ok {
+			*configFile = path
+		} else {
+			*configFile = dotenv["CONFIG_FILE"]
+		}
+	}
+	fileValues := map[string]string{}
+	if *configFile != "" {
+		if fileValues, err = readConfigFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cfg := defaultConfig()
+	var problems []string
+	for _, s := range settings {
+		raw, source := "", ""
+		if value, ok := fileValues[s.yamlKey()]; ok {
+			raw, source = value, *configFile
+		}
+		if value, ok := dotenv[s.name]; ok {
+			raw, source = value, dotenvPath
+		}
+		if value, ok := lookupEnv(s.name); ok {
+			raw, source = value, "environment"
+		}
+		if value, ok := flagValues[s.name]; ok {
+			raw, source = value, "-"+s.flagName()+" flag"
+		}
+		// an empty value still overrides the sources below it, leaving
+		// the setting at its default
+		switch {
+		case source == "":
+			cfg.sources[s.name] = "default"
+			continue
+		case raw == "":
+			cfg.sources[s.name] = "default (empty in " + source + ")"
+			continue
+		}
+		cfg.sources[s.name] = source
+		if err := s.set(cfg, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s, got %q (from %s)", s.name, err, raw, source))
+		}
+	}
+
+	if cfg.Host == "" {
+		cfg.Host = fmt.Sprintf("localhost:%d", cfg.Port)
+	}
+	if err := cfg.CORS.validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return cfg, flags.Args(), nil
+}
+
+// settingFlag records the flags given on the command line, so they only
+// override other sources when set
+type settingFlag struct {
+	setting setting
+	values  map[string]string
+}
+
+func (f settingFlag) String() string {
+	return ""
+}
+
+func (f settingFlag) Set(raw string) error {
+	f.values[f.setting.name] = raw
+	return nil
+}
+
+func (f settingFlag) IsBoolFlag() bool {
+	return f.setting.boolean
+}
+
+// readConfigFile reads a YAML file of settings keyed by their lower case
+// environment variable names, such as
+//
+//	port: 8080
+//	rate_limit_write: 30/1m
+//	cors_allowed_origins: [https://admin.example.com]
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	var file map[string]any
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, s := range settings {
+		known[s.yamlKey()] = true
+	}
+	values := map[string]string{}
+	for key, value := range file {
+		if !known[key] {
+			return nil, fmt.Errorf("config: %s: unknown setting %q", path, key)
+		}
+		switch value := value.(type) {
+		case nil:
+			values[key] = ""
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config: %s: %s must be a value or a list", path, key)
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// runConfigCommand implements the config subcommand, which prints the
+// effective settings and where each came from
+func runConfigCommand(cfg *config, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	for _, s := range settings {
+		value := s.get(cfg)
+		if s.secret {
+			value = redact(value)
+		}
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.name, value, cfg.sources[s.name])
+	}
+	return w.Flush()
+}
+
+// redact hides the password of a connection URL, and anything else that
+// is not a URL as a whole
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "[redacted]"
+	}
+	if query := u.Query(); query.Has("password") {
+		query.Set("password", "xxxxx")
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// formatDuration drops the zero units time.Duration leaves in, printing 24h
+// rather than 24h0m0s
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsConfig says which browser origins may call the API, and with what
+type corsConfig struct {
+	// AllowedOrigins are origins such as https://admin.example.com, or just
+	// * for any origin. CORS is off while there are none.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "If-Match", "If-None-Match", "Idempotency-Key", apiKeyHeader, "X-Request-Id", tenantHeader}
+	// defaultCORSExposedHeaders are the response headers scripts may read
+	// besides the ones browsers always expose
+	defaultCORSExposedHeaders = []string{"ETag", "Link", "Content-Disposition", "Idempotent-Replayed", "Retry-After",
+		"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "X-Request-Id"}
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+// validate refuses origins browsers would never send, and any origin at all
+// together with credentials: letting every site make requests with the
+// user's credentials would hand them to whichever site the user visits
+func (cfg corsConfig) validate() error {
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			if cfg.AllowCredentials {
+				return errors.New("CORS_ALLOWED_ORIGINS cannot be * while CORS_ALLOW_CREDENTIALS is set; list the origins instead")
+			}
+			if len(cfg.AllowedOrigins) > 1 {
+				return errors.New("CORS_ALLOWED_ORIGINS must not list other origins besides *")
+			}
+			continue
+		}
+		if strings.Contains(origin, "*") {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %q: wildcard patterns are not supported, list each origin", origin)
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %q is not an origin such as https://admin.example.com", origin)
+		}
+	}
+	return nil
+}
+
+// corsPolicy answers preflight requests from allowed origins and lets
+// browsers read the responses to their actual requests. Requests without an
+// Origin, or from origins not allowed, are passed on untouched, for the
+// browser to block; preflights from them are refused outright.
+func corsPolicy(cfg corsConfig) gin.HandlerFunc {
+	anyOrigin := slices.Contains(cfg.AllowedOrigins, "*")
+	origins := map[string]bool{}
+	for _, origin := range cfg.AllowedOrigins {
+		origins[strings.ToLower(origin)] = true
+	}
+	headers := map[string]bool{}
+	for _, name := range cfg.AllowedHeaders {
+		headers[http.CanonicalHeaderKey(name)] = true
+	}
+
+	return func(c *gin.Context) {
+		header := c.Writer.Header()
+		if !anyOrigin {
+			header.Add("Vary", "Origin")
+		}
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		requestedMethod := c.GetHeader("Access-Control-Request-Method")
+		preflight := c.Request.Method == http.MethodOptions && requestedMethod != ""
+		if !anyOrigin && !origins[strings.ToLower(origin)] {
+			if preflight {
+				writeProblem(c, newProblem(http.StatusForbidden, problemCORSRejected, "Requests from "+origin+" are not allowed"))
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if anyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(cfg.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+			}
+			c.Next()
+			return
+		}
+
+		if !slices.Contains(cfg.AllowedMethods, requestedMethod) {
+			writeProblem(c, newProblem(http.StatusForbidden, problemCORSRejected, requestedMethod+" requests are not allowed from other origins"))
+			return
+		}
+		for _, name := range splitList(c.GetHeader("Access-Control-Request-Headers")) {
+			if !headers[http.CanonicalHeaderKey(name)] {
+				writeProblem(c, newProblem(http.StatusForbidden, problemCORSRejected, "The "+name+" header is not allowed from other origins"))
+				return
+			}
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		if cfg.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// splitList splits a comma separated list, dropping blank entries
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
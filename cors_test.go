@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCORSConfigValidate(t *testing.T) {
+	valid := corsConfig{AllowedOrigins: []string{"https://admin.example.com", "http://localhost:5173"}, AllowCredentials: true}
+	if err := valid.validate(); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  corsConfig
+		want string
+	}{
+		{"Any origin with credentials", corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, "cannot be *"},
+		{"Any origin among others", corsConfig{AllowedOrigins: []string{"*", "https://admin.example.com"}}, "besides *"},
+		{"Wildcard pattern", corsConfig{AllowedOrigins: []string{"https://*.example.com"}}, "wildcard patterns"},
+		{"Trailing slash", corsConfig{AllowedOrigins: []string{"https://admin.example.com/"}}, "is not an origin"},
+		{"Without scheme", corsConfig{AllowedOrigins: []string{"admin.example.com"}}, "is not an origin"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v expected an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect captures the differences between the SQL backends SQLStore runs on
+type dialect interface {
+	// Name selects the migrations/<name> directory
+	Name() string
+	// DriverName is the database/sql driver the dialect is used with
+	DriverName() string
+	// Rebind rewrites ? placeholders into the driver's native form
+	Rebind(query string) string
+	// UniqueViolation reports whether err is a unique constraint failure
+	// and, if so, which products column caused it
+	UniqueViolation(err error) (column string, ok bool)
+	// TimeValue converts a timestamp into the form the driver stores and
+	// compares correctly
+	TimeValue(t time.Time) any
+	// ForUpdate is appended to a SELECT to lock the rows it reads until the
+	// transaction ends
+	ForUpdate() string
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) DriverName() string { return "sqlite3" }
+
+func (sqliteDialect) Rebind(query string) string { return query }
+
+func (sqliteDialect) UniqueViolation(err error) (string, bool) {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return "", false
+	}
+	// the message reads "UNIQUE constraint failed: products.tenant_id,
+	// products.<column>", the tenant coming first
+	message := sqliteErr.Error()
+	i := strings.LastIndex(message, "products.")
+	if i < 0 {
+		return "", true
+	}
+	return message[i+len("products."):], true
+}
+
+// sqliteTimeLayout is fixed width so timestamps stored as TEXT sort and
+// compare chronologically
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+func (sqliteDialect) TimeValue(t time.Time) any {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// SQLite has no row locks. Writers serialize on the database lock instead,
+// which openDatabase makes transactions take as they begin.
+func (sqliteDialect) ForUpdate() string { return "" }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) DriverName() string { return "postgres" }
+
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) UniqueViolation(err error) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return "", false
+	}
+	// constraints follow PostgreSQL's products_<column>_key naming
+	column := strings.TrimSuffix(strings.TrimPrefix(pqErr.Constraint, "products_"), "_key")
+	return column, true
+}
+
+func (postgresDialect) TimeValue(t time.Time) any {
+	return t
+}
+
+func (postgresDialect) ForUpdate() string { return " FOR UPDATE" }
+
+// openDatabase connects to PostgreSQL when databaseURL is set and falls back
+// to the SQLite file otherwise
+func openDatabase(databaseURL, databaseFile string) (*sql.DB, dialect, error) {
+	var d dialect = sqliteDialect{}
+	dsn := sqliteDSN(databaseFile)
+	if databaseURL != "" {
+		d = postgresDialect{}
+		dsn = databaseURL
+	}
+
+	db, err := sql.Open(d.DriverName(), dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, d, nil
+}
+
+// sqliteDSN opens transactions with BEGIN IMMEDIATE. Writes read the row
+// before changing it, and two deferred transactions that have both read
+// cannot both upgrade to the write lock: one fails with "database is locked"
+// at once, where waiting for the lock up front lets the busy timeout queue
+// them.
+func sqliteDSN(databaseFile string) string {
+	separator := "?"
+	if strings.Contains(databaseFile, "?") {
+		separator = "&"
+	}
+	return databaseFile + separator + "_txlock=immediate"
+}
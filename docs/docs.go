@@ -17,36 +17,158 @@ const docTemplate = `{
     "paths": {
         "/products": {
             "get": {
-                "description": "Get all products or retrieve a specific product by name. Name query parameter is optional.",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get a filtered, sorted page of products, or retrieve a specific product by its exact name.\nFilters take the form field[op]=value. id and price support eq, ne, gt, gte, lt, lte and in;\nname, description, currency and sku support eq, ne, contains, prefix and in;\ncreated_at and updated_at support gt, gte, lt and lte with an RFC 3339 timestamp or a YYYY-MM-DD date.\ncontains and prefix ignore case; in takes a comma separated list. Any of these fields can be used in sort.\nUse either offset or the opaque cursor returned as next_cursor to move between pages; the Link header carries the same URLs.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "products"
                 ],
-                "summary": "List all products or get a product by name",
+                "summary": "List products or get a product by name",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Name of the product to retrieve",
+                        "description": "Exact name of a single product to retrieve",
                         "name": "name",
                         "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Case-insensitive substring of the product name",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated fields to sort by, prefixed with - for descending (default id)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Example filter: products with an id of at least this value",
+                        "name": "id[gte]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Example filter: products whose name starts with this value",
+                        "name": "name[prefix]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Example filter: products created on or after this date",
+                        "name": "created_at[gte]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 20, maximum 100)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of products to skip",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from a previous page's next_cursor",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Also list products in the trash",
+                        "name": "include_deleted",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a copy the client already holds",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/main.Product"
+                            "$ref": "#/definitions/main.ProductList"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "The product version, or a hash of a listing"
+                            },
+                            "Link": {
+                                "type": "string",
+                                "description": "RFC 8288 links to the next, previous and first pages"
                             }
                         }
+                    },
+                    "304": {
+                        "description": "The copy named in If-None-Match is current"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
             },
             "put": {
-                "description": "Update a product's information by name",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Replace a product's information by name. Fields left out of the body are reset to their zero value.",
                 "consumes": [
                     "application/json"
                 ],
@@ -73,6 +195,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.Product"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have; required when REQUIRE_IF_MATCH is set",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -81,11 +209,79 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.Product"
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
             },
             "post": {
-                "description": "Add a new product to the database",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Add a new product to the database. Send an Idempotency-Key to make retries safe: the first\nresponse for a key is replayed to later requests with the same key and body.",
                 "consumes": [
                     "application/json"
                 ],
@@ -105,6 +301,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.Product"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key that makes retries of this request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -112,12 +314,74 @@ const docTemplate = `{
                         "description": "Created",
                         "schema": {
                             "$ref": "#/definitions/main.Product"
+                        },
+                        "headers": {
+                            "Idempotent-Replayed": {
+                                "type": "string",
+                                "description": "Set to true when the response is a replay of an earlier request with the same key"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             },
             "delete": {
-                "description": "Remove a product's information by name",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Move a product to the trash by name. It can be restored by id until it is purged.",
                 "consumes": [
                     "application/json"
                 ],
@@ -135,71 +399,1340 @@ const docTemplate = `{
                         "name": "name",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have; required when REQUIRE_IF_MATCH is set",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "204": {
                         "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
             }
         },
-        "/products/{id}": {
-            "get": {
-                "description": "Get a product by its ID",
+        "/products/batch": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Run up to 1000 create, update and delete operations in order, in one transaction.\nIn atomic mode (the default) either every operation succeeds and the response is 200,\nor nothing is changed and the response is a problem naming the failing operation.\nIn partial mode the operations that succeed are kept and the response is 207 with a result per operation.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "products"
                 ],
-                "summary": "Get a product",
+                "summary": "Create, update and delete products in bulk",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Product ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Operations to run",
+                        "name": "batch",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.BatchRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/main.Product"
+                            "$ref": "#/definitions/main.BatchResponse"
+                        }
+                    },
+                    "207": {
+                        "description": "Multi-Status",
+                        "schema": {
+                            "$ref": "#/definitions/main.BatchResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
-            },
-            "put": {
-                "description": "Update a product's information",
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/products/export": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
                 ],
+                "description": "Stream every product matching the filters, without paging, as CSV, newline-delimited JSON or a JSON array.\nFilters, q and sort work as on GET /products; limit, offset and cursor are ignored.\nThe response is sent as it is read from the database. Should the export fail part way through, the body ends early.",
                 "produces": [
+                    "text/csv",
+                    "application/x-ndjson",
                     "application/json"
                 ],
                 "tags": [
                     "products"
                 ],
-                "summary": "Update a product",
+                "summary": "Export products",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Product ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "type": "string",
+                        "description": "csv, ndjson or json (default json)",
+                        "name": "format",
+                        "in": "query"
                     },
                     {
-                        "description": "Updated product object",
-                        "name": "product",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/main.Product"
-                        }
+                        "type": "string",
+                        "description": "Comma separated fields to sort by, prefixed with - for descending (default id)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Case-insensitive substring of the product name",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Also export products in the trash",
+                        "name": "include_deleted",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Product"
+                            }
+                        },
+                        "headers": {
+                            "Content-Disposition": {
+                                "type": "string",
+                                "description": "attachment with a timestamped file name"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/import": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Create or update products from a CSV file with a header row, or from newline-delimited JSON objects.\nColumns, or keys, may be name, description, price, currency and sku; fields left out keep their current value on update.\nEach row is matched to an existing product by name or, with key=sku, by SKU, and validated like a POST body.\nRows are processed one at a time as the file streams in; a failing row is reported and the import carries on.\nWith dry_run=true nothing is written and the report says what would happen.",
+                "consumes": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Import products from CSV or NDJSON",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Field rows are matched on: name (default) or sku",
+                        "name": "key",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Report what would change without writing",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "description": "CSV or NDJSON rows",
+                        "name": "file",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportReport"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/search": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Full-text search over product names and descriptions, best match first.\nWords are ANDed together, \"quoted phrases\" must appear in order and a trailing * turns a word or phrase into a prefix query.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Search products",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Search query, e.g. \\",
+                        "name": "q",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 20, maximum 100)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of results to skip",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.SearchPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "501": {
+                        "description": "Not Implemented",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/trash": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get a page of the products in the trash, with the same filters, sort and paging as GET /products.\nDeleted products stay here until they are purged, by hand or after DELETED_PRODUCT_RETENTION if it is set.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "List deleted products",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Comma separated fields to sort by, prefixed with - for descending (default id)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 20, maximum 100)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of products to skip",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from a previous page's next_cursor",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ProductList"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get a product by its ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Also find the product if it is in the trash",
+                        "name": "include_deleted",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a copy the client already holds",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "The product version, or a hash of a listing"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The copy named in If-None-Match is current"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Replace a product's information. Fields left out of the body are reset to their zero value.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Update a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Updated product object",
+                        "name": "product",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have; required when REQUIRE_IF_MATCH is set",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Move a product to the trash. It disappears from reads and frees its name and SKU, but can be restored until it is purged.",
+                "tags": [
+                    "products"
+                ],
+                "summary": "Delete a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have; required when REQUIRE_IF_MATCH is set",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Change some of a product's fields. Send either an RFC 7386 merge patch as application/merge-patch+json,\ne.g. {\"price\": 250, \"sku\": null}, or an RFC 6902 JSON Patch as application/json-patch+json,\ne.g. [{\"op\": \"replace\", \"path\": \"/price\", \"value\": 250}]. The patch is applied and the result\nvalidated in one transaction; a patch that changes id, created_at, updated_at or version is rejected with 422.",
+                "consumes": [
+                    "application/merge-patch+json",
+                    "application/json-patch+json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Patch a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Merge patch or JSON Patch document",
+                        "name": "patch",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have; required when REQUIRE_IF_MATCH is set",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}/diff": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "List the fields that differ between two revisions of a product.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Compare two revisions of a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "The older revision",
+                        "name": "from",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "The newer revision (default the current one)",
+                        "name": "to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ProductDiff"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}/history": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "List every change made to a product, newest first: who made it, through which request, and the product before and after.\nThe history outlives the product, so it can still be read after the product has been purged.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get a product's history",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 20, maximum 100)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from a previous page's next_cursor",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ProductHistory"
+                        },
+                        "headers": {
+                            "Link": {
+                                "type": "string",
+                                "description": "RFC 8288 link to the next page"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}/restore": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Take a product out of the trash. This fails with 409 when another product has taken its name or SKU in the meantime.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Restore a deleted product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the deleted product must still have",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "The product version"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}/revisions": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the revision of a product that was current at the given time, including a deleted one.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get a product as it was at a point in time",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 timestamp or YYYY-MM-DD date",
+                        "name": "at",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/{id}/revisions/{revision}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get a product as it was at one of its revisions. Every change makes a new revision, numbered like the product's version.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get a revision of a product",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Revision number",
+                        "name": "revision",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
@@ -208,15 +1741,64 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.Product"
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
-            },
-            "delete": {
-                "description": "Delete a product by its ID",
+            }
+        },
+        "/products/{id}/revisions/{revision}/revert": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Write the name, description, price, currency and SKU of an earlier revision as a new revision.\nThe product must not be deleted; restore it first.",
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "products"
                 ],
-                "summary": "Delete a product",
+                "summary": "Revert a product to an earlier revision",
                 "parameters": [
                     {
                         "type": "integer",
@@ -224,36 +1806,546 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Revision to go back to",
+                        "name": "revision",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the product must still have",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
+                            "$ref": "#/definitions/main.Product"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "The product version"
                             }
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
             }
         }
     },
     "definitions": {
+        "main.AuditRecord": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "description": "@Description\tWhat happened to the product",
+                    "type": "string",
+                    "enum": [
+                        "create",
+                        "update",
+                        "delete",
+                        "restore",
+                        "purge"
+                    ],
+                    "example": "update"
+                },
+                "actor": {
+                    "description": "@Description\tWho made the change",
+                    "type": "string",
+                    "example": "anonymous"
+                },
+                "after": {
+                    "description": "@Description\tThe product after the change; absent for a purge",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    ]
+                },
+                "before": {
+                    "description": "@Description\tThe product before the change; absent for a create",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    ]
+                },
+                "created_at": {
+                    "description": "@Description\tWhen the change was made",
+                    "type": "string"
+                },
+                "id": {
+                    "description": "@Description\tThe unique ID of the entry",
+                    "type": "integer",
+                    "example": 42
+                },
+                "product_id": {
+                    "description": "@Description\tThe product that changed",
+                    "type": "integer",
+                    "example": 3
+                },
+                "request_id": {
+                    "description": "@Description\tThe X-Request-Id of the request that made the change",
+                    "type": "string",
+                    "example": "4f1c2a9e0b7d4e3a8c6f5b2d1e0a9c8b"
+                },
+                "version": {
+                    "description": "@Description\tThe product's version after the change, or before it for a purge",
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "main.BatchItemResult": {
+            "type": "object",
+            "properties": {
+                "problem": {
+                    "description": "@Description\tWhy the operation failed",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    ]
+                },
+                "product": {
+                    "description": "@Description\tThe created or updated product",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    ]
+                },
+                "status": {
+                    "description": "@Description\tThe HTTP status the operation would have had on its own",
+                    "type": "integer",
+                    "example": 201
+                }
+            }
+        },
+        "main.BatchOperation": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "description": "@Description\tThe product to update or delete",
+                    "type": "integer",
+                    "example": 3
+                },
+                "op": {
+                    "description": "@Description\tWhat to do: create, update or delete",
+                    "type": "string",
+                    "enum": [
+                        "create",
+                        "update",
+                        "delete"
+                    ],
+                    "example": "update"
+                },
+                "product": {
+                    "description": "@Description\tThe new product, for create and update",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    ]
+                },
+                "version": {
+                    "description": "@Description\tVersion the product must still have, like If-Match; omit to write unconditionally",
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "main.BatchRequest": {
+            "type": "object",
+            "properties": {
+                "mode": {
+                    "description": "@Description\tatomic (the default) applies every operation or none; partial applies those that succeed",
+                    "type": "string",
+                    "enum": [
+                        "atomic",
+                        "partial"
+                    ],
+                    "example": "atomic"
+                },
+                "operations": {
+                    "description": "@Description\tThe operations to run, in order",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BatchOperation"
+                    }
+                }
+            }
+        },
+        "main.BatchResponse": {
+            "type": "object",
+            "properties": {
+                "results": {
+                    "description": "@Description\tOne result per operation",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BatchItemResult"
+                    }
+                }
+            }
+        },
+        "main.FieldChange": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "description": "@Description\tThe product field",
+                    "type": "string",
+                    "example": "name"
+                },
+                "from": {
+                    "description": "@Description\tIts value in the older revision"
+                },
+                "to": {
+                    "description": "@Description\tIts value in the newer revision"
+                }
+            }
+        },
+        "main.FieldError": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "description": "@Description\tMachine-readable rule that failed",
+                    "type": "string",
+                    "example": "iso4217"
+                },
+                "field": {
+                    "description": "@Description\tJSON name of the offending field",
+                    "type": "string",
+                    "example": "currency"
+                },
+                "message": {
+                    "description": "@Description\tHuman-readable explanation",
+                    "type": "string",
+                    "example": "must be an ISO 4217 currency code"
+                }
+            }
+        },
+        "main.ImportReport": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "description": "@Description\tNumber of products created",
+                    "type": "integer"
+                },
+                "dry_run": {
+                    "description": "@Description\tWhether the import only reported what it would do",
+                    "type": "boolean"
+                },
+                "failed": {
+                    "description": "@Description\tNumber of rows that could not be imported",
+                    "type": "integer"
+                },
+                "rows": {
+                    "description": "@Description\tRows that changed something or failed",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.ImportRowResult"
+                    }
+                },
+                "unchanged": {
+                    "description": "@Description\tNumber of rows that matched a product exactly",
+                    "type": "integer"
+                },
+                "updated": {
+                    "description": "@Description\tNumber of products updated",
+                    "type": "integer"
+                }
+            }
+        },
+        "main.ImportRowResult": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "description": "@Description\tWhat happened to the row",
+                    "type": "string",
+                    "enum": [
+                        "create",
+                        "update",
+                        "error"
+                    ],
+                    "example": "update"
+                },
+                "errors": {
+                    "description": "@Description\tWhy the row failed",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FieldError"
+                    }
+                },
+                "id": {
+                    "description": "@Description\tThe product created or updated; absent for rows created in a dry run",
+                    "type": "integer"
+                },
+                "line": {
+                    "description": "@Description\tLine of the file the row starts on",
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "main.Problem": {
+            "type": "object",
+            "properties": {
+                "detail": {
+                    "description": "@Description\tExplanation specific to this occurrence",
+                    "type": "string"
+                },
+                "errors": {
+                    "description": "@Description\tPer-field problems, for validation failures",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FieldError"
+                    }
+                },
+                "instance": {
+                    "description": "@Description\tThe request path the problem occurred on",
+                    "type": "string",
+                    "example": "/products"
+                },
+                "status": {
+                    "description": "@Description\tThe HTTP status code",
+                    "type": "integer",
+                    "example": 400
+                },
+                "title": {
+                    "description": "@Description\tShort summary of the problem type",
+                    "type": "string",
+                    "example": "Validation failed"
+                },
+                "type": {
+                    "description": "@Description\tStable URI reference identifying the kind of problem",
+                    "type": "string",
+                    "example": "/problems/validation-failed"
+                }
+            }
+        },
         "main.Product": {
             "type": "object",
+            "required": [
+                "name"
+            ],
             "properties": {
+                "created_at": {
+                    "description": "@Description\tWhen the product was created",
+                    "type": "string"
+                },
+                "currency": {
+                    "description": "@Description\tThe ISO 4217 code of the price currency",
+                    "type": "string",
+                    "example": "USD"
+                },
+                "deleted_at": {
+                    "description": "@Description\tWhen the product was deleted; absent for products that are not",
+                    "type": "string"
+                },
+                "description": {
+                    "description": "@Description\tA longer description of the product",
+                    "type": "string",
+                    "maxLength": 5000
+                },
                 "id": {
                     "description": "@Description\tThe unique ID of the product",
                     "type": "integer"
                 },
                 "name": {
                     "description": "@Description\tThe name of the product",
+                    "type": "string",
+                    "maxLength": 200
+                },
+                "price": {
+                    "description": "@Description\tThe price in minor units of the currency, e.g. cents",
+                    "type": "integer",
+                    "minimum": 0,
+                    "example": 1999
+                },
+                "sku": {
+                    "description": "@Description\tThe unique stock keeping unit",
+                    "type": "string",
+                    "maxLength": 64,
+                    "example": "TEA-GRN-250"
+                },
+                "updated_at": {
+                    "description": "@Description\tWhen the product was last changed",
+                    "type": "string"
+                },
+                "version": {
+                    "description": "@Description\tBumped on every change; the product's ETag is this number in quotes",
+                    "type": "integer",
+                    "example": 1
+                }
+            }
+        },
+        "main.ProductDiff": {
+            "type": "object",
+            "properties": {
+                "changes": {
+                    "description": "@Description\tFields that differ; empty when the revisions are alike",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FieldChange"
+                    }
+                },
+                "from": {
+                    "description": "@Description\tThe older revision",
+                    "type": "integer",
+                    "example": 2
+                },
+                "to": {
+                    "description": "@Description\tThe newer revision",
+                    "type": "integer",
+                    "example": 5
+                }
+            }
+        },
+        "main.ProductHistory": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "description": "@Description\tChanges on this page, newest first",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.AuditRecord"
+                    }
+                },
+                "next_cursor": {
+                    "description": "@Description\tOpaque cursor for older changes, absent on the last page",
+                    "type": "string"
+                }
+            }
+        },
+        "main.ProductList": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "description": "@Description\tThe products on this page",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Product"
+                    }
+                },
+                "next_cursor": {
+                    "description": "@Description\tOpaque cursor for the next page, absent on the last page",
+                    "type": "string"
+                },
+                "total": {
+                    "description": "@Description\tThe number of products across all pages",
+                    "type": "integer"
+                }
+            }
+        },
+        "main.SearchPage": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "description": "@Description\tThe results on this page",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.SearchResult"
+                    }
+                },
+                "total": {
+                    "description": "@Description\tThe number of matching products across all pages",
+                    "type": "integer"
+                }
+            }
+        },
+        "main.SearchResult": {
+            "type": "object",
+            "properties": {
+                "product": {
+                    "description": "@Description\tThe matching product",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Product"
+                        }
+                    ]
+                },
+                "rank": {
+                    "description": "@Description\tBM25 score; lower is a better match",
+                    "type": "number"
+                },
+                "snippet": {
+                    "description": "@Description\tHTML-escaped excerpt with matched terms wrapped in \u003cmark\u003e tags",
                     "type": "string"
                 }
             }
         }
+    },
+    "securityDefinitions": {
+        "ApiKeyAuth": {
+            "type": "apiKey",
+            "name": "X-API-Key",
+            "in": "header"
+        },
+        "BearerAuth": {
+            "description": "A JWT from a trusted issuer, as \"Bearer \u003ctoken\u003e\"",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
+        }
     }
 }`
 
@@ -264,7 +2356,7 @@ var SwaggerInfo = &swag.Spec{
 	BasePath:         "/",
 	Schemes:          []string{},
 	Title:            "Product API",
-	Description:      "The name of the product",
+	Description:      "When the product was deleted; absent for products that are not",
 	InfoInstanceName: "swagger",
 	SwaggerTemplate:  docTemplate,
 	LeftDelim:        "{{",
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// productETag is the strong ETag of a single product, its quoted version
+func productETag(product Product) string {
+	return `"` + strconv.FormatInt(product.Version, 10) + `"`
+}
+
+// weakETag identifies a representation that has no version of its own,
+// such as a listing, by hashing its body
+func weakETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the ETag header and answers 304 Not Modified when
+// If-None-Match already names etag. Handlers stop when it returns true.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+
+	header := c.GetHeader("If-None-Match")
+	if header == "" {
+		return false
+	}
+	// If-None-Match uses the weak comparison
+	for _, tag := range splitETags(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			c.AbortWithStatus(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag renders value as JSON with a weak ETag of its body,
+// honouring If-None-Match
+func writeJSONWithETag(c *gin.Context, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		internalError(c, "Unable to encode the response", err)
+		return
+	}
+	if notModified(c, weakETag(body)) {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// ifMatchVersion reads the product version an If-Match header requires,
+// or zero when there is no header or it is *. When the header can never
+// match it writes the problem and returns false.
+func ifMatchVersion(c *gin.Context) (int64, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return 0, true
+	}
+
+	tags := splitETags(header)
+	for _, tag := range tags {
+		if tag == "*" {
+			return 0, true
+		}
+	}
+	if len(tags) != 1 {
+		badRequest(c, problemInvalidPrecondition, "If-Match must name a single ETag")
+		return 0, false
+	}
+
+	// If-Match uses the strong comparison, so weak tags never match
+	raw, ok := strings.CutPrefix(tags[0], `"`)
+	raw, quoted := strings.CutSuffix(raw, `"`)
+	version, err := strconv.ParseInt(raw, 10, 64)
+	if !ok || !quoted || err != nil || version < 1 {
+		preconditionFailed(c)
+		return 0, false
+	}
+	return version, true
+}
+
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func preconditionFailed(c *gin.Context) {
+	writeProblem(c, newProblem(http.StatusPreconditionFailed, problemPreconditionFailed, versionMismatchDetail))
+}
+
+const versionMismatchDetail = "The product has changed since it was read. Fetch it again and retry with its current ETag"
+
+// requirePreconditions rejects writes that do not send If-Match, so clients
+// cannot overwrite changes they have not seen
+func requirePreconditions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if c.GetHeader("If-Match") == "" {
+				writeProblem(c, newProblem(http.StatusPreconditionRequired, problemPreconditionRequired, "Send the product's ETag in If-Match, or * to write unconditionally"))
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// exportColumns is the header row of a CSV export
+var exportColumns = []string{"id", "name", "description", "price", "currency", "sku", "created_at", "updated_at", "version", "deleted_at"}
+
+// exportFormat is one of the formats GET /products/export can stream
+type exportFormat struct {
+	ContentType string
+	Extension   string
+	NewEncoder  func(w io.Writer) productEncoder
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":    {ContentType: mediaTypeCSV + "; charset=utf-8", Extension: ".csv", NewEncoder: newCSVProductEncoder},
+	"ndjson": {ContentType: mediaTypeNDJSON, Extension: ".ndjson", NewEncoder: newNDJSONProductEncoder},
+	"json":   {ContentType: "application/json; charset=utf-8", Extension: ".json", NewEncoder: newJSONProductEncoder},
+}
+
+// productEncoder writes products one at a time. Close writes whatever ends
+// the document; it does not close the underlying writer.
+type productEncoder interface {
+	Encode(product Product) error
+	Close() error
+}
+
+type csvProductEncoder struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCSVProductEncoder(w io.Writer) productEncoder {
+	writer := csv.NewWriter(w)
+	writer.Write(exportColumns)
+	return &csvProductEncoder{writer: writer, record: make([]string, len(exportColumns))}
+}
+
+func (e *csvProductEncoder) Encode(product Product) error {
+	e.record[0] = strconv.Itoa(product.Id)
+	e.record[1] = product.Name
+	e.record[2] = product.Description
+	e.record[3] = strconv.FormatInt(product.Price, 10)
+	e.record[4] = product.Currency
+	e.record[5] = product.Sku
+	e.record[6] = product.CreatedAt.Format(time.RFC3339Nano)
+	e.record[7] = product.UpdatedAt.Format(time.RFC3339Nano)
+	e.record[8] = strconv.FormatInt(product.Version, 10)
+	e.record[9] = ""
+	if product.DeletedAt != nil {
+		e.record[9] = product.DeletedAt.Format(time.RFC3339Nano)
+	}
+	return e.writer.Write(e.record)
+}
+
+func (e *csvProductEncoder) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonProductEncoder struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONProductEncoder(w io.Writer) productEncoder {
+	return &ndjsonProductEncoder{encoder: json.NewEncoder(w)}
+}
+
+func (e *ndjsonProductEncoder) Encode(product Product) error {
+	return e.encoder.Encode(product)
+}
+
+func (e *ndjsonProductEncoder) Close() error {
+	return nil
+}
+
+// jsonProductEncoder writes a single JSON array
+type jsonProductEncoder struct {
+	writer io.Writer
+	count  int
+}
+
+func newJSONProductEncoder(w io.Writer) productEncoder {
+	return &jsonProductEncoder{writer: w}
+}
+
+func (e *jsonProductEncoder) Encode(product Product) error {
+	raw, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+	separator := ","
+	if e.count == 0 {
+		separator = "["
+	}
+	e.count++
+	if _, err := io.WriteString(e.writer, separator); err != nil {
+		return err
+	}
+	_, err = e.writer.Write(raw)
+	return err
+}
+
+func (e *jsonProductEncoder) Close() error {
+	end := "]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.writer, end)
+	return err
+}
+
+// exportBufferSize is how much of an export is held before it is sent.
+// Nothing reaches the client until the buffer first fills, so an export
+// that fails early can still be answered with a problem.
+const exportBufferSize = 32 << 10
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultIdempotencyTTL is how long a response is replayed for a repeated
+// Idempotency-Key unless IDEMPOTENCY_KEY_TTL says otherwise
+const defaultIdempotencyTTL = 24 * time.Hour
+
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders are the response headers stored with an idempotent
+// response and sent again when it is replayed
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// idempotent makes a handler safe to retry. The first response to a request
+// with an Idempotency-Key is stored and replayed for later requests with the
+// same key and body until ttl passes. Server errors are not stored, so a
+// retry after one runs the handler again.
+func idempotent(keys IdempotencyStore, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			badRequest(c, problemInvalidIdempotencyKey, "Idempotency-Key must be at most 255 characters long")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxProductBodyBytes))
+		if err != nil {
+			writeProblem(c, jsonProblem(err, maxProductBodyBytes))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		requestHash := idempotencyHash(c.Request.Method, c.Request.URL.Path, body)
+
+		ctx := c.Request.Context()
+		existing, reserved, err := keys.ReserveIdempotencyKey(ctx, key, requestHash, now().Add(ttl))
+		if err != nil {
+			internalError(c, "Unable to check the idempotency key", err)
+			return
+		}
+
+		if !reserved {
+			switch {
+			case existing.RequestHash != requestHash:
+				writeProblem(c, newProblem(http.StatusUnprocessableEntity, problemIdempotencyKeyReused, "This Idempotency-Key was already used for a different request"))
+			case existing.Status == 0:
+				c.Header("Retry-After", "1")
+				writeProblem(c, newProblem(http.StatusConflict, problemIdempotencyKeyInUse, "A request with this Idempotency-Key is still being processed"))
+			default:
+				for name, values := range existing.Header {
+					for _, value := range values {
+						c.Writer.Header().Add(name, value)
+					}
+				}
+				c.Header("Idempotent-Replayed", "true")
+				c.Status(existing.Status)
+				c.Writer.Write(existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// the client may have gone away, but the outcome must still be recorded
+		ctx = context.WithoutCancel(ctx)
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			err = keys.ReleaseIdempotencyKey(ctx, key)
+		} else {
+			header := http.Header{}
+			for _, name := range replayedHeaders {
+				if value := recorder.Header().Get(name); value != "" {
+					header.Set(name, value)
+				}
+			}
+			err = keys.CompleteIdempotencyKey(ctx, key, status, header, recorder.body.Bytes())
+		}
+		if err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// idempotencyHash fingerprints a request so a reused key can be told apart
+// from a retry
+func idempotencyHash(method, path string, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, method+" "+path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body as it is written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// sweepIdempotencyKeys deletes expired idempotency keys every interval
+// until ctx is done
+func sweepIdempotencyKeys(ctx context.Context, keys IdempotencyStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			swept, err := keys.SweepIdempotencyKeys(ctx, now())
+			if err != nil {
+				log.Printf("Unable to sweep idempotency keys: %v", err)
+				continue
+			}
+			if swept > 0 {
+				log.Printf("Swept %d expired idempotency keys", swept)
+			}
+		}
+	}
+}
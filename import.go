@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxImportBodyBytes caps an import file. Rows are streamed, so this
+	// bounds the time an import takes rather than its memory use.
+	maxImportBodyBytes = 256 << 20
+	// maxImportLineBytes caps a single NDJSON line
+	maxImportLineBytes = 1 << 20
+)
+
+// Import media types
+const (
+	mediaTypeCSV    = "text/csv"
+	mediaTypeNDJSON = "application/x-ndjson"
+)
+
+// Upsert keys: the field an imported row is matched to an existing product by
+const (
+	importByName = "name"
+	importBySku  = "sku"
+)
+
+// Row outcomes of an import
+const (
+	importCreate    = "create"
+	importUpdate    = "update"
+	importUnchanged = "unchanged"
+	importError     = "error"
+)
+
+// importColumns are the product fields an import may set
+var importColumns = []string{"name", "description", "price", "currency", "sku"}
+
+// ImportReport summarizes an import. Rows lists every row that was, or in a
+// dry run would be, created or updated, and every row that failed.
+type ImportReport struct {
+	DryRun    bool              `json:"dry_run"`   //	@Description	Whether the import only reported what it would do
+	Created   int               `json:"created"`   //	@Description	Number of products created
+	Updated   int               `json:"updated"`   //	@Description	Number of products updated
+	Unchanged int               `json:"unchanged"` //	@Description	Number of rows that matched a product exactly
+	Failed    int               `json:"failed"`    //	@Description	Number of rows that could not be imported
+	Rows      []ImportRowResult `json:"rows"`      //	@Description	Rows that changed something or failed
+}
+
+// ImportRowResult is the outcome of one imported row
+type ImportRowResult struct {
+	Line   int          `json:"line" example:"2"`                                    //	@Description	Line of the file the row starts on
+	Action string       `json:"action" enums:"create,update,error" example:"update"` //	@Description	What happened to the row
+	Id     int          `json:"id,omitempty"`                                        //	@Description	The product created or updated; absent for rows created in a dry run
+	Errors []FieldError `json:"errors,omitempty"`                                    //	@Description	Why the row failed
+}
+
+// importRow is one parsed row. Fields left out of the row are nil and keep
+// their current value when the row updates a product.
+type importRow struct {
+	Line        int     `json:"-"`
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Price       *int64  `json:"price"`
+	Currency    *string `json:"currency"`
+	Sku         *string `json:"sku"`
+}
+
+func (row importRow) applyTo(product *Product) {
+	if row.Name != nil {
+		product.Name = *row.Name
+	}
+	if row.Description != nil {
+		product.Description = *row.Description
+	}
+	if row.Price != nil {
+		product.Price = *row.Price
+	}
+	if row.Currency != nil {
+		product.Currency = *row.Currency
+	}
+	if row.Sku != nil {
+		product.Sku = *row.Sku
+	}
+}
+
+// errImportFile wraps errors that stop an import because the file itself
+// cannot be read any further
+var errImportFile = errors.New("unreadable import file")
+
+// importRowError is a row that could not be parsed. Reading continues with
+// the next row.
+type importRowError struct {
+	Line   int
+	Errors []FieldError
+}
+
+func (e *importRowError) Error() string {
+	return fmt.Sprintf("line %d: %s %s", e.Line, e.Errors[0].Field, e.Errors[0].Message)
+}
+
+// importReader yields the rows of an import file one at a time. Next
+// returns io.EOF at the end, an *importRowError for a malformed row and any
+// other error when the file cannot be read further.
+type importReader interface {
+	Next() (importRow, error)
+}
+
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+// newCSVImportReader reads the header row, which must name known columns
+// only, each at most once
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("the file is empty; the first row must name the columns")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !isImportColumn(column) {
+			return nil, fmt.Errorf("unknown column '%s'; columns may be %s", column, strings.Join(importColumns, ", "))
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("column '%s' appears more than once", column)
+		}
+		seen[column] = true
+		columns[i] = column
+	}
+
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvImportReader) Next() (importRow, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{}, &importRowError{Line: parseErr.StartLine, Errors: []FieldError{{Field: "row", Code: "csv", Message: parseErr.Err.Error()}}}
+		}
+		return importRow{}, err
+	}
+
+	line, _ := r.reader.FieldPos(0)
+	row := importRow{Line: line}
+	for i, value := range record {
+		switch r.columns[i] {
+		case "name":
+			row.Name = &value
+		case "description":
+			row.Description = &value
+		case "price":
+			price, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return importRow{}, &importRowError{Line: line, Errors: []FieldError{{Field: "price", Code: "type", Message: "must be a whole number of minor units"}}}
+			}
+			row.Price = &price
+		case "currency":
+			row.Currency = &value
+		case "sku":
+			row.Sku = &value
+		}
+	}
+	return row, nil
+}
+
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONImportReader(r io.Reader) *ndjsonImportReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLineBytes)
+	return &ndjsonImportReader{scanner: scanner}
+}
+
+func (r *ndjsonImportReader) Next() (importRow, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := bytes.TrimSpace(r.scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		row := importRow{Line: r.line}
+		if err := decodeStrictJSON(bytes.NewReader(text), &row); err != nil {
+			p := jsonProblem(err, 0)
+			fields := p.Errors
+			if len(fields) == 0 {
+				fields = []FieldError{{Field: "row", Code: "json", Message: p.Detail}}
+			}
+			return importRow{}, &importRowError{Line: r.line, Errors: fields}
+		}
+		return row, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return importRow{}, fmt.Errorf("line %d is longer than %d bytes", r.line+1, maxImportLineBytes)
+		}
+		return importRow{}, err
+	}
+	return importRow{}, io.EOF
+}
+
+// importFileProblem describes an import file that could not be read past
+// some point, after written rows had already been saved
+func importFileProblem(err error, written int) *Problem {
+	p := newProblem(http.StatusBadRequest, problemInvalidBody, err.Error())
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p = newProblem(http.StatusRequestEntityTooLarge, problemBodyTooLarge, fmt.Sprintf("Import files must not exceed %d bytes", maxImportBodyBytes))
+	}
+	if written > 0 {
+		p.Detail += fmt.Sprintf(". %d rows were imported before the error", written)
+	}
+	return p
+}
+
+func isImportColumn(column string) bool {
+	for _, known := range importColumns {
+		if column == known {
+			return true
+		}
+	}
+	return false
+}
+
+// importer upserts rows into a store, matching them to existing products
+// by name or by sku
+type importer struct {
+	store  ProductStore
+	key    string
+	dryRun bool
+	// seen maps the key of every row imported so far to its line, so a file
+	// cannot write the same product twice
+	seen map[string]int
+	// claimed holds the names and skus the rows of a dry run would write,
+	// standing in for the unique indexes a real run runs into
+	claimed map[importClaim]bool
+}
+
+type importClaim struct {
+	field string
+	value string
+}
+
+func newImporter(store ProductStore, key string, dryRun bool) *importer {
+	return &importer{store: store, key: key, dryRun: dryRun, seen: map[string]int{}, claimed: map[importClaim]bool{}}
+}
+
+// run imports every row of src. Row problems are collected in the report;
+// an error is returned only when the import could not continue, in which
+// case rows before it have already been written.
+func (imp *importer) run(ctx context.Context, src importReader) (ImportReport, error) {
+	report := ImportReport{DryRun: imp.dryRun, Rows: []ImportRowResult{}}
+
+	for {
+		row, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+
+		var result ImportRowResult
+		var rowErr *importRowError
+		switch {
+		case errors.As(err, &rowErr):
+			result = ImportRowResult{Line: rowErr.Line, Action: importError, Errors: rowErr.Errors}
+		case err != nil:
+			return report, fmt.Errorf("%w: %w", errImportFile, err)
+		default:
+			result, err = imp.importRow(ctx, row)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		switch result.Action {
+		case importCreate:
+			report.Created++
+		case importUpdate:
+			report.Updated++
+		case importUnchanged:
+			report.Unchanged++
+			continue
+		case importError:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+}
+
+func (imp *importer) importRow(ctx context.Context, row importRow) (ImportRowResult, error) {
+	failed := func(fields ...FieldError) (ImportRowResult, error) {
+		return ImportRowResult{Line: row.Line, Action: importError, Errors: fields}, nil
+	}
+
+	keyValue := row.Name
+	if imp.key == importBySku {
+		keyValue = row.Sku
+	}
+	if keyValue == nil || *keyValue == "" {
+		return failed(FieldError{Field: imp.key, Code: "required", Message: "is required to match the row to a product"})
+	}
+	if line, ok := imp.seen[*keyValue]; ok {
+		return failed(FieldError{Field: imp.key, Code: "duplicate", Message: fmt.Sprintf("was already imported on line %d", line)})
+	}
+
+	existing, found, err := imp.lookup(ctx, *keyValue)
+	if err != nil {
+		return ImportRowResult{}, err
+	}
+
+	product := existing
+	row.applyTo(&product)
+	if err := validate.Struct(product); err != nil {
+		p := validationProblem(err)
+		if p == nil {
+			return ImportRowResult{}, err
+		}
+		return failed(p.Errors...)
+	}
+
+	if imp.dryRun {
+		field, ok, err := imp.claim(ctx, product, existing.Id)
+		if err != nil {
+			return ImportRowResult{}, err
+		}
+		if !ok {
+			return failed(conflictProblem(&ConflictError{Field: field}).Errors...)
+		}
+	}
+
+	if found && sameProductFields(existing, product) {
+		imp.seen[*keyValue] = row.Line
+		return ImportRowResult{Line: row.Line, Action: importUnchanged, Id: existing.Id}, nil
+	}
+
+	result := ImportRowResult{Line: row.Line, Action: importCreate}
+	if found {
+		result.Action, result.Id = importUpdate, existing.Id
+	}
+	if imp.dryRun {
+		imp.seen[*keyValue] = row.Line
+		return result, nil
+	}
+
+	var saved Product
+	if found {
+		// the version guards against a concurrent change since the lookup
+		product.Version = existing.Version
+		saved, err = imp.store.Update(ctx, existing.Id, product)
+	} else {
+		saved, err = imp.store.Create(ctx, product)
+	}
+	switch {
+	case errors.Is(err, ErrProductConflict):
+		return failed(conflictProblem(err).Errors...)
+	case errors.Is(err, ErrVersionMismatch), errors.Is(err, ErrProductNotFound):
+		return failed(FieldError{Field: imp.key, Code: "changed", Message: "matched a product that changed during the import; import the row again"})
+	case err != nil:
+		return ImportRowResult{}, err
+	}
+
+	imp.seen[*keyValue] = row.Line
+	result.Id = saved.Id
+	return result, nil
+}
+
+// claim records the name and sku product would be left with. If an earlier
+// row of the dry run claimed one of them, or another product in the store
+// has it, that field is returned instead. id is the product the row
+// updates, or 0 for a new one.
+func (imp *importer) claim(ctx context.Context, product Product, id int) (string, bool, error) {
+	claims := []importClaim{{importByName, product.Name}}
+	if product.Sku != "" {
+		claims = append(claims, importClaim{importBySku, product.Sku})
+	}
+	for _, c := range claims {
+		if imp.claimed[c] {
+			return c.field, false, nil
+		}
+		other, found, err := imp.find(ctx, c.field, c.value)
+		if err != nil {
+			return "", false, err
+		}
+		if found && other.Id != id {
+			return c.field, false, nil
+		}
+	}
+	for _, c := range claims {
+		imp.claimed[c] = true
+	}
+	return "", true, nil
+}
+
+// lookup finds the product a row with the given key value refers to
+func (imp *importer) lookup(ctx context.Context, value string) (Product, bool, error) {
+	return imp.find(ctx, imp.key, value)
+}
+
+// find looks up the live product whose name or sku, as field says, is value
+func (imp *importer) find(ctx context.Context, field, value string) (Product, bool, error) {
+	if field == importByName {
+		product, err := imp.store.GetByName(ctx, value)
+		if errors.Is(err, ErrProductNotFound) {
+			return Product{}, false, nil
+		}
+		return product, err == nil, err
+	}
+
+	page, err := imp.store.List(ctx, ListOptions{Filters: []Filter{{Field: "sku", Op: "eq", Value: value}}, Limit: 1})
+	if err != nil || len(page.Items) == 0 {
+		return Product{}, false, err
+	}
+	return page.Items[0], true, nil
+}
+
+// sameProductFields compares the fields an import can set
+func sameProductFields(a, b Product) bool {
+	return a.Name == b.Name && a.Description == b.Description && a.Price == b.Price && a.Currency == b.Currency && a.Sku == b.Sku
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestImporterUpsertsBySku(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			run := func(body string) ImportReport {
+				src, err := newCSVImportReader(strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				report, err := newImporter(store, importBySku, false).run(ctx, src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return report
+			}
+
+			first := run("sku,name,price,currency\nTEA-1,Green tea,450,EUR\nTEA-2,Black tea,400,EUR\n")
+			if first.Created != 2 || first.Failed != 0 {
+				t.Fatalf("unexpected first report %+v", first)
+			}
+
+			// a renamed product is still matched by its sku, and columns left
+			// out keep their value
+			second := run("sku,name\nTEA-1,Sencha\nTEA-2,Black tea\n")
+			if second.Updated != 1 || second.Unchanged != 1 || len(second.Rows) != 1 || second.Rows[0].Id != first.Rows[0].Id {
+				t.Fatalf("unexpected second report %+v", second)
+			}
+
+			product, err := store.Get(ctx, first.Rows[0].Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if product.Name != "Sencha" || product.Price != 450 || product.Currency != "EUR" || product.Version != 2 {
+				t.Errorf("unexpected product after import %+v", product)
+			}
+		})
+	}
+}
+
+func TestImporterDryRunMatchesRealRun(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			// two new products sharing a sku: the second collides with the
+			// first either way
+			body := "name,sku,price,currency\nGreen tea,TEA-1,450,EUR\nBlack tea,TEA-1,400,EUR\nOolong,TEA-3,500,EUR\n"
+			run := func(dryRun bool) ImportReport {
+				src, err := newCSVImportReader(strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				report, err := newImporter(store, importByName, dryRun).run(ctx, src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return report
+			}
+
+			dry, real := run(true), run(false)
+			if dry.Created != 2 || dry.Failed != 1 || real.Created != 2 || real.Failed != 1 {
+				t.Fatalf("dry run %+v does not match the real run %+v", dry, real)
+			}
+			for _, report := range []ImportReport{dry, real} {
+				row := report.Rows[1]
+				if row.Line != 3 || row.Action != importError || len(row.Errors) != 1 || row.Errors[0].Field != "sku" || row.Errors[0].Code != "unique" {
+					t.Errorf("unexpected row %+v", row)
+				}
+			}
+		})
+	}
+}
+
+func TestImporterDryRunChecksStore(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			for _, p := range []Product{{Name: "Green tea", Sku: "TEA-1"}, {Name: "Oolong", Sku: "TEA-3"}} {
+				if _, err := store.Create(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			run := func(key, body string, dryRun bool) ImportReport {
+				src, err := newCSVImportReader(strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				report, err := newImporter(store, key, dryRun).run(ctx, src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return report
+			}
+
+			tests := []struct {
+				name      string
+				key       string
+				body      string
+				wantField string
+			}{
+				// updating the product that holds the sku is fine, a new
+				// product taking it is not
+				{"New product with an existing sku", importByName, "name,sku,description\nGreen tea,TEA-1,Loose leaf\nBlack tea,TEA-1,Loose leaf\n", "sku"},
+				{"Renamed onto an existing name", importBySku, "sku,name\nTEA-3,Green tea\n", "name"},
+			}
+			for _, tc := range tests {
+				dry := run(tc.key, tc.body, true)
+				if dry.Failed != 1 || len(dry.Rows[len(dry.Rows)-1].Errors) != 1 || dry.Rows[len(dry.Rows)-1].Errors[0].Field != tc.wantField {
+					t.Fatalf("%s: unexpected dry run %+v", tc.name, dry)
+				}
+				if real := run(tc.key, tc.body, false); real.Failed != dry.Failed || real.Created != dry.Created || real.Updated != dry.Updated {
+					t.Errorf("%s: dry run %+v does not match the real run %+v", tc.name, dry, real)
+				}
+			}
+		})
+	}
+}
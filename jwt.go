@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultJWTClockSkew is how far the clocks of the token issuer and this
+// server may drift apart unless JWT_CLOCK_SKEW says otherwise
+const defaultJWTClockSkew = 30 * time.Second
+
+// defaultJWKSRefresh is how often the key set is reloaded unless
+// JWT_JWKS_REFRESH says otherwise
+const defaultJWKSRefresh = time.Hour
+
+// jwksMinReload limits how often a token signed with an unknown key can make
+// the key set reload, so such tokens cannot hammer the JWKS endpoint
+const jwksMinReload = time.Minute
+
+const maxJWKSBytes = 1 << 20
+
+// jwtAlgorithms are the signing methods accepted. Symmetric ones are left
+// out: a JWKS holds public keys only.
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// jwtConfig says which bearer tokens are accepted
+type jwtConfig struct {
+	// JWKS is the path or http(s) URL of the JSON Web Key Set
+	JWKS string
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+	// ClockSkew is the leeway given to the exp, nbf and iat claims
+	ClockSkew time.Duration
+}
+
+// jwtVerifier checks bearer tokens against a key set
+type jwtVerifier struct {
+	keys   *jwks
+	parser *jwt.Parser
+}
+
+// newJWTVerifier loads the key set once; it is an error if none of its
+// keys can be used
+func newJWTVerifier(ctx context.Context, cfg jwtConfig) (*jwtVerifier, error) {
+	keys := &jwks{source: cfg.JWKS, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := keys.load(ctx); err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithLeeway(cfg.ClockSkew),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(now),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	return &jwtVerifier{keys: keys, parser: jwt.NewParser(options...)}, nil
+}
+
+// Verify checks a token's signature and claims and returns the claims. A
+// token must name its subject.
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := v.keys.key(kid); ok {
+			return key, nil
+		}
+		// the issuer may have rotated its keys since the set was loaded
+		if err := v.keys.reloadStale(ctx); err != nil {
+			log.Printf("Unable to reload the JWKS: %v", err)
+		}
+		if key, ok := v.keys.key(kid); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if subject, _ := claims.GetSubject(); subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// jwks is a JSON Web Key Set read from a file or URL, reloaded in place
+type jwks struct {
+	source string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+
+	// reloading lets one load run at a time, so callers waiting on it
+	// use its keys rather than loading again
+	reloading sync.Mutex
+	// attemptedAt is when the last load started, whether it worked or
+	// not, and is guarded by reloading
+	attemptedAt time.Time
+}
+
+// key finds the key with kid. Tokens without a kid are accepted when the set
+// has a single key.
+func (s *jwks) key(kid string) (crypto.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// load reads the key set and replaces the current keys with it. On error
+// the current keys are kept.
+func (s *jwks) load(ctx context.Context) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	return s.fetch(ctx)
+}
+
+// reloadStale loads the key set again unless a load was attempted very
+// recently, even one that failed: an unreachable JWKS endpoint would
+// otherwise be tried again for every token with an unknown kid
+func (s *jwks) reloadStale(ctx context.Context) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	if now().Sub(s.attemptedAt) < jwksMinReload {
+		return nil
+	}
+	return s.fetch(ctx)
+}
+
+// fetch must be called holding reloading
+func (s *jwks) fetch(ctx context.Context) error {
+	s.attemptedAt = now()
+	data, err := s.read(ctx)
+	if err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("jwks: %s: %w", s.source, err)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// reloadEvery loads the key set every interval until ctx is done
+func (s *jwks) reloadEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.load(ctx); err != nil {
+				log.Printf("Unable to reload the JWKS, keeping the current keys: %v", err)
+			}
+		}
+	}
+}
+
+func (s *jwks) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.source, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
+
+// jsonWebKey holds the RFC 7517 members needed for RSA, EC and Ed25519
+// public keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the signing keys of a key set by kid. Encryption keys and
+// key types that cannot sign JWTs are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey returns nil for key types that are not supported
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e: not a valid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("x: not an Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeJWKInt(raw string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("not a base64url encoded integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testSigningKey is a locally generated key that tokens are signed with
+type testSigningKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+func newTestSigningKeys(t *testing.T) []testSigningKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []testSigningKey{
+		{"rsa-1", jwt.SigningMethodRS256, rsaKey},
+		{"ec-1", jwt.SigningMethodES256, ecKey},
+		{"ed-1", jwt.SigningMethodEdDSA, edKey},
+	}
+}
+
+// marshalJWKS renders the public halves of keys as a JSON Web Key Set
+func marshalJWKS(t *testing.T, keys ...testSigningKey) []byte {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for _, key := range keys {
+		jwk := jsonWebKey{Kid: key.kid, Use: "sig"}
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty, jwk.N, jwk.E = "RSA", b64(public.N.Bytes()), b64(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X, jwk.Y = "EC", "P-256", b64(public.X.FillBytes(make([]byte, 32))), b64(public.Y.FillBytes(make([]byte, 32)))
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", b64(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func signTestToken(t *testing.T, key testSigningKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func writeTestJWKS(t *testing.T, path string, keys ...testSigningKey) {
+	if err := os.WriteFile(path, marshalJWKS(t, keys...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClaims(overrides jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss":   "https://auth.example.com",
+		"aud":   "product-api",
+		"sub":   "user-42",
+		"roles": []string{roleEditor},
+		"iat":   now().Unix(),
+		"exp":   now().Add(time.Hour).Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ctx := context.Background()
+	keys := newTestSigningKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, keys...)
+
+	verifier, err := newJWTVerifier(ctx, jwtConfig{JWKS: path, Issuer: "https://auth.example.com", Audience: "product-api", ClockSkew: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		claims, err := verifier.Verify(ctx, signTestToken(t, key, testClaims(nil)))
+		if err != nil {
+			t.Errorf("%s: %v", key.method.Alg(), err)
+			continue
+		}
+		if subject, _ := claims.GetSubject(); subject != "user-42" {
+			t.Errorf("%s: got subject %q", key.method.Alg(), subject)
+		}
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(nil)).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := newTestSigningKeys(t)[0]
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"Expired within the clock skew", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"exp": now().Add(-30 * time.Second).Unix()})), true},
+		{"Expired", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"exp": now().Add(-2 * time.Minute).Unix()})), false},
+		{"Without expiry", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"exp": nil})), false},
+		{"Not yet valid", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"nbf": now().Add(2 * time.Minute).Unix()})), false},
+		{"Other issuer", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"iss": "https://evil.example.com"})), false},
+		{"Other audience", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"aud": "billing-api"})), false},
+		{"Audience list", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"aud": []string{"billing-api", "product-api"}})), true},
+		{"Without subject", signTestToken(t, keys[0], testClaims(jwt.MapClaims{"sub": nil})), false},
+		{"Unsigned", unsigned, false},
+		{"Symmetric", hmac, false},
+		{"Unknown key", signTestToken(t, testSigningKey{"rsa-2", otherKey.method, otherKey.private}, testClaims(nil)), false},
+		{"Forged with a known kid", signTestToken(t, testSigningKey{"rsa-1", otherKey.method, otherKey.private}, testClaims(nil)), false},
+		{"Garbage", "not.a.token", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := verifier.Verify(ctx, tc.token)
+			if tc.valid && err != nil {
+				t.Errorf("expected a valid token, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	ctx := context.Background()
+	keys := newTestSigningKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, keys[0])
+
+	verifier, err := newJWTVerifier(ctx, jwtConfig{JWKS: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := signTestToken(t, keys[1], testClaims(nil))
+	if _, err := verifier.Verify(ctx, rotated); err == nil {
+		t.Fatal("expected a token signed with a key not yet published to be rejected")
+	}
+
+	// a token with an unknown kid reloads the set, but not more than once a
+	// minute
+	writeTestJWKS(t, path, keys[0], keys[1])
+	if _, err := verifier.Verify(ctx, rotated); err == nil {
+		t.Error("expected the key set not to reload again so soon")
+	}
+	verifier.keys.attemptedAt = now().Add(-jwksMinReload)
+	if _, err := verifier.Verify(ctx, rotated); err != nil {
+		t.Errorf("expected the rotated key to be picked up, got %v", err)
+	}
+
+	// a broken key set keeps the keys already loaded
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.keys.load(ctx); err == nil {
+		t.Error("expected an error loading a broken key set")
+	}
+	if _, err := verifier.Verify(ctx, rotated); err != nil {
+		t.Errorf("expected the loaded keys to be kept, got %v", err)
+	}
+}
+
+func TestJWKSFromURL(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(marshalJWKS(t, keys[2]))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	if _, err := newJWTVerifier(ctx, jwtConfig{JWKS: server.URL + "/missing"}); err == nil {
+		t.Error("expected a 404 to fail")
+	}
+	verifier, err := newJWTVerifier(ctx, jwtConfig{JWKS: server.URL + "/.well-known/jwks.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(ctx, signTestToken(t, keys[2], testClaims(nil))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJWKSReloadFailure(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	var fetches atomic.Int32
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(marshalJWKS(t, keys[0]))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	verifier, err := newJWTVerifier(ctx, jwtConfig{JWKS: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Store(true)
+	verifier.keys.attemptedAt = now().Add(-jwksMinReload)
+
+	// while the endpoint fails, tokens with made-up kids do not each fetch
+	// the set again, however many arrive at once
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := verifier.Verify(ctx, signTestToken(t, keys[1], testClaims(nil))); err == nil {
+				t.Error("expected a token with an unknown kid to be rejected")
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := verifier.Verify(ctx, signTestToken(t, keys[2], testClaims(nil))); err == nil {
+		t.Error("expected a token with an unknown kid to be rejected")
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("expected a single failed reload, got %d fetches in all", got)
+	}
+
+	// the keys loaded before the failure still work
+	if _, err := verifier.Verify(ctx, signTestToken(t, keys[0], testClaims(nil))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+		want string
+	}{
+		{"Not JSON", `nonsense`, "invalid character"},
+		{"Empty", `{"keys":[]}`, "no signing keys"},
+		{"Only encryption keys", `{"keys":[{"kty":"OKP","crv":"Ed25519","use":"enc","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`, "no signing keys"},
+		{"Bad modulus", `{"keys":[{"kty":"RSA","n":"","e":"AQAB"}]}`, "keys[0]: n"},
+		{"Off the curve", `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`, "not on the curve"},
+		{"Unknown curve", `{"keys":[{"kty":"OKP","crv":"X25519","x":"AQ"}]}`, "unsupported curve"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseJWKS([]byte(tc.jwks))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v expected an error containing %q", err, tc.want)
+			}
+		})
+	}
+
+	// key types that cannot sign JWTs are skipped rather than rejected
+	keys, err := parseJWKS([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"},{"kty":"OKP","crv":"Ed25519","kid":"a","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`))
+	if err != nil || len(keys) != 1 {
+		t.Errorf("got %v, %v", keys, err)
+	}
+}
@@ -3,20 +3,34 @@
 // @description	This is a sample API for managing products
 // @host			{host}
 // @BasePath		/
+
+// @securityDefinitions.apikey	ApiKeyAuth
+// @in							header
+// @name						X-API-Key
+
+// @securityDefinitions.apikey	BearerAuth
+// @in							header
+// @name						Authorization
+// @description				A JWT from a trusted issuer, as "Bearer <token>"
 package main
 
 import (
-	"database/sql"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"github.com/joho/godotenv"
-	"github.com/mattn/go-sqlite3"
 	_ "github.com/mattn/go-sqlite3"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -26,18 +40,30 @@ import (
 
 // Product represents the product model
 type Product struct {
-	Id   int    `json:"id"`   //	@Description	The unique ID of the product
-	Name string `json:"name"` //	@Description	The name of the product
+	Id          int        `json:"id"`                                                                      //	@Description	The unique ID of the product
+	Name        string     `json:"name" validate:"required,max=200"`                                        //	@Description	The name of the product
+	Description string     `json:"description" validate:"max=5000"`                                         //	@Description	A longer description of the product
+	Price       int64      `json:"price" validate:"gte=0" example:"1999"`                                   //	@Description	The price in minor units of the currency, e.g. cents
+	Currency    string     `json:"currency" validate:"required_with=Price,omitempty,iso4217" example:"USD"` //	@Description	The ISO 4217 code of the price currency
+	Sku         string     `json:"sku,omitempty" validate:"omitempty,max=64,sku" example:"TEA-GRN-250"`     //	@Description	The unique stock keeping unit
+	CreatedAt   time.Time  `json:"created_at"`                                                              //	@Description	When the product was created
+	UpdatedAt   time.Time  `json:"updated_at"`                                                              //	@Description	When the product was last changed
+	Version     int64      `json:"version" example:"1"`                                                     //	@Description	Bumped on every change; the product's ETag is this number in quotes
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`                                                    //	@Description	When the product was deleted; absent for products that are not
 }
 
-var validate = validator.New()
+var validate = newValidator()
 
-// initDB initializes the database
-func initDB(db *sql.DB) {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS products(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE)")
-	if err != nil {
-		log.Fatal(err)
-	}
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// newValidator registers the custom tags used by Product
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(jsonFieldName)
+	v.RegisterValidation("sku", func(fl validator.FieldLevel) bool {
+		return skuPattern.MatchString(fl.Field().String())
+	})
+	return v
 }
 
 // @Summary     Get a product
@@ -45,252 +71,1080 @@ func initDB(db *sql.DB) {
 // @Tags        products
 // @Produce     json
 // @Param       id path int true "Product ID"
+// @Param       include_deleted query bool false "Also find the product if it is in the trash"
+// @Param       If-None-Match header string false "ETag of a copy the client already holds"
 // @Success     200 {object} Product
+// @Header      200 {string} ETag "The product version, or a hash of a listing"
+// @Success     304 "The copy named in If-None-Match is current"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products/{id} [get]
-func getProduct(c *gin.Context, db *sql.DB) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	var product Product
+func getProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+
+	var opts ListOptions
+	if err := parseDeletedScope(c, &opts); err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
+	}
 
-	err := db.QueryRow("SELECT * FROM products WHERE id=?", id).Scan(&product.Id, &product.Name)
+	product, err := getIncludingDeleted(c.Request.Context(), store, id, opts.Deleted)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No such product with id %d", id)})
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred"})
+		internalError(c, "Unable to read from database", err)
 		return
 	}
 
+	if notModified(c, productETag(product)) {
+		return
+	}
 	c.JSON(http.StatusOK, product)
 }
 
-// @Summary     List all products or get a product by name
-// @Description Get all products or retrieve a specific product by name. Name query parameter is optional.
+// @Summary     List products or get a product by name
+// @Description Get a filtered, sorted page of products, or retrieve a specific product by its exact name.
+// @Description Filters take the form field[op]=value. id and price support eq, ne, gt, gte, lt, lte and in;
+// @Description name, description, currency and sku support eq, ne, contains, prefix and in;
+// @Description created_at and updated_at support gt, gte, lt and lte with an RFC 3339 timestamp or a YYYY-MM-DD date.
+// @Description contains and prefix ignore case; in takes a comma separated list. Any of these fields can be used in sort.
+// @Description Use either offset or the opaque cursor returned as next_cursor to move between pages; the Link header carries the same URLs.
 // @Tags        products
 // @Produce     json
-// @Param       name  query      string false "Name of the product to retrieve"
-// @Success     200 {array}  Product
+// @Param       name   query    string false "Exact name of a single product to retrieve"
+// @Param       q      query    string false "Case-insensitive substring of the product name"
+// @Param       sort   query    string false "Comma separated fields to sort by, prefixed with - for descending (default id)"
+// @Param       id[gte]        query int    false "Example filter: products with an id of at least this value"
+// @Param       name[prefix]   query string false "Example filter: products whose name starts with this value"
+// @Param       created_at[gte] query string false "Example filter: products created on or after this date"
+// @Param       limit  query    int    false "Page size (default 20, maximum 100)"
+// @Param       offset query    int    false "Number of products to skip"
+// @Param       cursor query    string false "Cursor from a previous page's next_cursor"
+// @Param       include_deleted query bool false "Also list products in the trash"
+// @Param       If-None-Match header string false "ETag of a copy the client already holds"
+// @Success     200 {object} ProductList
+// @Header      200 {string} ETag "The product version, or a hash of a listing"
+// @Success     304 "The copy named in If-None-Match is current"
+// @Header      200 {string} Link "RFC 8288 links to the next, previous and first pages"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products [get]
-func getProducts(c *gin.Context, db *sql.DB) {
+func getProducts(c *gin.Context, store ProductStore) {
 	productName := c.Query("name")
 
-	var rows *sql.Rows
-	var err error
-
 	if productName != "" {
-		rows, err = db.Query("SELECT * FROM products WHERE name=?", productName)
-	} else {
-		rows, err = db.Query("SELECT * FROM products")
+		product, err := store.GetByName(c.Request.Context(), productName)
+		if err != nil {
+			if errors.Is(err, ErrProductNotFound) {
+				productNotFound(c, fmt.Sprintf("No such product with name '%s'. Use q or name[contains] for partial matches", productName))
+				return
+			}
+			internalError(c, "Unable to read from database", err)
+			return
+		}
+
+		if notModified(c, productETag(product)) {
+			return
+		}
+		c.JSON(http.StatusOK, product)
+		return
 	}
 
+	opts, err := parseListOptions(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, map[string]string{"error": "Unable to read from database"})
+		badRequest(c, problemInvalidQuery, err.Error())
 		return
 	}
-	defer rows.Close()
 
-	var products []Product
+	page, err := store.List(c.Request.Context(), opts)
+	if err != nil {
+		internalError(c, "Unable to read from database", err)
+		return
+	}
 
-	for rows.Next() {
-		var product Product
-		if err := rows.Scan(&product.Id, &product.Name); err != nil {
-			c.JSON(http.StatusInternalServerError, map[string]string{"error": "Bad reading of database content"})
+	writeJSONWithETag(c, newProductList(c, page, opts))
+}
+
+// @Summary     Export products
+// @Description Stream every product matching the filters, without paging, as CSV, newline-delimited JSON or a JSON array.
+// @Description Filters, q and sort work as on GET /products; limit, offset and cursor are ignored.
+// @Description The response is sent as it is read from the database. Should the export fail part way through, the body ends early.
+// @Tags        products
+// @Produce     text/csv
+// @Produce     application/x-ndjson
+// @Produce     json
+// @Param       format query    string false "csv, ndjson or json (default json)"
+// @Param       sort   query    string false "Comma separated fields to sort by, prefixed with - for descending (default id)"
+// @Param       q      query    string false "Case-insensitive substring of the product name"
+// @Param       include_deleted query bool false "Also export products in the trash"
+// @Success     200 {array} Product
+// @Header      200 {string} Content-Disposition "attachment with a timestamped file name"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/export [get]
+func exportProducts(c *gin.Context, store ProductStore) {
+	name := c.DefaultQuery("format", "json")
+	format, ok := exportFormats[name]
+	if !ok {
+		badRequest(c, problemInvalidQuery, fmt.Sprintf("format must be csv, ndjson or json, got '%s'", name))
+		return
+	}
+
+	var opts ListOptions
+	if err := parseFilters(c, &opts); err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
+	}
+
+	filename := "products-" + now().Format("20060102T150405Z") + format.Extension
+	c.Header("Content-Type", format.ContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	buffer := bufio.NewWriterSize(c.Writer, exportBufferSize)
+	encoder := format.NewEncoder(buffer)
+	err := store.Each(c.Request.Context(), opts, encoder.Encode)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		if c.Writer.Written() {
+			// the status and part of the body are gone; all that is left is
+			// to stop, leaving a truncated body
+			c.Error(err)
+			c.Abort()
 			return
 		}
-		products = append(products, product)
+		c.Writer.Header().Del("Content-Disposition")
+		internalError(c, "Unable to read from database", err)
+	}
+}
+
+// @Summary     List deleted products
+// @Description Get a page of the products in the trash, with the same filters, sort and paging as GET /products.
+// @Description Deleted products stay here until they are purged, by hand or after DELETED_PRODUCT_RETENTION if it is set.
+// @Tags        products
+// @Produce     json
+// @Param       sort   query    string false "Comma separated fields to sort by, prefixed with - for descending (default id)"
+// @Param       limit  query    int    false "Page size (default 20, maximum 100)"
+// @Param       offset query    int    false "Number of products to skip"
+// @Param       cursor query    string false "Cursor from a previous page's next_cursor"
+// @Success     200 {object} ProductList
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/trash [get]
+func getDeletedProducts(c *gin.Context, store ProductStore) {
+	opts, err := parseListOptions(c)
+	if err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
 	}
+	opts.Deleted = onlyDeleted
 
-	if productName != "" && len(products) == 0 {
-		c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No such product with name '%s'. Product names must be exact", productName)})
+	page, err := store.List(c.Request.Context(), opts)
+	if err != nil {
+		internalError(c, "Unable to read from database", err)
 		return
 	}
 
-	if productName != "" {
-		c.JSON(http.StatusOK, products[0])
-	} else {
-		c.JSON(http.StatusOK, products)
+	writeJSONWithETag(c, newProductList(c, page, opts))
+}
+
+// @Summary     Search products
+// @Description Full-text search over product names and descriptions, best match first.
+// @Description Words are ANDed together, "quoted phrases" must appear in order and a trailing * turns a word or phrase into a prefix query.
+// @Tags        products
+// @Produce     json
+// @Param       q      query    string true  "Search query, e.g. \"blue pen\" note*"
+// @Param       limit  query    int    false "Page size (default 20, maximum 100)"
+// @Param       offset query    int    false "Number of results to skip"
+// @Success     200 {object} SearchPage
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Failure     501 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/search [get]
+func searchProducts(c *gin.Context, store ProductStore) {
+	searcher, ok := store.(ProductSearcher)
+	if !ok {
+		writeProblem(c, newProblem(http.StatusNotImplemented, problemSearchUnavailable, ErrSearchUnavailable.Error()))
+		return
+	}
+
+	match, err := buildMatchQuery(c.Query("q"))
+	if err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
 	}
+
+	limit, offset, err := parseLimitOffset(c)
+	if err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
+	}
+
+	page, err := searcher.Search(c.Request.Context(), match, limit, offset)
+	if err != nil {
+		if errors.Is(err, ErrSearchUnavailable) {
+			writeProblem(c, newProblem(http.StatusNotImplemented, problemSearchUnavailable, err.Error()))
+			return
+		}
+		internalError(c, "Unable to search the database", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
 }
 
 // @Summary     Create a new product
-// @Description Add a new product to the database
+// @Description Add a new product to the database. Send an Idempotency-Key to make retries safe: the first
+// @Description response for a key is replayed to later requests with the same key and body.
 // @Tags        products
 // @Accept      json
 // @Produce     json
 // @Param       product body Product true "Product object"
+// @Param       Idempotency-Key header string false "Unique key that makes retries of this request safe"
 // @Success     201 {object} Product
+// @Header      201 {string} Idempotent-Replayed "Set to true when the response is a replay of an earlier request with the same key"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     422 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products [post]
-func createProduct(c *gin.Context, db *sql.DB) {
+func createProduct(c *gin.Context, store ProductStore) {
 	var product Product
 
-	if err := c.ShouldBindJSON(&product); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+	if !bindProduct(c, &product) {
+		return
+	}
+
+	product, err := store.Create(c.Request.Context(), product)
+	if err != nil {
+		if errors.Is(err, ErrProductConflict) {
+			conflict(c, err)
+			return
+		}
+		internalError(c, "Unable to write to database", err)
+		return
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusCreated, product)
+}
+
+// @Summary     Create, update and delete products in bulk
+// @Description Run up to 1000 create, update and delete operations in order, in one transaction.
+// @Description In atomic mode (the default) either every operation succeeds and the response is 200,
+// @Description or nothing is changed and the response is a problem naming the failing operation.
+// @Description In partial mode the operations that succeed are kept and the response is 207 with a result per operation.
+// @Tags        products
+// @Accept      json
+// @Produce     json
+// @Param       batch body BatchRequest true "Operations to run"
+// @Success     200 {object} BatchResponse
+// @Success     207 {object} BatchResponse
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/batch [post]
+func batchProducts(c *gin.Context, store ProductStore) {
+	var request BatchRequest
+	if !decodeJSONBody(c, &request, maxBatchBodyBytes) {
+		return
+	}
+
+	mode := request.Mode
+	if mode == "" {
+		mode = batchAtomic
+	}
+	if mode != batchAtomic && mode != batchPartial {
+		p := newProblem(http.StatusBadRequest, problemValidation, "The batch is invalid")
+		p.Errors = []FieldError{{Field: "mode", Code: "oneof", Message: "must be atomic or partial"}}
+		writeProblem(c, p)
+		return
+	}
+	if len(request.Operations) == 0 || len(request.Operations) > maxBatchOperations {
+		p := newProblem(http.StatusBadRequest, problemValidation, "The batch is invalid")
+		p.Errors = []FieldError{{Field: "operations", Code: "len", Message: fmt.Sprintf("must hold between 1 and %d operations", maxBatchOperations)}}
+		writeProblem(c, p)
 		return
 	}
+	atomic := mode == batchAtomic
 
-	if err := validate.Struct(product); err != nil {
-		var errMessages []string
-		for _, err := range err.(validator.ValidationErrors) {
-			errMessages = append(errMessages, fmt.Sprintf("Field '%s': %s", err.Field(), err.Tag()))
+	results := make([]BatchItemResult, len(request.Operations))
+	var valid []BatchOperation
+	var validIndex []int
+	invalid := newProblem(http.StatusBadRequest, problemValidation, "One or more operations are invalid. No changes were made")
+	for i, op := range request.Operations {
+		if p := checkBatchOperation(op); p != nil {
+			results[i] = BatchItemResult{Status: p.Status, Problem: p}
+			invalid.Errors = append(invalid.Errors, operationFields(i, p)...)
+			continue
 		}
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Validation errors: %s", errMessages)})
+		valid = append(valid, op)
+		validIndex = append(validIndex, i)
+	}
+	if atomic && len(invalid.Errors) > 0 {
+		writeProblem(c, invalid)
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO products (name) VALUES (?)", product.Name)
+	stored, err := store.Batch(c.Request.Context(), valid, atomic)
 	if err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			c.JSON(http.StatusConflict, gin.H{"error": "Product name already exists"})
-			return
+		internalError(c, "Unable to run the batch", err)
+		return
+	}
+
+	for j, result := range stored {
+		i, op := validIndex[j], valid[j]
+		if result.Err != nil {
+			p := batchItemProblem(op, result.Err)
+			if atomic {
+				failed := newProblem(p.Status, problemBatchFailed, fmt.Sprintf("Operation %d failed: %s. No changes were made", i, p.Detail))
+				failed.Errors = operationFields(i, p)
+				writeProblem(c, failed)
+				return
+			}
+			results[i] = BatchItemResult{Status: p.Status, Problem: p}
+			continue
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to write to database"})
+
+		results[i] = BatchItemResult{Status: batchSuccessStatus(op)}
+		if op.Op != batchDelete {
+			product := result.Product
+			results[i].Product = &product
+		}
+	}
+
+	status := http.StatusOK
+	if !atomic {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, BatchResponse{Results: results})
+}
+
+// @Summary     Import products from CSV or NDJSON
+// @Description Create or update products from a CSV file with a header row, or from newline-delimited JSON objects.
+// @Description Columns, or keys, may be name, description, price, currency and sku; fields left out keep their current value on update.
+// @Description Each row is matched to an existing product by name or, with key=sku, by SKU, and validated like a POST body.
+// @Description Rows are processed one at a time as the file streams in; a failing row is reported and the import carries on.
+// @Description With dry_run=true nothing is written and the report says what would happen.
+// @Tags        products
+// @Accept      text/csv
+// @Accept      application/x-ndjson
+// @Produce     json
+// @Param       key     query string false "Field rows are matched on: name (default) or sku"
+// @Param       dry_run query bool   false "Report what would change without writing"
+// @Param       file    body  string true  "CSV or NDJSON rows"
+// @Success     200 {object} ImportReport
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     415 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/import [post]
+func importProducts(c *gin.Context, store ProductStore) {
+	key := c.DefaultQuery("key", importByName)
+	if key != importByName && key != importBySku {
+		badRequest(c, problemInvalidQuery, fmt.Sprintf("key must be name or sku, got '%s'", key))
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		badRequest(c, problemInvalidQuery, "dry_run must be true or false")
 		return
 	}
 
-	newProductId, _ := result.LastInsertId()
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBodyBytes)
+	var src importReader
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case mediaTypeCSV:
+		src, err = newCSVImportReader(body)
+		if err != nil {
+			writeProblem(c, importFileProblem(err, 0))
+			return
+		}
+	case mediaTypeNDJSON, "application/ndjson":
+		src = newNDJSONImportReader(body)
+	default:
+		c.Header("Accept-Post", mediaTypeCSV+", "+mediaTypeNDJSON)
+		writeProblem(c, newProblem(http.StatusUnsupportedMediaType, problemUnsupportedMedia, "Imports must be "+mediaTypeCSV+" or "+mediaTypeNDJSON))
+		return
+	}
 
-	if err = db.QueryRow("SELECT * FROM products WHERE id = ?", newProductId).Scan(&product.Id, &product.Name); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred while fetching the newly created row"})
+	report, err := newImporter(store, key, dryRun).run(c.Request.Context(), src)
+	if err != nil {
+		written := 0
+		if !dryRun {
+			written = report.Created + report.Updated
+		}
+		if errors.Is(err, errImportFile) {
+			writeProblem(c, importFileProblem(err, written))
+			return
+		}
+		internalError(c, fmt.Sprintf("Unable to write to database. %d rows were imported before the error", written), err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, product)
+	c.JSON(http.StatusOK, report)
 }
 
 // @Summary     Update a product
-// @Description Update a product's information
+// @Description Replace a product's information. Fields left out of the body are reset to their zero value.
 // @Tags        products
 // @Accept      json
 // @Produce     json
 // @Param       id path int true "Product ID"
 // @Param       product body Product true "Updated product object"
+// @Param       If-Match header string false "ETag the product must still have; required when REQUIRE_IF_MATCH is set"
 // @Success     200 {object} Product
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     428 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products/{id} [put]
-func updateProduct(c *gin.Context, db *sql.DB) {
-	id, _ := strconv.Atoi(c.Param("id"))
+func updateProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
 	var newProduct Product
 
-	if err := c.ShouldBindJSON(&newProduct); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing request body as JSON"})
+	if !bindProduct(c, &newProduct) {
 		return
 	}
+	newProduct.Version = version
 
-	result, err := db.Exec("UPDATE products SET name = ? WHERE id = ?", newProduct.Name, id)
-
+	newProduct, err := store.Update(c.Request.Context(), id, newProduct)
 	if err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			c.JSON(http.StatusConflict, gin.H{"error": "A product with this name already exists"})
-			return
+		switch {
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductConflict):
+			conflict(c, err)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
+		default:
+			internalError(c, "Unable to update the product", err)
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred while updating the rows"})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No such product with id %d", id)})
+	c.Header("ETag", productETag(newProduct))
+	c.JSON(http.StatusOK, newProduct)
+}
+
+// @Summary     Patch a product
+// @Description Change some of a product's fields. Send either an RFC 7386 merge patch as application/merge-patch+json,
+// @Description e.g. {"price": 250, "sku": null}, or an RFC 6902 JSON Patch as application/json-patch+json,
+// @Description e.g. [{"op": "replace", "path": "/price", "value": 250}]. The patch is applied and the result
+// @Description validated in one transaction; a patch that changes id, created_at, updated_at or version is rejected with 422.
+// @Tags        products
+// @Accept      application/merge-patch+json
+// @Accept      application/json-patch+json
+// @Produce     json
+// @Param       id path int true "Product ID"
+// @Param       patch body object true "Merge patch or JSON Patch document"
+// @Param       If-Match header string false "ETag the product must still have; required when REQUIRE_IF_MATCH is set"
+// @Success     200 {object} Product
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     415 {object} Problem
+// @Failure     422 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     428 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id} [patch]
+func patchProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxProductBodyBytes))
+	if err != nil {
+		writeProblem(c, jsonProblem(err, maxProductBodyBytes))
 		return
 	}
 
-	if err = db.QueryRow("SELECT * FROM products WHERE id=?", id).Scan(&newProduct.Id, &newProduct.Name); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred while returning the updated data"})
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	patch, err := parseProductPatch(mediaType, body)
+	var patchErr *patchError
+	if errors.As(err, &patchErr) {
+		if patchErr.problem.Status == http.StatusUnsupportedMediaType {
+			c.Header("Accept-Patch", acceptPatch)
+		}
+		writeProblem(c, patchErr.problem)
 		return
 	}
 
-	c.JSON(http.StatusOK, newProduct)
+	product, err := store.Patch(c.Request.Context(), id, func(current Product) (Product, error) {
+		if version != 0 && current.Version != version {
+			return Product{}, ErrVersionMismatch
+		}
+		return patch.Apply(current)
+	})
+	if err != nil {
+		switch {
+		case errors.As(err, &patchErr):
+			writeProblem(c, patchErr.problem)
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductConflict):
+			conflict(c, err)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
+		default:
+			internalError(c, "Unable to patch the product", err)
+		}
+		return
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, product)
 }
 
 // @Summary     Update a product by name
-// @Description Update a product's information by name
+// @Description Replace a product's information by name. Fields left out of the body are reset to their zero value.
 // @Tags        products
 // @Accept      json
 // @Produce     json
 // @Param       name  query      string true "Name of the product to update"
 // @Param       product body Product true "Updated product object"
+// @Param       If-Match header string false "ETag the product must still have; required when REQUIRE_IF_MATCH is set"
 // @Success     200 {object} Product
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     413 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     428 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products [put]
-func updateProductByName(c *gin.Context, db *sql.DB) {
-	productName := c.Query("name")
+func updateProductByName(c *gin.Context, store ProductStore) {
+	productName, ok := requireNameQuery(c)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
 	var newProduct Product
 
-	if err := c.ShouldBindJSON(&newProduct); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error parsing the request body as JSON"})
+	if !bindProduct(c, &newProduct) {
 		return
 	}
+	newProduct.Version = version
 
-	result, err := db.Exec("UPDATE products SET name = ? WHERE name = ?", newProduct.Name, productName)
+	newProduct, err := store.UpdateByName(c.Request.Context(), productName, newProduct)
 	if err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			c.JSON(http.StatusConflict, gin.H{"error": "A product with this name already exists"})
+		switch {
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductConflict):
+			conflict(c, err)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with name '%s'. Product names must be exact", productName))
+		default:
+			internalError(c, "Unable to update the product", err)
+		}
+		return
+	}
+
+	c.Header("ETag", productETag(newProduct))
+	c.JSON(http.StatusOK, newProduct)
+}
+
+// @Summary     Delete a product
+// @Description Move a product to the trash. It disappears from reads and frees its name and SKU, but can be restored until it is purged.
+// @Tags        products
+// @Param       id path int true "Product ID"
+// @Param       If-Match header string false "ETag the product must still have; required when REQUIRE_IF_MATCH is set"
+// @Success     200 {object} map[string]string
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     428 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id} [delete]
+func deleteProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	if err := store.Delete(c.Request.Context(), id, version); err != nil {
+		switch {
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
+		default:
+			internalError(c, "Unable to delete the product", err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted product successfully"})
+}
+
+// @Summary     Get a product's history
+// @Description List every change made to a product, newest first: who made it, through which request, and the product before and after.
+// @Description The history outlives the product, so it can still be read after the product has been purged.
+// @Tags        products
+// @Produce     json
+// @Param       id     path  int    true  "Product ID"
+// @Param       limit  query int    false "Page size (default 20, maximum 100)"
+// @Param       cursor query string false "Cursor from a previous page's next_cursor"
+// @Success     200 {object} ProductHistory
+// @Header      200 {string} Link "RFC 8288 link to the next page"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/history [get]
+func getProductHistory(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+
+	limit, _, err := parseLimitOffset(c)
+	if err != nil {
+		badRequest(c, problemInvalidQuery, err.Error())
+		return
+	}
+	opts := HistoryOptions{Limit: limit}
+	if raw := c.Query("cursor"); raw != "" {
+		if opts.Before, err = decodeHistoryCursor(raw); err != nil {
+			badRequest(c, problemInvalidQuery, err.Error())
+			return
+		}
+	}
+
+	page, err := store.History(c.Request.Context(), id, opts)
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occured while updating the product"})
+		internalError(c, "Unable to read from database", err)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
+	history := ProductHistory{Items: page.Items}
+	if page.HasMore {
+		history.NextCursor = encodeHistoryCursor(page.Items[len(page.Items)-1].Id)
+		c.Header("Link", pageLink(c, "next", map[string]string{"cursor": history.NextCursor}))
+	}
+	c.JSON(http.StatusOK, history)
+}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No such product with name '%s'. Product names must be exact", productName)})
+// @Summary     Get a revision of a product
+// @Description Get a product as it was at one of its revisions. Every change makes a new revision, numbered like the product's version.
+// @Tags        products
+// @Produce     json
+// @Param       id       path int true "Product ID"
+// @Param       revision path int true "Revision number"
+// @Success     200 {object} Product
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/revisions/{revision} [get]
+func getProductRevision(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	revision, ok := parseRevision(c, "revision", c.Param("revision"))
+	if !ok {
 		return
 	}
 
-	if err = db.QueryRow("SELECT * FROM products WHERE name=?", newProduct.Name).Scan(&newProduct.Id, &newProduct.Name); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred while returning the updated data"})
+	product, err := store.Revision(c.Request.Context(), id, revision)
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("Product %d has no revision %d", id, revision))
+			return
+		}
+		internalError(c, "Unable to read from database", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, newProduct)
+	c.JSON(http.StatusOK, product)
 }
 
-// @Summary     Delete a product
-// @Description Delete a product by its ID
+// @Summary     Get a product as it was at a point in time
+// @Description Get the revision of a product that was current at the given time, including a deleted one.
 // @Tags        products
-// @Param       id path int true "Product ID"
-// @Success     200 {object} map[string]string
-// @Router      /products/{id} [delete]
-func deleteProduct(c *gin.Context, db *sql.DB) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	result, err := db.Exec("DELETE from products WHERE id = ?", id)
+// @Produce     json
+// @Param       id path  int    true "Product ID"
+// @Param       at query string true "RFC 3339 timestamp or YYYY-MM-DD date"
+// @Success     200 {object} Product
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/revisions [get]
+func getProductRevisionAt(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	at, err := parseTimestamp(c.Query("at"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occurred while deleting your data"})
+		badRequest(c, problemInvalidQuery, "at: "+err.Error())
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No such product with id, %d", id)})
+	product, err := store.RevisionAt(c.Request.Context(), id, at)
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("Product %d did not exist at %s", id, at.Format(time.RFC3339)))
+			return
+		}
+		internalError(c, "Unable to read from database", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Deleted product successfully"})
+	c.JSON(http.StatusOK, product)
+}
+
+// @Summary     Compare two revisions of a product
+// @Description List the fields that differ between two revisions of a product.
+// @Tags        products
+// @Produce     json
+// @Param       id   path  int true  "Product ID"
+// @Param       from query int true  "The older revision"
+// @Param       to   query int false "The newer revision (default the current one)"
+// @Success     200 {object} ProductDiff
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/diff [get]
+func diffProductRevisions(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	from, ok := parseRevision(c, "from", c.Query("from"))
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var to Product
+	var err error
+	if raw := c.Query("to"); raw != "" {
+		revision, ok := parseRevision(c, "to", raw)
+		if !ok {
+			return
+		}
+		to, err = store.Revision(ctx, id, revision)
+	} else {
+		to, err = getIncludingDeleted(ctx, store, id, includeDeleted)
+	}
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("Product %d has no revision %s", id, c.DefaultQuery("to", "now")))
+			return
+		}
+		internalError(c, "Unable to read from database", err)
+		return
+	}
+
+	older, err := store.Revision(ctx, id, from)
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("Product %d has no revision %d", id, from))
+			return
+		}
+		internalError(c, "Unable to read from database", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ProductDiff{From: from, To: to.Version, Changes: diffProducts(older, to)})
+}
+
+// @Summary     Revert a product to an earlier revision
+// @Description Write the name, description, price, currency and SKU of an earlier revision as a new revision.
+// @Description The product must not be deleted; restore it first.
+// @Tags        products
+// @Produce     json
+// @Param       id       path int true "Product ID"
+// @Param       revision path int true "Revision to go back to"
+// @Param       If-Match header string false "ETag the product must still have"
+// @Success     200 {object} Product
+// @Header      200 {string} ETag "The product version"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     422 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/revisions/{revision}/revert [post]
+func revertProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	revision, ok := parseRevision(c, "revision", c.Param("revision"))
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	target, err := store.Revision(ctx, id, revision)
+	if err != nil {
+		if errors.Is(err, ErrProductNotFound) {
+			productNotFound(c, fmt.Sprintf("Product %d has no revision %d", id, revision))
+			return
+		}
+		internalError(c, "Unable to read from database", err)
+		return
+	}
+
+	product, err := store.Patch(ctx, id, func(current Product) (Product, error) {
+		if version != 0 && current.Version != version {
+			return Product{}, ErrVersionMismatch
+		}
+		reverted := revertTo(current, target)
+		// the rules may have tightened since the revision was written
+		if err := validate.Struct(reverted); err != nil {
+			p := validationProblem(err)
+			if p == nil {
+				return Product{}, err
+			}
+			p.Status, p.Detail = http.StatusUnprocessableEntity, fmt.Sprintf("Revision %d is no longer a valid product", revision)
+			return Product{}, &patchError{problem: p}
+		}
+		return reverted, nil
+	})
+	var patchErr *patchError
+	if err != nil {
+		switch {
+		case errors.As(err, &patchErr):
+			writeProblem(c, patchErr.problem)
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductConflict):
+			conflict(c, err)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with id %d", id))
+		default:
+			internalError(c, "Unable to revert the product", err)
+		}
+		return
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, product)
+}
+
+// @Summary     Restore a deleted product
+// @Description Take a product out of the trash. This fails with 409 when another product has taken its name or SKU in the meantime.
+// @Tags        products
+// @Produce     json
+// @Param       id path int true "Product ID"
+// @Param       If-Match header string false "ETag the deleted product must still have"
+// @Success     200 {object} Product
+// @Header      200 {string} ETag "The product version"
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     409 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
+// @Router      /products/{id}/restore [post]
+func restoreProduct(c *gin.Context, store ProductStore) {
+	id, ok := parseIdParam(c)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	product, err := store.Restore(c.Request.Context(), id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductConflict):
+			conflict(c, err)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No deleted product with id %d", id))
+		default:
+			internalError(c, "Unable to restore the product", err)
+		}
+		return
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, product)
 }
 
 // @Summary     Delete a product by name
-// @Description Remove a product's information by name
+// @Description Move a product to the trash by name. It can be restored by id until it is purged.
 // @Tags        products
 // @Accept      json
 // @Produce     json
 // @Param       name  query      string true "Name of the product to delete"
+// @Param       If-Match header string false "ETag the product must still have; required when REQUIRE_IF_MATCH is set"
 // @Success     204 {object} nil
+// @Failure     400 {object} Problem
+// @Failure     401 {object} Problem
+// @Failure     403 {object} Problem
+// @Failure     404 {object} Problem
+// @Failure     412 {object} Problem
+// @Failure     428 {object} Problem
+// @Failure     429 {object} Problem
+// @Failure     500 {object} Problem
+// @Security    ApiKeyAuth
+// @Security    BearerAuth
 // @Router      /products [delete]
-func deleteProductByName(c *gin.Context, db *sql.DB) {
-	productName := c.Query("name")
-
-	result, err := db.Exec("DELETE FROM products WHERE name=?", productName)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while deleting the product"})
+func deleteProductByName(c *gin.Context, store ProductStore) {
+	productName, ok := requireNameQuery(c)
+	if !ok {
 		return
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while retrieving deletion status"})
+	version, ok := ifMatchVersion(c)
+	if !ok {
 		return
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No such product with name '%s'. Product names must be exact", productName)})
+	if err := store.DeleteByName(c.Request.Context(), productName, version); err != nil {
+		switch {
+		case errors.Is(err, ErrVersionMismatch):
+			preconditionFailed(c)
+		case errors.Is(err, ErrProductNotFound):
+			productNotFound(c, fmt.Sprintf("No such product with name '%s'. Product names must be exact", productName))
+		default:
+			internalError(c, "Unable to delete the product", err)
+		}
 		return
 	}
 
@@ -298,30 +1152,129 @@ func deleteProductByName(c *gin.Context, db *sql.DB) {
 }
 
 func main() {
-	err := godotenv.Load()
+	cfg, args, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal(err)
 	}
 
-	databaseFile := os.Getenv("DATABASE_FILE")
-	port := os.Getenv("PORT")
-	host := os.Getenv("HOST")
+	// config needs no database, so it works when the database is the
+	// problem
+	if len(args) > 0 && args[0] == "config" {
+		if err := runConfigCommand(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	if host == "" {
-		host = fmt.Sprintf("localhost:%s", port)
+	accessPolicy := defaultPolicy()
+	if cfg.RBACPolicy != "" {
+		accessPolicy, err = loadPolicy(cfg.RBACPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	docs.SwaggerInfo.Host = host
+	docs.SwaggerInfo.Host = cfg.Host
 
-	db, err := sql.Open("sqlite3", databaseFile)
+	db, sqlDialect, err := openDatabase(cfg.DatabaseURL, cfg.DatabaseFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	initDB(db)
+	migrator, err := NewMigrator(db, sqlDialect)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			err = runMigrateCommand(context.Background(), migrator, args[1:], os.Stdout)
+		case "apikey":
+			err = runAPIKeyCommand(context.Background(), NewSQLStore(db, sqlDialect), accessPolicy, args[1:], os.Stdout)
+		case "purge":
+			err = runPurgeCommand(context.Background(), NewSQLStore(db, sqlDialect), args[1:], cfg.DeletedProductRetention, os.Stdout)
+		default:
+			log.Fatalf("Unknown command %q", args[0])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	printMigrations(os.Stdout, "applied", applied)
+
+	store := NewSQLStore(db, sqlDialect)
+	if err := store.EnableSearch(context.Background()); err != nil {
+		if !errors.Is(err, ErrSearchUnavailable) {
+			log.Fatal(err)
+		}
+		log.Printf("Full-text search is disabled: %v", err)
+	}
+
+	var tokens *jwtVerifier
+	if cfg.JWT.JWKS != "" {
+		tokens, err = newJWTVerifier(context.Background(), cfg.JWT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go tokens.keys.reloadEvery(context.Background(), cfg.JWKSRefresh)
+	}
+	auth := newAuthenticator(store, tokens, accessPolicy)
+
+	go sweepIdempotencyKeys(context.Background(), store, time.Hour)
+	if cfg.DeletedProductRetention > 0 {
+		go purgeDeletedProducts(context.Background(), store, cfg.DeletedProductRetention, time.Hour)
+	}
 
 	r := gin.Default()
+	r.HandleMethodNotAllowed = true
+	// client IPs, which anonymous requests are rate limited by, are only
+	// taken from X-Forwarded-For when a trusted proxy sent it
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	r.NoRoute(func(c *gin.Context) {
+		writeProblem(c, newProblem(http.StatusNotFound, problemNotFound, "No route matches "+c.Request.URL.Path))
+	})
+	r.NoMethod(func(c *gin.Context) {
+		writeProblem(c, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, c.Request.Method+" is not supported on "+c.Request.URL.Path))
+	})
+
+	// CORS comes first so preflights need no credentials and browsers can
+	// read every error
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		r.Use(corsPolicy(cfg.CORS))
+	}
+	// each client gets a bucket of requests per route group, whether or not
+	// the requests are then allowed
+	limiter := NewMemoryRateLimiter()
+	r.Use(requestContext(), limitFailedAuth(limiter, cfg.RateLimits[rateGroupAuth]), auth.authenticate())
+	if cfg.RequireIfMatch {
+		r.Use(requirePreconditions())
+	}
+
+	// product routes need a role granting the permission, except for reads
+	// when PUBLIC_READS is set
+	canRead := auth.authorize(permRead, cfg.PublicReads)
+	canCreate := auth.authorize(permCreate, false)
+	canUpdate := auth.authorize(permUpdate, false)
+	canDelete := auth.authorize(permDelete, false)
+	canManageTrash := auth.authorize(permTrash, false)
+	canBulkEdit := auth.authorize(permBulk, false)
+
+	limitReads := rateLimited(limiter, rateGroupRead, cfg.RateLimits[rateGroupRead])
+	limitWrites := rateLimited(limiter, rateGroupWrite, cfg.RateLimits[rateGroupWrite])
+	limitBulk := rateLimited(limiter, rateGroupBulk, cfg.RateLimits[rateGroupBulk])
 
 	r.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "/swagger/index.html")
@@ -329,33 +1282,74 @@ func main() {
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	r.GET("/products", func(c *gin.Context) {
-		getProducts(c, db)
+	r.GET("/products", limitReads, canRead, func(c *gin.Context) {
+		getProducts(c, store)
+	})
+
+	r.POST("/products", limitWrites, canCreate, idempotent(store, cfg.IdempotencyKeyTTL), func(c *gin.Context) {
+		createProduct(c, store)
 	})
 
-	r.POST("/products", func(c *gin.Context) {
-		createProduct(c, db)
+	r.POST("/products/import", limitBulk, canBulkEdit, func(c *gin.Context) {
+		importProducts(c, store)
 	})
 
-	r.PUT("/products", func(c *gin.Context) {
-		updateProductByName(c, db)
+	r.POST("/products/batch", limitBulk, canBulkEdit, func(c *gin.Context) {
+		batchProducts(c, store)
 	})
 
-	r.GET("/products/:id", func(c *gin.Context) {
-		getProduct(c, db)
+	r.PUT("/products", limitWrites, canUpdate, func(c *gin.Context) {
+		updateProductByName(c, store)
+	})
+
+	r.GET("/products/export", limitBulk, canRead, func(c *gin.Context) {
+		exportProducts(c, store)
+	})
+
+	r.GET("/products/trash", limitReads, canManageTrash, func(c *gin.Context) {
+		getDeletedProducts(c, store)
+	})
+
+	r.GET("/products/search", limitReads, canRead, func(c *gin.Context) {
+		searchProducts(c, store)
+	})
+
+	r.GET("/products/:id", limitReads, canRead, func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	r.PUT("/products/:id", limitWrites, canUpdate, func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	r.PATCH("/products/:id", limitWrites, canUpdate, func(c *gin.Context) {
+		patchProduct(c, store)
+	})
+	r.DELETE("/products/:id", limitWrites, canDelete, func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+	r.POST("/products/:id/restore", limitWrites, canManageTrash, func(c *gin.Context) {
+		restoreProduct(c, store)
+	})
+	r.GET("/products/:id/history", limitReads, canRead, func(c *gin.Context) {
+		getProductHistory(c, store)
+	})
+	r.GET("/products/:id/revisions", limitReads, canRead, func(c *gin.Context) {
+		getProductRevisionAt(c, store)
+	})
+	r.GET("/products/:id/revisions/:revision", limitReads, canRead, func(c *gin.Context) {
+		getProductRevision(c, store)
 	})
-	r.PUT("/products/:id", func(c *gin.Context) {
-		updateProduct(c, db)
+	r.POST("/products/:id/revisions/:revision/revert", limitWrites, canUpdate, func(c *gin.Context) {
+		revertProduct(c, store)
 	})
-	r.DELETE("/products/:id", func(c *gin.Context) {
-		deleteProduct(c, db)
+	r.GET("/products/:id/diff", limitReads, canRead, func(c *gin.Context) {
+		diffProductRevisions(c, store)
 	})
-	r.DELETE("/products", func(c *gin.Context) {
-		deleteProductByName(c, db)
+	r.DELETE("/products", limitWrites, canDelete, func(c *gin.Context) {
+		deleteProductByName(c, store)
 	})
 
-	fmt.Printf("Server running on port %s\n", port)
-	if err := r.Run(fmt.Sprintf(":%s", port)); err != nil {
+	fmt.Printf("Server running on port %d\n", cfg.Port)
+	if err := r.Run(fmt.Sprintf(":%d", cfg.Port)); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
@@ -17,13 +28,37 @@ func setupTestDB(t *testing.T) *sql.DB {
 	if err != nil {
 		t.Fatalf("failed to open test db %v", err)
 	}
-	initDB(db)
+	// every new connection to :memory: would see an empty database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	migrateTestDB(t, db, sqliteDialect{})
 	return db
 }
 
+func migrateTestDB(t *testing.T, db *sql.DB, d dialect) {
+	migrator, err := NewMigrator(db, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("failed to migrate test db: %v", err)
+	}
+}
+
+func setupTestStore(t *testing.T) ProductStore {
+	return NewSQLiteStore(setupTestDB(t))
+}
+
+func seedProducts(t *testing.T, store ProductStore, names ...string) {
+	for _, name := range names {
+		if _, err := store.Create(context.Background(), Product{Name: name}); err != nil {
+			t.Fatalf("Failed to insert test product %q: %v", name, err)
+		}
+	}
+}
+
 func TestCreateProduct(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	productName := "Test Product"
 	reqBody := fmt.Sprintf(`{"name":"%s"}`, productName)
@@ -31,7 +66,7 @@ func TestCreateProduct(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.POST("/products", func(c *gin.Context) {
-		createProduct(c, db) // Only pass context and db
+		createProduct(c, store)
 	})
 
 	req, err := http.NewRequest("POST", "/products", strings.NewReader(reqBody))
@@ -58,18 +93,14 @@ func TestCreateProduct(t *testing.T) {
 }
 
 func TestListProducts(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?), (?), (?)", "Tissue Paper", "Ribbons", "Band Aid")
-	if err != nil {
-		t.Fatalf("Failed to insert test products to db: %v", err)
-	}
+	seedProducts(t, store, "Tissue Paper", "Ribbons", "Band Aid")
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.GET("/products", func(c *gin.Context) {
-		getProducts(c, db) // Only pass context and db
+		getProducts(c, store)
 	})
 
 	req, err := http.NewRequest("GET", "/products", nil)
@@ -84,31 +115,27 @@ func TestListProducts(t *testing.T) {
 		t.Errorf("Handler returned wrong status code: got %v expected %v", status, http.StatusOK)
 	}
 
-	var products []Product
+	var products ProductList
 	err = json.NewDecoder(rr.Body).Decode(&products)
 	if err != nil {
 		t.Errorf("Could not decode JSON body: %v", err)
 	}
 
-	if len(products) != 3 {
-		t.Fatalf("Expected 3 products in db, instead got %v", len(products))
+	if len(products.Items) != 3 || products.Total != 3 {
+		t.Fatalf("Expected 3 products in db, instead got %v of %v", len(products.Items), products.Total)
 	}
 }
 
 func TestGetProductById(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	product2Name := "Soap"
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?), (?), (?)", "Toothpaste", "Toothbrush", product2Name)
-	if err != nil {
-		t.Fatalf("Failed to insert into products: %v", err)
-	}
+	seedProducts(t, store, "Toothpaste", "Toothbrush", product2Name)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.GET("/products/:id", func(c *gin.Context) {
-		getProduct(c, db)
+		getProduct(c, store)
 	})
 
 	req, err := http.NewRequest("GET", "/products/3", nil)
@@ -135,19 +162,15 @@ func TestGetProductById(t *testing.T) {
 }
 
 func TestGetProductByName(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	productName := "Test Product"
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?)", productName)
-	if err != nil {
-		t.Fatalf("Failed to insert test product into db: %v", err)
-	}
+	seedProducts(t, store, productName)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.GET("/products", func(c *gin.Context) {
-		getProducts(c, db)
+		getProducts(c, store)
 	})
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("/products?name=%s", productName), nil)
@@ -186,21 +209,17 @@ func TestGetProductByName(t *testing.T) {
 }
 
 func TestUpdateProduct(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	product1Name := "Sugar"
 	product1NewName := "Honey"
 
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?), (?), (?)", "Brownies", product1Name, "Flour")
-	if err != nil {
-		t.Fatal(err)
-	}
+	seedProducts(t, store, "Brownies", product1Name, "Flour")
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.PUT("/products/:id", func(c *gin.Context) {
-		updateProduct(c, db)
+		updateProduct(c, store)
 	})
 
 	reqBody := fmt.Sprintf(`{"name":"%s"}`, product1NewName)
@@ -228,20 +247,16 @@ func TestUpdateProduct(t *testing.T) {
 }
 
 func TestUpdateProductByName(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	initialProductName := "Bread"
 	newProductName := "Buns"
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?)", initialProductName)
-	if err != nil {
-		t.Fatalf("Failed to insert test product into db: %v", err)
-	}
+	seedProducts(t, store, initialProductName)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.PUT("/products", func(c *gin.Context) {
-		updateProductByName(c, db)
+		updateProductByName(c, store)
 	})
 
 	reqBody := fmt.Sprintf(`{"name":"%s"}`, newProductName)
@@ -281,17 +296,14 @@ func TestUpdateProductByName(t *testing.T) {
 }
 
 func TestDeleteProductById(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
-	if _, err := db.Exec("INSERT INTO products (name) VALUES (?), (?), (?)", "Yams", "Eggs", "Berries"); err != nil {
-		t.Fatal(err)
-	}
+	seedProducts(t, store, "Yams", "Eggs", "Berries")
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.DELETE("/products/:id", func(c *gin.Context) {
-		deleteProduct(c, db) // Only pass context and db
+		deleteProduct(c, store)
 	})
 
 	req, err := http.NewRequest("DELETE", "/products/1", nil)
@@ -306,32 +318,27 @@ func TestDeleteProductById(t *testing.T) {
 		t.Errorf("Handler returned wrong status code: got %v but expected %v", status, http.StatusOK)
 	}
 
-	var rowCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM products").Scan(&rowCount)
+	page, err := store.List(context.Background(), ListOptions{})
 	if err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
 
 	expectedRows := 2
-	if expectedRows != rowCount {
-		t.Errorf("expected %v number of rows remaining, but got %v", expectedRows, rowCount)
+	if expectedRows != page.Total {
+		t.Errorf("expected %v number of rows remaining, but got %v", expectedRows, page.Total)
 	}
 }
 
 func TestDeleteProductByName(t *testing.T) {
-	db := setupTestDB(t)
-	defer db.Close()
+	store := setupTestStore(t)
 
 	productName := "Saccharin"
-	_, err := db.Exec("INSERT INTO products (name) VALUES (?)", productName)
-	if err != nil {
-		t.Fatalf("Failed to insert test product into db: %v", err)
-	}
+	seedProducts(t, store, productName)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
 	router.DELETE("/products", func(c *gin.Context) {
-		deleteProductByName(c, db)
+		deleteProductByName(c, store)
 	})
 
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("/products?name=%s", productName), nil)
@@ -370,3 +377,2048 @@ func TestDeleteProductByName(t *testing.T) {
 		t.Errorf("Handler should return 404 for non-existing product: got %v expected %v", status, http.StatusNotFound)
 	}
 }
+
+func TestListProductsPagination(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Pen", "Pencil", "Eraser", "Ruler", "Stapler")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products", func(c *gin.Context) {
+		getProducts(c, store)
+	})
+
+	var names []string
+	url := "/products?limit=2"
+	for pages := 0; url != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("cursor pagination did not terminate")
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v expected %v", status, http.StatusOK)
+		}
+
+		var list ProductList
+		if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+			t.Fatalf("Could not decode JSON body: %v", err)
+		}
+		if list.Total != 5 {
+			t.Errorf("Expected total of 5 but got %v", list.Total)
+		}
+		for _, product := range list.Items {
+			names = append(names, product.Name)
+		}
+
+		url = ""
+		if list.NextCursor != "" {
+			url = "/products?limit=2&cursor=" + list.NextCursor
+			if link := rr.Header().Get("Link"); !strings.Contains(link, `rel="next"`) {
+				t.Errorf("Expected a next link, got %q", link)
+			}
+		}
+	}
+
+	if strings.Join(names, ",") != "Pen,Pencil,Eraser,Ruler,Stapler" {
+		t.Errorf("Unexpected products across pages: %v", names)
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "offset=-1", "cursor=!!", "offset=2&cursor=eyJhZnRlcl9pZCI6MX0"} {
+		req, err := http.NewRequest("GET", "/products?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q but got %v", query, status)
+		}
+	}
+}
+
+func TestListProductsQueryGrammar(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Apple Juice", "Orange Juice", "Apple Pie", "Bread")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products", func(c *gin.Context) {
+		getProducts(c, store)
+	})
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantNames  string
+	}{
+		{"q=juice", http.StatusOK, "Apple Juice,Orange Juice"},
+		{"name[prefix]=APPLE&sort=-name", http.StatusOK, "Apple Pie,Apple Juice"},
+		{"id[gt]=1&id[lte]=3", http.StatusOK, "Orange Juice,Apple Pie"},
+		{"id[in]=1,4&sort=-id", http.StatusOK, "Bread,Apple Juice"},
+		{"colour[eq]=red", http.StatusBadRequest, ""},
+		{"name[gt]=A", http.StatusBadRequest, ""},
+		{"id[eq]=one", http.StatusBadRequest, ""},
+		{"sort=colour", http.StatusBadRequest, ""},
+		{"sort=name,-name", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/products?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s: got status %v expected %v", tc.query, rr.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var list ProductList
+		if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+			t.Fatalf("%s: could not decode JSON body: %v", tc.query, err)
+		}
+		var names []string
+		for _, product := range list.Items {
+			names = append(names, product.Name)
+		}
+		if got := strings.Join(names, ","); got != tc.wantNames {
+			t.Errorf("%s: got %q expected %q", tc.query, got, tc.wantNames)
+		}
+	}
+}
+
+func TestListProductsCursorFollowsSort(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Delta", "Alpha", "Charlie", "Bravo")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products", func(c *gin.Context) {
+		getProducts(c, store)
+	})
+
+	get := func(url string) (*httptest.ResponseRecorder, ProductList) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var list ProductList
+		json.NewDecoder(rr.Body).Decode(&list)
+		return rr, list
+	}
+
+	_, first := get("/products?sort=name&limit=2")
+	if len(first.Items) != 2 || first.Items[1].Name != "Bravo" || first.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+
+	_, second := get("/products?sort=name&limit=2&cursor=" + first.NextCursor)
+	if len(second.Items) != 2 || second.Items[0].Name != "Charlie" || second.NextCursor != "" {
+		t.Errorf("unexpected second page: %+v", second)
+	}
+
+	if rr, _ := get("/products?sort=-name&limit=2&cursor=" + first.NextCursor); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when reusing a cursor with another sort, got %v", rr.Code)
+	}
+}
+
+func TestSearchProducts(t *testing.T) {
+	store := setupSearchStore(t)
+	seedProducts(t, store, "Green Tea", "Tea Kettle", "Coffee Beans")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products/search", func(c *gin.Context) {
+		searchProducts(c, store)
+	})
+
+	req, err := http.NewRequest("GET", "/products/search?q=tea", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v expected %v", status, http.StatusOK)
+	}
+
+	var page SearchPage
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("Could not decode JSON body: %v", err)
+	}
+	if page.Total != 2 || len(page.Items) != 2 {
+		t.Errorf("Expected 2 results for tea, got %+v", page)
+	}
+
+	req, err = http.NewRequest("GET", "/products/search?q=", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Handler should reject an empty query: got %v expected %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestSearchProductsUnavailable(t *testing.T) {
+	store := NewMemoryStore()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products/search", func(c *gin.Context) {
+		searchProducts(c, store)
+	})
+
+	req, err := http.NewRequest("GET", "/products/search?q=tea", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotImplemented {
+		t.Errorf("Handler returned wrong status code: got %v expected %v", status, http.StatusNotImplemented)
+	}
+}
+
+func TestCreateProductDetails(t *testing.T) {
+	store := setupTestStore(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"name":"Green Tea","description":"Loose leaf","price":1299,"currency":"EUR","sku":"TEA-GRN-250"}`, http.StatusCreated},
+		{`{"name":"Black Tea","sku":"TEA-GRN-250"}`, http.StatusConflict},
+		{`{"name":"White Tea","price":500,"currency":"XXQ"}`, http.StatusBadRequest},
+		{`{"name":"Oolong","price":500}`, http.StatusBadRequest},
+		{`{"name":"Rooibos","price":-1,"currency":"USD"}`, http.StatusBadRequest},
+		{`{"name":"Matcha","sku":"has spaces"}`, http.StatusBadRequest},
+		{`{"name":""}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", "/products", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s: got status %v expected %v (%s)", tc.body, rr.Code, tc.wantStatus, rr.Body.String())
+		}
+	}
+
+	product, err := store.GetByName(context.Background(), "Green Tea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Description != "Loose leaf" || product.Price != 1299 || product.Currency != "EUR" || product.Sku != "TEA-GRN-250" {
+		t.Errorf("product details were not stored: %+v", product)
+	}
+	if product.CreatedAt.IsZero() || !product.UpdatedAt.Equal(product.CreatedAt) {
+		t.Errorf("expected matching created_at and updated_at timestamps, got %+v", product)
+	}
+}
+
+func TestErrorsAreProblemDetails(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Taken")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.GET("/products/:id", func(c *gin.Context) {
+		getProduct(c, store)
+	})
+
+	tests := []struct {
+		method, url, body string
+		wantStatus        int
+		wantType          string
+		wantFields        string
+	}{
+		{"POST", "/products", `{"name":"","price":5,"currency":"usd"}`, http.StatusBadRequest, "/problems/validation-failed", "name,currency"},
+		{"POST", "/products", `{"name":`, http.StatusBadRequest, "/problems/invalid-body", ""},
+		{"POST", "/products", `{"name":"Taken"}`, http.StatusConflict, "/problems/product-conflict", "name"},
+		{"GET", "/products/42", "", http.StatusNotFound, "/problems/product-not-found", ""},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %v expected %v", tc.method, tc.url, rr.Code, tc.wantStatus)
+		}
+		if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/problem+json") {
+			t.Errorf("%s %s: got content type %q", tc.method, tc.url, contentType)
+		}
+
+		var problem Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+			t.Fatalf("Could not decode problem: %v", err)
+		}
+		if problem.Type != tc.wantType || problem.Status != tc.wantStatus || problem.Title == "" || problem.Instance != req.URL.Path {
+			t.Errorf("%s %s: unexpected problem %+v", tc.method, tc.url, problem)
+		}
+
+		var fields []string
+		for _, fieldErr := range problem.Errors {
+			fields = append(fields, fieldErr.Field)
+			if fieldErr.Code == "" || fieldErr.Message == "" {
+				t.Errorf("%s %s: incomplete field error %+v", tc.method, tc.url, fieldErr)
+			}
+		}
+		if got := strings.Join(fields, ","); got != tc.wantFields {
+			t.Errorf("%s %s: got field errors %q expected %q", tc.method, tc.url, got, tc.wantFields)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Pen", "Pencil")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.PUT("/products", func(c *gin.Context) {
+		updateProductByName(c, store)
+	})
+	router.DELETE("/products", func(c *gin.Context) {
+		deleteProductByName(c, store)
+	})
+	router.GET("/products/:id", func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.PUT("/products/:id", func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	router.DELETE("/products/:id", func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+
+	longDescription := `{"name":"Long","description":"` + strings.Repeat("x", maxProductBodyBytes) + `"}`
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+		wantType   string
+		wantFields string
+	}{
+		{"non-numeric id on get", "GET", "/products/abc", "", http.StatusBadRequest, "/problems/invalid-id", "id"},
+		{"zero id on get", "GET", "/products/0", "", http.StatusBadRequest, "/problems/invalid-id", "id"},
+		{"negative id on update", "PUT", "/products/-1", `{"name":"Pen"}`, http.StatusBadRequest, "/problems/invalid-id", "id"},
+		{"overflowing id on delete", "DELETE", "/products/99999999999999999999", "", http.StatusBadRequest, "/problems/invalid-id", "id"},
+		{"empty name on update", "PUT", "/products/1", `{"name":""}`, http.StatusBadRequest, "/problems/validation-failed", "name"},
+		{"bad currency on update by name", "PUT", "/products?name=Pen", `{"name":"Pen","price":5,"currency":"usd"}`, http.StatusBadRequest, "/problems/validation-failed", "currency"},
+		{"missing name query on update", "PUT", "/products", `{"name":"Pen"}`, http.StatusBadRequest, "/problems/invalid-query", ""},
+		{"missing name query on delete", "DELETE", "/products?name=", "", http.StatusBadRequest, "/problems/invalid-query", ""},
+		{"unknown field on create", "POST", "/products", `{"name":"Ink","colour":"blue"}`, http.StatusBadRequest, "/problems/invalid-body", "colour"},
+		{"unknown field on update", "PUT", "/products/1", `{"name":"Pen","Nmae":"x"}`, http.StatusBadRequest, "/problems/invalid-body", "Nmae"},
+		{"wrong type", "POST", "/products", `{"name":"Ink","price":"5"}`, http.StatusBadRequest, "/problems/invalid-body", "price"},
+		{"array body", "POST", "/products", `[{"name":"Ink"}]`, http.StatusBadRequest, "/problems/invalid-body", ""},
+		{"empty body", "POST", "/products", ``, http.StatusBadRequest, "/problems/invalid-body", ""},
+		{"trailing data", "POST", "/products", `{"name":"Ink"}{"name":"Ink"}`, http.StatusBadRequest, "/problems/invalid-body", ""},
+		{"oversized body", "POST", "/products", longDescription, http.StatusRequestEntityTooLarge, "/problems/body-too-large", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatalf("Could not decode problem: %v", err)
+			}
+			if problem.Type != tc.wantType {
+				t.Errorf("got problem type %q expected %q", problem.Type, tc.wantType)
+			}
+
+			var fields []string
+			for _, fieldErr := range problem.Errors {
+				fields = append(fields, fieldErr.Field)
+			}
+			if got := strings.Join(fields, ","); got != tc.wantFields {
+				t.Errorf("got field errors %q expected %q", got, tc.wantFields)
+			}
+		})
+	}
+
+	// nothing above should have changed the catalog
+	product, err := store.Get(context.Background(), 1)
+	if err != nil || product.Name != "Pen" {
+		t.Errorf("product 1 changed to %+v (%v)", product, err)
+	}
+	page, err := store.List(context.Background(), ListOptions{Limit: 10})
+	if err != nil || page.Total != 2 {
+		t.Errorf("got %d products (%v) expected 2", page.Total, err)
+	}
+}
+
+func TestPatchProduct(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	lamp, err := store.Create(ctx, Product{Name: "Lamp", Description: "Brass desk lamp", Price: 4000, Currency: "EUR", Sku: "LAMP-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedProducts(t, store, "Shade")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.PATCH("/products/:id", func(c *gin.Context) {
+		patchProduct(c, store)
+	})
+
+	const (
+		merge = "application/merge-patch+json"
+		ops   = "application/json-patch+json"
+	)
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		wantStatus  int
+		wantType    string
+		check       func(Product) bool
+	}{
+		{"merge one field", "/products/1", merge, `{"price":3500}`, http.StatusOK, "",
+			func(p Product) bool {
+				return p.Price == 3500 && p.Description == "Brass desk lamp" && p.Sku == "LAMP-1"
+			}},
+		{"merge null clears a field", "/products/1", merge + "; charset=utf-8", `{"sku":null}`, http.StatusOK, "",
+			func(p Product) bool { return p.Sku == "" && p.Price == 3500 }},
+		{"json patch", "/products/1", ops, `[{"op":"test","path":"/price","value":3500},{"op":"replace","path":"/description","value":"Brass"}]`, http.StatusOK, "",
+			func(p Product) bool { return p.Description == "Brass" }},
+		{"unchanged read-only fields", "/products/1", ops, `[{"op":"test","path":"/id","value":1},{"op":"replace","path":"/name","value":"Lamp"}]`, http.StatusOK, "",
+			func(p Product) bool { return p.Id == 1 && p.CreatedAt.Equal(lamp.CreatedAt) }},
+		{"merge read-only fields", "/products/1", merge, `{"id":7,"created_at":"2000-01-01T00:00:00Z"}`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"replace version", "/products/1", ops, `[{"op":"replace","path":"/version","value":99}]`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"add deleted_at", "/products/1", ops, `[{"op":"add","path":"/deleted_at","value":"2000-01-01T00:00:00Z"}]`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"failing test op", "/products/1", ops, `[{"op":"test","path":"/price","value":1},{"op":"replace","path":"/price","value":0}]`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"missing path", "/products/1", ops, `[{"op":"remove","path":"/colour"}]`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"unknown field", "/products/1", merge, `{"colour":"red"}`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"wrong type", "/products/1", merge, `{"price":"cheap"}`, http.StatusUnprocessableEntity, "/problems/patch-failed", nil},
+		{"invalid result", "/products/1", merge, `{"name":null}`, http.StatusBadRequest, "/problems/validation-failed", nil},
+		{"conflicting name", "/products/1", merge, `{"name":"Shade"}`, http.StatusConflict, "/problems/product-conflict", nil},
+		{"malformed merge patch", "/products/1", merge, `{"price":`, http.StatusBadRequest, "/problems/invalid-patch", nil},
+		{"merge patch not an object", "/products/1", merge, `[1]`, http.StatusBadRequest, "/problems/invalid-patch", nil},
+		{"malformed json patch", "/products/1", ops, `{"op":"replace"}`, http.StatusBadRequest, "/problems/invalid-patch", nil},
+		{"unknown op", "/products/1", ops, `[{"op":"frob","path":"/price"}]`, http.StatusBadRequest, "/problems/invalid-patch", nil},
+		{"plain json", "/products/1", "application/json", `{"price":1}`, http.StatusUnsupportedMediaType, "/problems/unsupported-media-type", nil},
+		{"unknown product", "/products/99", merge, `{"price":1}`, http.StatusNotFound, "/problems/product-not-found", nil},
+		{"malformed id", "/products/abc", merge, `{"price":1}`, http.StatusBadRequest, "/problems/invalid-id", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("PATCH", tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+
+			if tc.wantType != "" {
+				var problem Problem
+				if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+					t.Fatalf("Could not decode problem: %v", err)
+				}
+				if problem.Type != tc.wantType {
+					t.Errorf("got problem type %q expected %q", problem.Type, tc.wantType)
+				}
+				if tc.wantStatus == http.StatusUnsupportedMediaType && rr.Header().Get("Accept-Patch") == "" {
+					t.Error("expected an Accept-Patch header")
+				}
+				return
+			}
+
+			var product Product
+			if err := json.NewDecoder(rr.Body).Decode(&product); err != nil {
+				t.Fatalf("Could not decode product: %v", err)
+			}
+			if !tc.check(product) {
+				t.Errorf("unexpected product %+v", product)
+			}
+		})
+	}
+
+	// failed patches must not have changed anything
+	got, err := store.Get(ctx, lamp.Id)
+	if err != nil || got.Name != "Lamp" || got.Price != 3500 || got.Description != "Brass" || !got.CreatedAt.Equal(lamp.CreatedAt) || got.DeletedAt != nil {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	// and the read-only fields a patch tried to change are named
+	req, _ := http.NewRequest("PATCH", "/products/1", strings.NewReader(`{"id":7,"version":99}`))
+	req.Header.Set("Content-Type", merge)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var problem Problem
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if len(problem.Errors) != 2 || problem.Errors[0].Field != "id" || problem.Errors[1].Field != "version" || problem.Errors[1].Code != "read_only" {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Desk", "Drawer")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products", func(c *gin.Context) {
+		getProducts(c, store)
+	})
+	router.GET("/products/:id", func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.PUT("/products/:id", func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	router.PATCH("/products/:id", func(c *gin.Context) {
+		patchProduct(c, store)
+	})
+	router.DELETE("/products/:id", func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+
+	send := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		headers    map[string]string
+		wantStatus int
+		wantETag   string
+	}{
+		{"get sends the version as ETag", "GET", "/products/1", "", nil, http.StatusOK, `"1"`},
+		{"by name too", "GET", "/products?name=Desk", "", nil, http.StatusOK, `"1"`},
+		{"current ETag is not modified", "GET", "/products/1", "", map[string]string{"If-None-Match": `"1"`}, http.StatusNotModified, `"1"`},
+		{"weak comparison on reads", "GET", "/products/1", "", map[string]string{"If-None-Match": `"9", W/"1"`}, http.StatusNotModified, `"1"`},
+		{"other ETag is modified", "GET", "/products/1", "", map[string]string{"If-None-Match": `"2"`}, http.StatusOK, `"1"`},
+		{"stale put", "PUT", "/products/1", `{"name":"Table"}`, map[string]string{"If-Match": `"2"`}, http.StatusPreconditionFailed, ""},
+		{"weak If-Match never matches", "PUT", "/products/1", `{"name":"Table"}`, map[string]string{"If-Match": `W/"1"`}, http.StatusPreconditionFailed, ""},
+		{"several If-Match tags", "PUT", "/products/1", `{"name":"Table"}`, map[string]string{"If-Match": `"1", "2"`}, http.StatusBadRequest, ""},
+		{"current put", "PUT", "/products/1", `{"name":"Table","version":7}`, map[string]string{"If-Match": `"1"`}, http.StatusOK, `"2"`},
+		{"stale patch", "PATCH", "/products/1", `{"price":1,"currency":"USD"}`, map[string]string{"If-Match": `"1"`, "Content-Type": "application/merge-patch+json"}, http.StatusPreconditionFailed, ""},
+		{"current patch", "PATCH", "/products/1", `{"price":1,"currency":"USD"}`, map[string]string{"If-Match": `"2"`, "Content-Type": "application/merge-patch+json"}, http.StatusOK, `"3"`},
+		{"unconditional put", "PUT", "/products/2", `{"name":"Cabinet"}`, nil, http.StatusOK, `"2"`},
+		{"star matches any version", "PUT", "/products/2", `{"name":"Cupboard"}`, map[string]string{"If-Match": "*"}, http.StatusOK, `"3"`},
+		{"stale delete", "DELETE", "/products/1", "", map[string]string{"If-Match": `"2"`}, http.StatusPreconditionFailed, ""},
+		{"missing product", "DELETE", "/products/9", "", map[string]string{"If-Match": `"3"`}, http.StatusNotFound, ""},
+		{"current delete", "DELETE", "/products/1", "", map[string]string{"If-Match": `"3"`}, http.StatusOK, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := send(tc.method, tc.url, tc.body, tc.headers)
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if etag := rr.Header().Get("ETag"); etag != tc.wantETag {
+				t.Errorf("got ETag %q expected %q", etag, tc.wantETag)
+			}
+			if tc.wantStatus == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("expected an empty 304 body, got %q", rr.Body.String())
+			}
+		})
+	}
+
+	// listings carry a weak ETag of their body, which changes with the data
+	list := send("GET", "/products", "", nil)
+	listETag := list.Header().Get("ETag")
+	if !strings.HasPrefix(listETag, `W/"`) {
+		t.Fatalf("expected a weak listing ETag, got %q", listETag)
+	}
+	if rr := send("GET", "/products", "", map[string]string{"If-None-Match": listETag}); rr.Code != http.StatusNotModified {
+		t.Errorf("unchanged listing: got status %v expected 304", rr.Code)
+	}
+	send("PUT", "/products/2", `{"name":"Wardrobe"}`, nil)
+	if rr := send("GET", "/products", "", map[string]string{"If-None-Match": listETag}); rr.Code != http.StatusOK {
+		t.Errorf("changed listing: got status %v expected 200", rr.Code)
+	}
+}
+
+func TestRequirePreconditions(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Desk")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(requirePreconditions())
+	router.GET("/products/:id", func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.PUT("/products/:id", func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+
+	tests := []struct {
+		method     string
+		ifMatch    string
+		wantStatus int
+	}{
+		{"GET", "", http.StatusOK},
+		{"PUT", "", http.StatusPreconditionRequired},
+		{"PUT", `"1"`, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, "/products/1", strings.NewReader(`{"name":"Desk"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.ifMatch != "" {
+			req.Header.Set("If-Match", tc.ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s with If-Match %q: got status %v expected %v", tc.method, tc.ifMatch, rr.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk")
+
+	ctx := context.Background()
+	newKey := func(name string, roles ...string) string {
+		raw, hash, err := newAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateAPIKey(ctx, APIKey{Name: name, Hash: hash, Roles: roles}); err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	reader := newKey("reader", roleViewer)
+	writer := newKey("writer", roleEditor)
+	revoked := newKey("revoked", roleCatalogAdmin)
+	if err := store.RevokeAPIKey(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	newRouter := func(publicReads bool) *gin.Engine {
+		router := gin.Default()
+		auth := newAuthenticator(store, nil, defaultPolicy())
+		router.Use(requestContext(), auth.authenticate())
+		router.GET("/products/:id", auth.authorize(permRead, publicReads), func(c *gin.Context) {
+			getProduct(c, store)
+		})
+		router.PUT("/products/:id", auth.authorize(permUpdate, false), func(c *gin.Context) {
+			updateProduct(c, store)
+		})
+		return router
+	}
+
+	tests := []struct {
+		name        string
+		publicReads bool
+		method      string
+		key         string
+		wantStatus  int
+	}{
+		{"Read without a key", false, "GET", "", http.StatusUnauthorized},
+		{"Public read without a key", true, "GET", "", http.StatusOK},
+		{"Read with a read key", false, "GET", reader, http.StatusOK},
+		{"Read with a write key", false, "GET", writer, http.StatusOK},
+		{"Write without a key", true, "PUT", "", http.StatusUnauthorized},
+		{"Write with a read key", false, "PUT", reader, http.StatusForbidden},
+		{"Write with a write key", false, "PUT", writer, http.StatusOK},
+		{"Unknown key", true, "GET", apiKeyPrefix + "nonsense", http.StatusUnauthorized},
+		{"Revoked key", false, "GET", revoked, http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "/products/1", strings.NewReader(`{"name":"Desk"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.key != "" {
+				req.Header.Set("X-API-Key", tc.key)
+			}
+			rr := httptest.NewRecorder()
+			newRouter(tc.publicReads).ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+			if rr.Code >= 400 && rr.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("expected a problem, got %s", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	// changes are attributed to the key that made them
+	page, err := store.History(ctx, 1, HistoryOptions{Limit: 1})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Actor != "apikey:writer" {
+		t.Errorf("expected the update to be attributed to the writer key, got %+v, %v", page.Items, err)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk")
+
+	ctx := context.Background()
+	keys := newTestSigningKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, keys...)
+	tokens, err := newJWTVerifier(ctx, jwtConfig{JWKS: path, Audience: "product-api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	newRouter := func(tokens *jwtVerifier) *gin.Engine {
+		router := gin.Default()
+		auth := newAuthenticator(store, tokens, defaultPolicy())
+		router.Use(requestContext(), auth.authenticate())
+		router.PUT("/products/:id", auth.authorize(permUpdate, false), func(c *gin.Context) {
+			updateProduct(c, store)
+		})
+		return router
+	}
+
+	tests := []struct {
+		name          string
+		tokens        *jwtVerifier
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{"Valid token", tokens, "Bearer " + signTestToken(t, keys[1], testClaims(nil)), http.StatusOK, ""},
+		{"Lowercase scheme", tokens, "bearer " + signTestToken(t, keys[1], testClaims(nil)), http.StatusOK, ""},
+		{"Roles as a string", tokens, "Bearer " + signTestToken(t, keys[1], testClaims(jwt.MapClaims{"roles": "viewer editor"})), http.StatusOK, ""},
+		{"Viewer", tokens, "Bearer " + signTestToken(t, keys[1], testClaims(jwt.MapClaims{"roles": []string{roleViewer}})), http.StatusForbidden, ""},
+		{"Without roles", tokens, "Bearer " + signTestToken(t, keys[1], testClaims(jwt.MapClaims{"roles": nil})), http.StatusForbidden, ""},
+		{"Wrong audience", tokens, "Bearer " + signTestToken(t, keys[1], testClaims(jwt.MapClaims{"aud": "billing-api"})), http.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"No credentials", tokens, "", http.StatusUnauthorized, "Bearer"},
+		{"Bearer auth disabled", nil, "Bearer " + signTestToken(t, keys[1], testClaims(nil)), http.StatusUnauthorized, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("PUT", "/products/1", strings.NewReader(`{"name":"Desk"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			newRouter(tc.tokens).ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			challenges := rr.Header().Values("WWW-Authenticate")
+			if tc.wantChallenge != "" && !slices.Contains(challenges, tc.wantChallenge) {
+				t.Errorf("expected the challenge %q, got %q", tc.wantChallenge, challenges)
+			}
+			if tc.tokens == nil && slices.ContainsFunc(challenges, func(c string) bool { return strings.HasPrefix(c, "Bearer") }) {
+				t.Errorf("expected no Bearer challenge while bearer auth is disabled, got %q", challenges)
+			}
+		})
+	}
+
+	// changes are attributed to the token's subject
+	page, err := store.History(ctx, 1, HistoryOptions{Limit: 1})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Actor != "jwt:user-42" {
+		t.Errorf("expected the update to be attributed to the subject, got %+v, %v", page.Items, err)
+	}
+}
+
+func TestRoleBasedAccess(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk", "Chair", "Lamp")
+
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, role := range []string{roleViewer, roleEditor, roleCatalogAdmin} {
+		raw, hash, err := newAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateAPIKey(ctx, APIKey{Name: role, Hash: hash, Roles: []string{role}}); err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = raw
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	auth := newAuthenticator(store, nil, defaultPolicy())
+	router.Use(requestContext(), auth.authenticate())
+	router.GET("/products/:id", auth.authorize(permRead, false), func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.POST("/products", auth.authorize(permCreate, false), func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.PUT("/products/:id", auth.authorize(permUpdate, false), func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	router.DELETE("/products/:id", auth.authorize(permDelete, false), func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+	router.DELETE("/products", auth.authorize(permDelete, false), func(c *gin.Context) {
+		deleteProductByName(c, store)
+	})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tests := []struct {
+		role       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{roleViewer, "GET", "/products/1", "", http.StatusOK},
+		{roleViewer, "POST", "/products", `{"name":"Shelf"}`, http.StatusForbidden},
+		{roleEditor, "POST", "/products", `{"name":"Shelf"}`, http.StatusCreated},
+		{roleEditor, "PUT", "/products/1", `{"name":"Oak desk"}`, http.StatusOK},
+		{roleEditor, "DELETE", "/products/1", "", http.StatusForbidden},
+		{roleEditor, "DELETE", "/products?name=Chair", "", http.StatusForbidden},
+		{roleCatalogAdmin, "DELETE", "/products/1", "", http.StatusOK},
+		{roleCatalogAdmin, "DELETE", "/products?name=Chair", "", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.role+" "+tc.method+" "+tc.url, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-API-Key", keys[tc.role])
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Errorf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if tc.wantStatus == http.StatusForbidden {
+				var problem Problem
+				if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil || problem.Title != "Insufficient permissions" ||
+					!strings.Contains(problem.Detail, "None of your roles grants") {
+					t.Errorf("got %+v, %v", problem, err)
+				}
+			}
+		})
+	}
+
+	// denials are logged with who was denied what
+	for _, want := range []string{"DELETE /products/1 by apikey:editor with roles [editor] lacks products.delete", "POST /products by apikey:viewer"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("expected the log to contain %q, got %q", want, logged.String())
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+
+	ctx := context.Background()
+	apiKeys := map[string]string{}
+	for _, tenant := range []string{"acme", "globex"} {
+		raw, hash, err := newAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateAPIKey(ctx, APIKey{Name: tenant, Hash: hash, Roles: []string{roleEditor}, Tenant: tenant}); err != nil {
+			t.Fatal(err)
+		}
+		apiKeys[tenant] = raw
+	}
+	signingKeys := newTestSigningKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, signingKeys[0])
+	tokens, err := newJWTVerifier(ctx, jwtConfig{JWKS: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	auth := newAuthenticator(store, tokens, defaultPolicy())
+	router.Use(requestContext(), auth.authenticate())
+	router.GET("/products", auth.authorize(permRead, true), func(c *gin.Context) {
+		getProducts(c, store)
+	})
+	router.GET("/products/:id", auth.authorize(permRead, true), func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.POST("/products", auth.authorize(permCreate, false), func(c *gin.Context) {
+		createProduct(c, store)
+	})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	send := func(method, url, body string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	withKey := func(tenant string) http.Header {
+		return http.Header{"X-Api-Key": {apiKeys[tenant]}}
+	}
+
+	// both tenants may have a Kettle
+	ids := map[string]int{}
+	for _, tenant := range []string{"acme", "globex"} {
+		rr := send("POST", "/products", `{"name":"Kettle"}`, withKey(tenant))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: got status %v: %s", tenant, rr.Code, rr.Body.String())
+		}
+		var created Product
+		if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		ids[tenant] = created.Id
+	}
+	acmeURL := fmt.Sprintf("/products/%d", ids["acme"])
+	globexURL := fmt.Sprintf("/products/%d", ids["globex"])
+
+	tests := []struct {
+		name       string
+		url        string
+		header     http.Header
+		wantStatus int
+	}{
+		{"Own product by key", acmeURL, withKey("acme"), http.StatusOK},
+		{"Other tenant's product by key", globexURL, withKey("acme"), http.StatusNotFound},
+		{"Own tenant named", acmeURL, http.Header{"X-Api-Key": {apiKeys["acme"]}, "X-Tenant-Id": {"acme"}}, http.StatusOK},
+		{"Other tenant named", globexURL, http.Header{"X-Api-Key": {apiKeys["acme"]}, "X-Tenant-Id": {"globex"}}, http.StatusForbidden},
+		{"Token for the tenant", globexURL, http.Header{"Authorization": {"Bearer " + signTestToken(t, signingKeys[0], testClaims(jwt.MapClaims{"tenant": "globex"}))}}, http.StatusOK},
+		{"Token for another tenant", acmeURL, http.Header{"Authorization": {"Bearer " + signTestToken(t, signingKeys[0], testClaims(jwt.MapClaims{"tenant": "globex"}))}}, http.StatusNotFound},
+		{"Token without a tenant", acmeURL, http.Header{"Authorization": {"Bearer " + signTestToken(t, signingKeys[0], testClaims(nil))}}, http.StatusNotFound},
+		{"Token with a malformed tenant", acmeURL, http.Header{"Authorization": {"Bearer " + signTestToken(t, signingKeys[0], testClaims(jwt.MapClaims{"tenant": 42}))}}, http.StatusUnauthorized},
+		{"Anonymous with a tenant", acmeURL, http.Header{"X-Tenant-Id": {"acme"}}, http.StatusUnauthorized},
+		{"Anonymous with the default tenant", acmeURL, http.Header{"X-Tenant-Id": {defaultTenant}}, http.StatusNotFound},
+		{"Anonymous without a tenant", acmeURL, nil, http.StatusNotFound},
+		{"Anonymous with a malformed tenant", acmeURL, http.Header{"X-Tenant-Id": {"../acme"}}, http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := send("GET", tc.url, "", tc.header)
+			if rr.Code != tc.wantStatus {
+				t.Errorf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+		})
+	}
+
+	// public reads only ever list the default tenant's catalog
+	if rr := send("GET", "/products", "", http.Header{"X-Tenant-Id": {"acme"}}); rr.Code != http.StatusUnauthorized || strings.Contains(rr.Body.String(), "Kettle") {
+		t.Errorf("anonymous listing of another tenant: got status %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("GET", "/products", "", nil); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "Kettle") {
+		t.Errorf("anonymous listing: got status %v: %s", rr.Code, rr.Body.String())
+	}
+
+	if want := fmt.Sprintf("GET %s by apikey:acme of tenant acme to tenant \"globex\"", globexURL); !strings.Contains(logged.String(), want) {
+		t.Errorf("expected the log to contain %q, got %q", want, logged.String())
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk")
+
+	raw, hash, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateAPIKey(context.Background(), APIKey{Name: "storefront", Hash: hash, Roles: []string{roleViewer}, Tenant: defaultTenant}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.SetTrustedProxies(nil)
+	auth := newAuthenticator(store, nil, defaultPolicy())
+	router.Use(requestContext(), auth.authenticate())
+	limiter := NewMemoryRateLimiter()
+	router.GET("/products/:id", rateLimited(limiter, rateGroupRead, RateLimit{Requests: 2, Per: time.Minute}), auth.authorize(permRead, true), func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.GET("/products", rateLimited(limiter, rateGroupRead, RateLimit{}), auth.authorize(permRead, true), func(c *gin.Context) {
+		getProducts(c, store)
+	})
+
+	get := func(url, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		rr := get("/products/1", "192.0.2.1:1234", nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != wantRemaining || rr.Header().Get("RateLimit-Limit") != "2" {
+			t.Fatalf("request %d: got status %v, headers %v", i+1, rr.Code, rr.Header())
+		}
+	}
+	// spoofing X-Forwarded-For does not get a fresh bucket
+	rr := get("/products/1", "192.0.2.1:5678", http.Header{"X-Forwarded-For": {"198.51.100.7"}})
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %v expected 429: %s", rr.Code, rr.Body.String())
+	}
+	var problem Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil || problem.Type != "/problems/"+problemRateLimited {
+		t.Errorf("got %+v, %v", problem, err)
+	}
+	if rr.Header().Get("Retry-After") != "30" || rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Policy") != "2;w=60" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+
+	// other clients have buckets of their own
+	if rr := get("/products/1", "192.0.2.2:1234", nil); rr.Code != http.StatusOK {
+		t.Errorf("another IP: got status %v", rr.Code)
+	}
+	if rr := get("/products/1", "192.0.2.1:1234", http.Header{"X-Api-Key": {raw}}); rr.Code != http.StatusOK {
+		t.Errorf("an API key from the same IP: got status %v", rr.Code)
+	}
+
+	// a group without a limit sends no headers
+	if rr := get("/products", "192.0.2.1:1234", nil); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited group: got status %v, headers %v", rr.Code, rr.Header())
+	}
+}
+
+// countingKeys counts the API key lookups made through it
+type countingKeys struct {
+	APIKeyStore
+	lookups int
+}
+
+func (k *countingKeys) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	k.lookups++
+	return k.APIKeyStore.APIKeyByHash(ctx, hash)
+}
+
+func TestFailedAuthRateLimit(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk")
+
+	raw, hash, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateAPIKey(context.Background(), APIKey{Name: "storefront", Hash: hash, Roles: []string{roleViewer}, Tenant: defaultTenant}); err != nil {
+		t.Fatal(err)
+	}
+	keys := &countingKeys{APIKeyStore: store}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.SetTrustedProxies(nil)
+	auth := newAuthenticator(keys, nil, defaultPolicy())
+	router.Use(requestContext(), limitFailedAuth(NewMemoryRateLimiter(), RateLimit{Requests: 2, Per: time.Minute}), auth.authenticate())
+	router.GET("/products/:id", auth.authorize(permRead, true), func(c *gin.Context) {
+		getProduct(c, store)
+	})
+
+	get := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/products/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// valid keys and anonymous requests do not count
+	for range 3 {
+		if rr := get("192.0.2.1:1234", raw); rr.Code != http.StatusOK {
+			t.Fatalf("valid key: got status %v", rr.Code)
+		}
+		if rr := get("192.0.2.1:1234", ""); rr.Code != http.StatusOK {
+			t.Fatalf("anonymous: got status %v", rr.Code)
+		}
+	}
+
+	for i := range 2 {
+		if rr := get("192.0.2.1:1234", "pak_guess"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: got status %v", i+1, rr.Code)
+		}
+	}
+	lookups := keys.lookups
+	rr := get("192.0.2.1:1234", "pak_guess")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "30" {
+		t.Fatalf("got status %v, headers %v expected 429", rr.Code, rr.Header())
+	}
+	if keys.lookups != lookups {
+		t.Error("expected no API key lookup once the client is limited")
+	}
+	if rr := get("192.0.2.1:1234", ""); rr.Code != http.StatusOK {
+		t.Errorf("anonymous from a limited IP: got status %v", rr.Code)
+	}
+	if rr := get("192.0.2.2:1234", "pak_guess"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("another IP: got status %v", rr.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+	seedProducts(t, store, "Desk")
+
+	newRouter := func(cfg corsConfig) *gin.Engine {
+		gin.SetMode(gin.TestMode)
+		router := gin.Default()
+		router.HandleMethodNotAllowed = true
+		router.NoMethod(func(c *gin.Context) {
+			writeProblem(c, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, c.Request.Method+" is not supported on "+c.Request.URL.Path))
+		})
+		auth := newAuthenticator(store, nil, defaultPolicy())
+		router.Use(corsPolicy(cfg), requestContext(), auth.authenticate())
+		router.GET("/products/:id", auth.authorize(permRead, false), func(c *gin.Context) {
+			getProduct(c, store)
+		})
+		router.PUT("/products/:id", auth.authorize(permUpdate, false), func(c *gin.Context) {
+			updateProduct(c, store)
+		})
+		return router
+	}
+	cfg := corsConfig{
+		AllowedOrigins:   []string{"https://admin.example.com"},
+		AllowedMethods:   defaultCORSMethods,
+		AllowedHeaders:   defaultCORSHeaders,
+		ExposedHeaders:   defaultCORSExposedHeaders,
+		AllowCredentials: true,
+		MaxAge:           defaultCORSMaxAge,
+	}
+	router := newRouter(cfg)
+
+	send := func(router *gin.Engine, method string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/products/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	preflight := func(origin, method, headers string) http.Header {
+		return http.Header{"Origin": {origin}, "Access-Control-Request-Method": {method}, "Access-Control-Request-Headers": {headers}}
+	}
+
+	// preflights are answered before authentication
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		rr := send(router, "OPTIONS", preflight("https://admin.example.com", method, "content-type, if-match, x-api-key"))
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("%s preflight: got status %v: %s", method, rr.Code, rr.Body.String())
+		}
+		want := map[string]string{
+			"Access-Control-Allow-Origin":      "https://admin.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "GET, POST, PUT, PATCH, DELETE",
+			"Access-Control-Max-Age":           "600",
+			"Vary":                             "Origin",
+		}
+		for name, value := range want {
+			if got := rr.Header().Get(name); got != value {
+				t.Errorf("%s preflight: %s got %q expected %q", method, name, got, value)
+			}
+		}
+	}
+
+	refused := []struct {
+		name   string
+		header http.Header
+	}{
+		{"Other origin", preflight("https://evil.example.com", "PUT", "")},
+		{"Method not allowed", preflight("https://admin.example.com", "TRACE", "")},
+		{"Header not allowed", preflight("https://admin.example.com", "PUT", "x-secret")},
+	}
+	for _, tc := range refused {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := send(router, "OPTIONS", tc.header)
+			if rr.Code != http.StatusForbidden || rr.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("got status %v, headers %v", rr.Code, rr.Header())
+			}
+		})
+	}
+
+	// actual requests get the headers too, errors included, so the panel can
+	// read them
+	rr := send(router, "GET", http.Header{"Origin": {"https://admin.example.com"}})
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" ||
+		!strings.Contains(rr.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Errorf("actual request: got status %v, headers %v", rr.Code, rr.Header())
+	}
+	rr = send(router, "GET", http.Header{"Origin": {"https://evil.example.com"}})
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers for another origin, got %v", rr.Header())
+	}
+	rr = send(router, "OPTIONS", nil)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a plain OPTIONS request to be left to the router, got %v", rr.Code)
+	}
+
+	// any origin, without credentials
+	cfg.AllowedOrigins, cfg.AllowCredentials = []string{"*"}, false
+	rr = send(newRouter(cfg), "OPTIONS", preflight("https://anywhere.example.com", "DELETE", ""))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "*" || rr.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("any origin: got status %v, headers %v", rr.Code, rr.Header())
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	store := setupTestStore(t).(*SQLStore)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/products", idempotent(store, time.Hour), func(c *gin.Context) {
+		createProduct(c, store)
+	})
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/products", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := post("create-kettle", `{"name":"Kettle"}`)
+	if first.Code != http.StatusCreated || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: got status %v, headers %v", first.Code, first.Header())
+	}
+
+	_, inProgress, err := store.ReserveIdempotencyKey(context.Background(), "in-flight", idempotencyHash("POST", "/products", []byte(`{"name":"Toaster"}`)), now().Add(time.Hour))
+	if err != nil || !inProgress {
+		t.Fatalf("reserve: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		wantStatus   int
+		wantType     string
+		wantReplayed bool
+	}{
+		{"retry replays the response", "create-kettle", `{"name":"Kettle"}`, http.StatusCreated, "", true},
+		{"different body", "create-kettle", `{"name":"Toaster"}`, http.StatusUnprocessableEntity, "/problems/idempotency-key-reused", false},
+		{"without a key the conflict shows", "", `{"name":"Kettle"}`, http.StatusConflict, "/problems/product-conflict", false},
+		{"errors are stored too", "bad-body", `{"name":""}`, http.StatusBadRequest, "/problems/validation-failed", false},
+		{"and replayed", "bad-body", `{"name":""}`, http.StatusBadRequest, "/problems/validation-failed", true},
+		{"request still in flight", "in-flight", `{"name":"Toaster"}`, http.StatusConflict, "/problems/idempotency-key-in-use", false},
+		{"key too long", strings.Repeat("k", 256), `{"name":"Toaster"}`, http.StatusBadRequest, "/problems/invalid-idempotency-key", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := post(tc.key, tc.body)
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.wantReplayed {
+				t.Errorf("got replayed %v expected %v", replayed, tc.wantReplayed)
+			}
+
+			if tc.wantType == "" {
+				if rr.Body.String() != first.Body.String() || rr.Header().Get("ETag") != first.Header().Get("ETag") {
+					t.Errorf("replay differs: got %s %v", rr.Body.String(), rr.Header())
+				}
+				return
+			}
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatalf("Could not decode problem: %v", err)
+			}
+			if problem.Type != tc.wantType {
+				t.Errorf("got problem type %q expected %q", problem.Type, tc.wantType)
+			}
+		})
+	}
+
+	page, err := store.List(context.Background(), ListOptions{})
+	if err != nil || page.Total != 1 {
+		t.Errorf("expected exactly one product, got %d (%v)", page.Total, err)
+	}
+}
+
+func TestBatchProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantType    string
+		wantFields  string
+		wantResults []int
+		wantNames   string
+	}{
+		{
+			name:        "atomic success",
+			body:        `{"operations":[{"op":"create","product":{"name":"Lamp"}},{"op":"update","id":1,"version":1,"product":{"name":"Big Desk"}},{"op":"delete","id":2}]}`,
+			wantStatus:  http.StatusOK,
+			wantResults: []int{201, 200, 204},
+			wantNames:   "Big Desk,Lamp",
+		},
+		{
+			name:       "atomic conflict rolls back",
+			body:       `{"operations":[{"op":"create","product":{"name":"Lamp"}},{"op":"create","product":{"name":"Chair"}}]}`,
+			wantStatus: http.StatusConflict,
+			wantType:   "/problems/batch-failed",
+			wantFields: "operations[1].product.name",
+			wantNames:  "Desk,Chair",
+		},
+		{
+			name:       "atomic stale version",
+			body:       `{"mode":"atomic","operations":[{"op":"delete","id":1,"version":5}]}`,
+			wantStatus: http.StatusPreconditionFailed,
+			wantType:   "/problems/batch-failed",
+			wantFields: "operations[0].version",
+			wantNames:  "Desk,Chair",
+		},
+		{
+			name:       "atomic validation",
+			body:       `{"operations":[{"op":"create","product":{"name":""}},{"op":"update","id":1},{"op":"frob"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "/problems/validation-failed",
+			wantFields: "operations[0].product.name,operations[1].product,operations[2].op",
+			wantNames:  "Desk,Chair",
+		},
+		{
+			name:        "partial",
+			body:        `{"mode":"partial","operations":[{"op":"create","product":{"name":"Lamp"}},{"op":"create","product":{"name":"Chair"}},{"op":"delete","id":9},{"op":"create","product":{"name":"","price":-1}},{"op":"delete","id":1}]}`,
+			wantStatus:  http.StatusMultiStatus,
+			wantResults: []int{201, 409, 404, 400, 204},
+			wantNames:   "Chair,Lamp",
+		},
+		{
+			name:       "unknown mode",
+			body:       `{"mode":"some","operations":[{"op":"delete","id":1}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "/problems/validation-failed",
+			wantFields: "mode",
+			wantNames:  "Desk,Chair",
+		},
+		{
+			name:       "empty batch",
+			body:       `{"operations":[]}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "/problems/validation-failed",
+			wantFields: "operations",
+			wantNames:  "Desk,Chair",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t)
+			seedProducts(t, store, "Desk", "Chair")
+
+			router := gin.Default()
+			router.POST("/products/batch", func(c *gin.Context) {
+				batchProducts(c, store)
+			})
+
+			req, err := http.NewRequest("POST", "/products/batch", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+
+			if tc.wantType != "" {
+				var problem Problem
+				if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+					t.Fatalf("Could not decode problem: %v", err)
+				}
+				var fields []string
+				for _, fieldErr := range problem.Errors {
+					fields = append(fields, fieldErr.Field)
+				}
+				if problem.Type != tc.wantType || strings.Join(fields, ",") != tc.wantFields {
+					t.Errorf("got problem %s with fields %v", problem.Type, fields)
+				}
+			} else {
+				var response BatchResponse
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Fatalf("Could not decode response: %v", err)
+				}
+				var statuses []int
+				for _, result := range response.Results {
+					statuses = append(statuses, result.Status)
+					if (result.Status >= 400) != (result.Problem != nil) {
+						t.Errorf("result %+v should carry a problem exactly when it failed", result)
+					}
+				}
+				if fmt.Sprint(statuses) != fmt.Sprint(tc.wantResults) {
+					t.Errorf("got statuses %v expected %v", statuses, tc.wantResults)
+				}
+			}
+
+			page, err := store.List(context.Background(), ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, product := range page.Items {
+				names = append(names, product.Name)
+			}
+			if got := strings.Join(names, ","); got != tc.wantNames {
+				t.Errorf("got products %q expected %q", got, tc.wantNames)
+			}
+		})
+	}
+}
+
+func TestImportProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		contentType string
+		query       string
+		body        string
+		wantStatus  int
+		wantType    string
+		wantRows    string
+		wantCounts  [4]int
+		wantNames   string
+	}{
+		{
+			name:        "csv upsert by name",
+			contentType: "text/csv",
+			body:        "name,price,currency\nDesk,1999,USD\nLamp,500,EUR\nChair,0,\n",
+			wantStatus:  http.StatusOK,
+			wantRows:    "2:update,3:create",
+			wantCounts:  [4]int{1, 1, 1, 0},
+			wantNames:   "Desk,Chair,Lamp",
+		},
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson",
+			body:        "{\"name\":\"Desk\",\"description\":\"Oak\"}\n\n{\"name\":\"Lamp\"}\n",
+			wantStatus:  http.StatusOK,
+			wantRows:    "1:update,3:create",
+			wantCounts:  [4]int{1, 1, 0, 0},
+			wantNames:   "Desk,Chair,Lamp",
+		},
+		{
+			name:        "dry run writes nothing",
+			contentType: "text/csv; charset=utf-8",
+			query:       "?dry_run=true",
+			body:        "name,price,currency\nDesk,1999,USD\nLamp,500,EUR\n",
+			wantStatus:  http.StatusOK,
+			wantRows:    "2:update,3:create",
+			wantCounts:  [4]int{1, 1, 0, 0},
+			wantNames:   "Desk,Chair",
+		},
+		{
+			name:        "row errors",
+			contentType: "text/csv",
+			body:        "name,price,currency\nLamp,abc,USD\n,5,USD\nStool,-1,USD\nLamp,5,USD\nLamp,6,USD\n\"Bad,5\n",
+			wantStatus:  http.StatusOK,
+			wantRows:    "2:error:price,3:error:name,4:error:price,5:create,6:error:name,7:error:row",
+			wantCounts:  [4]int{1, 0, 0, 5},
+			wantNames:   "Desk,Chair,Lamp",
+		},
+		{
+			name:        "by sku",
+			contentType: "application/x-ndjson",
+			query:       "?key=sku",
+			body:        "{\"sku\":\"LAMP-1\",\"name\":\"Lamp\"}\n{\"sku\":\"DESK-1\",\"name\":\"Desk\"}\n{\"name\":\"Stool\"}\n{\"sku\":\"STOOL-1\",\"name\":\"Stool\",\"colour\":\"red\"}\n",
+			wantStatus:  http.StatusOK,
+			wantRows:    "1:create,2:error:name,3:error:sku,4:error:colour",
+			wantCounts:  [4]int{1, 0, 0, 3},
+			wantNames:   "Desk,Chair,Lamp",
+		},
+		{
+			name:        "unknown column",
+			contentType: "text/csv",
+			body:        "name,colour\nLamp,red\n",
+			wantStatus:  http.StatusBadRequest,
+			wantType:    "/problems/invalid-body",
+			wantNames:   "Desk,Chair",
+		},
+		{
+			name:        "unknown key",
+			contentType: "text/csv",
+			query:       "?key=id",
+			body:        "name\nLamp\n",
+			wantStatus:  http.StatusBadRequest,
+			wantType:    "/problems/invalid-query",
+			wantNames:   "Desk,Chair",
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "application/json",
+			body:        `[{"name":"Lamp"}]`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+			wantType:    "/problems/unsupported-media-type",
+			wantNames:   "Desk,Chair",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t)
+			seedProducts(t, store, "Desk", "Chair")
+
+			router := gin.Default()
+			router.POST("/products/import", func(c *gin.Context) {
+				importProducts(c, store)
+			})
+
+			req, err := http.NewRequest("POST", "/products/import"+tc.query, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+
+			if tc.wantType != "" {
+				var problem Problem
+				if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+					t.Fatalf("Could not decode problem: %v", err)
+				}
+				if problem.Type != tc.wantType {
+					t.Errorf("got problem %s expected %s", problem.Type, tc.wantType)
+				}
+			} else {
+				var report ImportReport
+				if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+					t.Fatalf("Could not decode report: %v", err)
+				}
+				var rows []string
+				for _, row := range report.Rows {
+					desc := fmt.Sprintf("%d:%s", row.Line, row.Action)
+					for _, fieldErr := range row.Errors {
+						desc += ":" + fieldErr.Field
+					}
+					rows = append(rows, desc)
+				}
+				if got := strings.Join(rows, ","); got != tc.wantRows {
+					t.Errorf("got rows %q expected %q", got, tc.wantRows)
+				}
+				counts := [4]int{report.Created, report.Updated, report.Unchanged, report.Failed}
+				if counts != tc.wantCounts {
+					t.Errorf("got created, updated, unchanged, failed %v expected %v", counts, tc.wantCounts)
+				}
+			}
+
+			page, err := store.List(context.Background(), ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, product := range page.Items {
+				names = append(names, product.Name)
+			}
+			if got := strings.Join(names, ","); got != tc.wantNames {
+				t.Errorf("got products %q expected %q", got, tc.wantNames)
+			}
+		})
+	}
+}
+
+// failingEachStore fails every export before a product is read
+type failingEachStore struct {
+	ProductStore
+}
+
+func (failingEachStore) Each(ctx context.Context, opts ListOptions, fn func(Product) error) error {
+	return errors.New("connection lost")
+}
+
+func TestExportProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name            string
+		query           string
+		failing         bool
+		wantStatus      int
+		wantContentType string
+		wantExtension   string
+		wantBody        string
+	}{
+		{
+			name:            "csv",
+			query:           "?format=csv&price[gte]=100&sort=-price",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/csv; charset=utf-8",
+			wantExtension:   ".csv",
+			wantBody:        "id,name,description,price,currency,sku,created_at,updated_at,version,deleted_at\n2,Chair,\"Four legs, one seat\",2500,EUR,CHR-1,T,T,1,\n1,Desk,Oak,1999,USD,,T,T,1,\n",
+		},
+		{
+			name:            "ndjson",
+			query:           "?format=ndjson&name[prefix]=d",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/x-ndjson",
+			wantExtension:   ".ndjson",
+			wantBody:        `{"id":1,"name":"Desk","description":"Oak","price":1999,"currency":"USD","created_at":"T","updated_at":"T","version":1}` + "\n",
+		},
+		{
+			name:            "json by default",
+			query:           "?q=a&limit=1",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json; charset=utf-8",
+			wantExtension:   ".json",
+			wantBody:        `[{"id":2,"name":"Chair","description":"Four legs, one seat","price":2500,"currency":"EUR","sku":"CHR-1","created_at":"T","updated_at":"T","version":1},{"id":3,"name":"Lamp","description":"","price":0,"currency":"","created_at":"T","updated_at":"T","version":1}]` + "\n",
+		},
+		{
+			name:            "no matches",
+			query:           "?format=json&price[gt]=10000",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json; charset=utf-8",
+			wantExtension:   ".json",
+			wantBody:        "[]\n",
+		},
+		{
+			name:            "unknown format",
+			query:           "?format=xlsx",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/problem+json",
+		},
+		{
+			name:            "invalid filter",
+			query:           "?format=csv&colour[eq]=red",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/problem+json",
+		},
+		{
+			name:            "store failure before the first row",
+			query:           "?format=csv",
+			failing:         true,
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/problem+json",
+		},
+	}
+
+	timestamp := regexp.MustCompile(`\d{4}-\d\d-\d\dT[0-9:.]+Z`)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var store ProductStore = setupTestStore(t)
+			for _, product := range []Product{
+				{Name: "Desk", Description: "Oak", Price: 1999, Currency: "USD"},
+				{Name: "Chair", Description: "Four legs, one seat", Price: 2500, Currency: "EUR", Sku: "CHR-1"},
+				{Name: "Lamp"},
+			} {
+				if _, err := store.Create(context.Background(), product); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.failing {
+				store = failingEachStore{store}
+			}
+
+			router := gin.Default()
+			router.GET("/products/export", func(c *gin.Context) {
+				exportProducts(c, store)
+			})
+
+			req, err := http.NewRequest("GET", "/products/export"+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if got := rr.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("got Content-Type %q expected %q", got, tc.wantContentType)
+			}
+
+			disposition := rr.Header().Get("Content-Disposition")
+			if tc.wantExtension == "" {
+				if disposition != "" {
+					t.Errorf("error response should not be an attachment, got %q", disposition)
+				}
+				return
+			}
+			if !regexp.MustCompile(`^attachment; filename=products-\d{8}T\d{6}Z\` + tc.wantExtension + `$`).MatchString(disposition) {
+				t.Errorf("unexpected Content-Disposition %q", disposition)
+			}
+			if got := timestamp.ReplaceAllString(rr.Body.String(), "T"); got != tc.wantBody {
+				t.Errorf("got body\n%s\nexpected\n%s", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	store := setupTestStore(t)
+	seedProducts(t, store, "Desk", "Chair")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/products", func(c *gin.Context) {
+		getProducts(c, store)
+	})
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.GET("/products/trash", func(c *gin.Context) {
+		getDeletedProducts(c, store)
+	})
+	router.GET("/products/:id", func(c *gin.Context) {
+		getProduct(c, store)
+	})
+	router.DELETE("/products/:id", func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+	router.POST("/products/:id/restore", func(c *gin.Context) {
+		restoreProduct(c, store)
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		ifMatch    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"delete", "DELETE", "/products/1", "", "", http.StatusOK, ""},
+		{"deleted product is hidden", "GET", "/products/1", "", "", http.StatusNotFound, ""},
+		{"and hidden by name", "GET", "/products?name=Desk", "", "", http.StatusNotFound, ""},
+		{"and left out of listings", "GET", "/products", "", "", http.StatusOK, `"total":1`},
+		{"unless asked for", "GET", "/products/1?include_deleted=true", "", "", http.StatusOK, `"deleted_at":"`},
+		{"in listings too", "GET", "/products?include_deleted=1", "", "", http.StatusOK, `"total":2`},
+		{"invalid flag", "GET", "/products?include_deleted=maybe", "", "", http.StatusBadRequest, "include_deleted"},
+		{"trash lists deleted products only", "GET", "/products/trash", "", "", http.StatusOK, `"name":"Desk"`},
+		{"name is free again", "POST", "/products", `{"name":"Desk"}`, "", http.StatusCreated, `"id":3`},
+		{"restore onto a taken name", "POST", "/products/1/restore", "", "", http.StatusConflict, "/problems/product-conflict"},
+		{"delete the new one", "DELETE", "/products/3", "", "", http.StatusOK, ""},
+		{"stale restore", "POST", "/products/1/restore", "", `"1"`, http.StatusPreconditionFailed, ""},
+		{"restore", "POST", "/products/1/restore", "", `"2"`, http.StatusOK, `"version":3`},
+		{"restored product is back", "GET", "/products/1", "", "", http.StatusOK, `"name":"Desk"`},
+		{"live products cannot be restored", "POST", "/products/1/restore", "", "", http.StatusNotFound, "No deleted product"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("got status %v expected %v: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tc.wantBody) {
+				t.Errorf("expected body to contain %q, got %s", tc.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestProductHistory(t *testing.T) {
+	store := setupTestStore(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(requestContext())
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.PUT("/products/:id", func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	router.DELETE("/products/:id", func(c *gin.Context) {
+		deleteProduct(c, store)
+	})
+	router.GET("/products/:id/history", func(c *gin.Context) {
+		getProductHistory(c, store)
+	})
+
+	send := func(method, url, body, requestId string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requestId != "" {
+			req.Header.Set("X-Request-Id", requestId)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/products", `{"name":"Desk"}`, "create-1")
+	send("PUT", "/products/1", `{"name":"Standing desk"}`, "update 2 has spaces")
+	rr := send("DELETE", "/products/1", "", "")
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(rr.Header().Get("X-Request-Id")) {
+		t.Errorf("expected a generated request id, got %q", rr.Header().Get("X-Request-Id"))
+	}
+
+	rr = send("GET", "/products/1/history?limit=2", "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %v: %s", rr.Code, rr.Body.String())
+	}
+	var history ProductHistory
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Items) != 2 || history.Items[0].Action != auditDelete || history.Items[1].Action != auditUpdate {
+		t.Fatalf("unexpected first page %+v", history.Items)
+	}
+	if history.Items[0].Actor != anonymousActor || history.Items[1].RequestId == "update 2 has spaces" || history.Items[1].Before.Name != "Desk" {
+		t.Errorf("unexpected records %+v", history.Items)
+	}
+	if history.NextCursor == "" || !strings.Contains(rr.Header().Get("Link"), `rel="next"`) {
+		t.Fatalf("expected a next page, got cursor %q and Link %q", history.NextCursor, rr.Header().Get("Link"))
+	}
+
+	rr = send("GET", "/products/1/history?limit=2&cursor="+history.NextCursor, "", "")
+	history = ProductHistory{}
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Items) != 1 || history.Items[0].Action != auditCreate || history.Items[0].RequestId != "create-1" || history.NextCursor != "" {
+		t.Errorf("unexpected last page %+v", history)
+	}
+
+	if rr := send("GET", "/products/1/history?cursor=nonsense", "", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid cursor: got status %v expected 400", rr.Code)
+	}
+	if rr := send("GET", "/products/9/history", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown product: got status %v expected 404", rr.Code)
+	}
+}
+
+func TestProductRevisions(t *testing.T) {
+	store := setupTestStore(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/products", func(c *gin.Context) {
+		createProduct(c, store)
+	})
+	router.PUT("/products/:id", func(c *gin.Context) {
+		updateProduct(c, store)
+	})
+	router.GET("/products/:id/revisions", func(c *gin.Context) {
+		getProductRevisionAt(c, store)
+	})
+	router.GET("/products/:id/revisions/:revision", func(c *gin.Context) {
+		getProductRevision(c, store)
+	})
+	router.POST("/products/:id/revisions/:revision/revert", func(c *gin.Context) {
+		revertProduct(c, store)
+	})
+	router.GET("/products/:id/diff", func(c *gin.Context) {
+		diffProductRevisions(c, store)
+	})
+
+	send := func(method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %v: %s", rr.Code, rr.Body.String())
+		}
+		if err := json.NewDecoder(rr.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("POST", "/products", `{"name":"Desk","price":100,"currency":"USD"}`, nil)
+	between := time.Now().UTC().Format(time.RFC3339Nano)
+	send("PUT", "/products/1", `{"name":"Standing desk","price":250,"currency":"USD"}`, nil)
+
+	var product Product
+	decode(send("GET", "/products/1/revisions/1", "", nil), &product)
+	if product.Name != "Desk" || product.Version != 1 {
+		t.Errorf("revision 1: got %+v", product)
+	}
+
+	product = Product{}
+	decode(send("GET", "/products/1/revisions?at="+url.QueryEscape(between), "", nil), &product)
+	if product.Version != 1 {
+		t.Errorf("expected revision 1 at %s, got %+v", between, product)
+	}
+
+	var diff ProductDiff
+	decode(send("GET", "/products/1/diff?from=1", "", nil), &diff)
+	if diff.From != 1 || diff.To != 2 || len(diff.Changes) != 2 || diff.Changes[0].Field != "name" || diff.Changes[1].Field != "price" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	diff = ProductDiff{}
+	decode(send("GET", "/products/1/diff?from=2&to=2", "", nil), &diff)
+	if len(diff.Changes) != 0 {
+		t.Errorf("expected no changes, got %+v", diff)
+	}
+
+	rr := send("POST", "/products/1/revisions/1/revert", "", map[string]string{"If-Match": `"1"`})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale revert: got status %v expected 412", rr.Code)
+	}
+	rr = send("POST", "/products/1/revisions/1/revert", "", map[string]string{"If-Match": `"2"`})
+	product = Product{}
+	decode(rr, &product)
+	if product.Name != "Desk" || product.Price != 100 || product.Version != 3 || rr.Header().Get("ETag") != `"3"` {
+		t.Errorf("revert: got %+v with ETag %s", product, rr.Header().Get("ETag"))
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		method string
+		status int
+	}{
+		{"Revision zero", "/products/1/revisions/0", "GET", http.StatusBadRequest},
+		{"Unknown revision", "/products/1/revisions/9", "GET", http.StatusNotFound},
+		{"Unknown product", "/products/9/revisions/1", "GET", http.StatusNotFound},
+		{"Missing at", "/products/1/revisions", "GET", http.StatusBadRequest},
+		{"Before the product existed", "/products/1/revisions?at=2000-01-01", "GET", http.StatusNotFound},
+		{"Missing from", "/products/1/diff", "GET", http.StatusBadRequest},
+		{"Unknown to", "/products/1/diff?from=1&to=9", "GET", http.StatusNotFound},
+		{"Revert to unknown revision", "/products/1/revisions/9/revert", "POST", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if rr := send(tc.method, tc.url, "", nil); rr.Code != tc.status {
+				t.Errorf("got status %v expected %v: %s", rr.Code, tc.status, rr.Body.String())
+			}
+		})
+	}
+}
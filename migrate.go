@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migration is one versioned schema change, loaded from
+// migrations/<dialect>/<version>_<name>.(up|down).sql
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// migrationStatus describes a migration as seen from the database
+type migrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies and rolls back the embedded migrations for one dialect.
+// Applied versions are tracked in the schema_migrations table together with
+// a checksum of their up script, so edits to shipped migrations are caught.
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []migration
+}
+
+// NewMigrator loads the embedded migrations for the given dialect
+func NewMigrator(db *sql.DB, d dialect) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", d.Name()))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, direction, ok := cutDirection(fileName)
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", fileName)
+		}
+
+		versionPart, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionPart)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a positive version and an underscore", fileName)
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d: conflicting names %q and %q", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+			sum := sha256.Sum256(contents)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func cutDirection(fileName string) (base, direction string, ok bool) {
+	if base, ok := strings.CutSuffix(fileName, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok := strings.CutSuffix(fileName, ".down.sql"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// Up applies every pending migration in order and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]migration, error) {
+	applied, err := m.verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+
+		err := m.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, m.dialect.Rebind("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)"),
+				mig.Version, mig.Name, mig.Checksum, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d_%s up: %w", mig.Version, mig.Name, err)
+		}
+		ran = append(ran, mig)
+	}
+
+	return ran, nil
+}
+
+// Down rolls back up to steps of the most recently applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []migration
+	for i := len(m.migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return ran, fmt.Errorf("migration %d_%s has no down script", mig.Version, mig.Name)
+		}
+
+		err := m.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, m.dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), mig.Version)
+			return err
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d_%s down: %w", mig.Version, mig.Name, err)
+		}
+		ran = append(ran, mig)
+	}
+
+	return ran, nil
+}
+
+// Status lists every known migration and whether it has been applied
+func (m *Migrator) Status(ctx context.Context) ([]migrationStatus, error) {
+	applied, err := m.verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := migrationStatus{Version: mig.Version, Name: mig.Name}
+		if row, ok := applied[mig.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = row.appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// verify makes sure the tracking table exists and that every applied
+// migration still matches the embedded copy
+func (m *Migrator) verify(ctx context.Context) (map[int]appliedMigration, error) {
+	_, err := m.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var row appliedMigration
+		if err := rows.Scan(&version, &row.name, &row.checksum, &row.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	known := map[int]migration{}
+	for _, mig := range m.migrations {
+		known[mig.Version] = mig
+	}
+	for version, row := range applied {
+		mig, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("database has migration %d_%s applied, which this binary does not know about", version, row.name)
+		}
+		if mig.Checksum != row.checksum {
+			return nil, fmt.Errorf("migration %d_%s was modified after it was applied (checksum mismatch)", version, mig.Name)
+		}
+	}
+
+	return applied, nil
+}
+
+func (m *Migrator) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrateCommand implements `productapi migrate up|down [steps]|status`
+func runMigrateCommand(ctx context.Context, m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		ran, err := m.Up(ctx)
+		printMigrations(out, "applied", ran)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("down: steps must be a positive integer, got %q", args[1])
+			}
+			steps = n
+		}
+		ran, err := m.Down(ctx, steps)
+		printMigrations(out, "rolled back", ran)
+		return err
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range statuses {
+			state, appliedAt := "pending", "-"
+			if s.Applied {
+				state, appliedAt = "applied", s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
+
+func printMigrations(out io.Writer, verb string, migrations []migration) {
+	if len(migrations) == 0 {
+		fmt.Fprintf(out, "no migrations %s\n", verb)
+		return
+	}
+	for _, mig := range migrations {
+		fmt.Fprintf(out, "%s %04d_%s\n", verb, mig.Version, mig.Name)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func openEmptyTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open test db %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyTestDB(t)
+
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if len(applied) != len(migrator.migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrator.migrations), len(applied))
+	}
+
+	again, err := migrator.Up(ctx)
+	if err != nil || len(again) != 0 {
+		t.Errorf("second up should be a no-op, got %v, %v", again, err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.Applied {
+			t.Errorf("migration %d should be applied", s.Version)
+		}
+	}
+
+	if _, err := migrator.Down(ctx, len(migrator.migrations)); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if _, err := db.Exec("SELECT 1 FROM products"); err == nil {
+		t.Error("expected products table to be dropped after rolling back every migration")
+	}
+
+	statuses, err = migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.Applied {
+			t.Errorf("migration %d should be pending", s.Version)
+		}
+	}
+}
+
+func TestMigratorDetectsChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyTestDB(t)
+
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("UPDATE schema_migrations SET checksum = 'tampered' WHERE version = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.Up(ctx); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch error, got %v", err)
+	}
+}
+
+func TestLoadMigrationsRejectsBadNames(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing direction": {"m/0001_init.sql": {Data: []byte("SELECT 1")}},
+		"missing version":   {"m/init.up.sql": {Data: []byte("SELECT 1")}},
+		"missing up script": {"m/0001_init.down.sql": {Data: []byte("SELECT 1")}},
+	}
+
+	for name, fsys := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadMigrations(fsys, "m"); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	ctx := context.Background()
+	migrator, err := NewMigrator(openEmptyTestDB(t), sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runMigrateCommand(ctx, migrator, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "create_products") || !strings.Contains(out.String(), "pending") {
+		t.Errorf("unexpected status output:\n%s", out.String())
+	}
+
+	if err := runMigrateCommand(ctx, migrator, []string{"down", "zero"}, &out); err == nil {
+		t.Error("expected an error for a non-numeric step count")
+	}
+	if err := runMigrateCommand(ctx, migrator, []string{"sideways"}, &out); err == nil {
+		t.Error("expected an error for an unknown subcommand")
+	}
+}
+
+func TestMigrationBackfillsProductDetails(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyTestDB(t)
+
+	// a database file created before migrations existed
+	if _, err := db.Exec("CREATE TABLE products(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO products (name) VALUES ('Legacy')"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+
+	product, err := NewSQLiteStore(db).GetByName(ctx, "Legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.CreatedAt.Year() < 2000 || !product.UpdatedAt.Equal(product.CreatedAt) {
+		t.Errorf("expected existing rows to be stamped by the migration, got %+v", product)
+	}
+}
+
+func TestSoftDeleteMigrationKeepsIds(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyTestDB(t)
+
+	if _, err := db.Exec("CREATE TABLE products(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO products (name) VALUES ('Kept'), ('Removed'); DELETE FROM products WHERE name = 'Removed'"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+
+	store := NewSQLiteStore(db)
+	kept, err := store.GetByName(ctx, "Kept")
+	if err != nil || kept.Id != 1 {
+		t.Fatalf("expected the existing product to keep id 1, got %+v, %v", kept, err)
+	}
+	// the rebuilt table must not hand out the id of a row removed before it
+	created, err := store.Create(ctx, Product{Name: "Removed"})
+	if err != nil || created.Id != 3 {
+		t.Fatalf("expected the next id to be 3, got %+v, %v", created, err)
+	}
+
+	if err := store.Delete(ctx, created.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(ctx, Product{Name: "Removed"}); err != nil {
+		t.Fatalf("a deleted product's name should be free again: %v", err)
+	}
+
+	if _, err := migrator.Down(ctx, 1); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO products (name) VALUES ('Kept')"); err == nil {
+		t.Error("expected names to be unique again after rolling back")
+	}
+}
+
+func TestProductAuditIsAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	db := setupTestDB(t)
+	if _, err := NewSQLiteStore(db).Create(ctx, Product{Name: "Kettle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("UPDATE product_audit SET actor = 'someone else'"); err == nil {
+		t.Error("expected audit records to be immutable")
+	}
+	if _, err := db.Exec("DELETE FROM product_audit"); err == nil {
+		t.Error("expected audit records to be undeletable")
+	}
+}
+
+func TestAPIKeyRolesMigration(t *testing.T) {
+	ctx := context.Background()
+	db := setupTestDB(t)
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roll back to the scopes API keys had before roles
+	steps := 0
+	for _, mig := range migrator.migrations {
+		if mig.Version >= 8 {
+			steps++
+		}
+	}
+	if _, err := migrator.Down(ctx, steps); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO api_keys (name, key_hash, scopes, created_at) VALUES
+		('reader', 'a', 'read', CURRENT_TIMESTAMP), ('writer', 'b', 'read write', CURRENT_TIMESTAMP), ('admin', 'c', 'admin', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	keys, err := NewSQLiteStore(db).ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, key := range keys {
+		got = append(got, key.Name+":"+strings.Join(key.Roles, " "))
+	}
+	if want := "reader:viewer writer:editor admin:catalog-admin"; strings.Join(got, " ") != want {
+		t.Errorf("got %q expected %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestTenantMigration(t *testing.T) {
+	ctx := context.Background()
+	db := setupTestDB(t)
+	migrator, err := NewMigrator(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roll back to before products had tenants
+	steps := 0
+	for _, mig := range migrator.migrations {
+		if mig.Version >= 9 {
+			steps++
+		}
+	}
+	if _, err := migrator.Down(ctx, steps); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO products (name, sku) VALUES ('Legacy', 'LG-1')"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	store := NewSQLiteStore(db)
+	if _, err := store.GetByName(ctx, "Legacy"); err != nil {
+		t.Errorf("expected existing products to join the default tenant: %v", err)
+	}
+	if _, err := store.Create(withTenant(ctx, "acme"), Product{Name: "Legacy", Sku: "LG-1"}); err != nil {
+		t.Errorf("expected names and skus to be unique per tenant: %v", err)
+	}
+
+	// rolling back cannot merge catalogs that share a name
+	if _, err := migrator.Down(ctx, steps); err == nil {
+		t.Error("expected the rollback to fail while two tenants share a product name")
+	}
+}
@@ -0,0 +1,3 @@
+-- Databases created before migrations existed already have this table,
+-- so the baseline must stay idempotent.
+CREATE TABLE IF NOT EXISTS products(id SERIAL PRIMARY KEY, name TEXT UNIQUE);
@@ -0,0 +1,7 @@
+ALTER TABLE products
+    DROP COLUMN updated_at,
+    DROP COLUMN created_at,
+    DROP COLUMN sku,
+    DROP COLUMN currency,
+    DROP COLUMN price,
+    DROP COLUMN description;
@@ -0,0 +1,7 @@
+ALTER TABLE products
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN price BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN currency TEXT NOT NULL DEFAULT '',
+    ADD COLUMN sku TEXT CONSTRAINT products_sku_key UNIQUE,
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
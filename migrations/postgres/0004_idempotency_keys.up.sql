@@ -0,0 +1,13 @@
+-- Responses to requests sent with an Idempotency-Key. status is 0 while the
+-- first request is still being handled.
+CREATE TABLE idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status INTEGER NOT NULL DEFAULT 0,
+    headers TEXT NOT NULL DEFAULT '{}',
+    body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);
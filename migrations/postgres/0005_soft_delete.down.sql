@@ -0,0 +1,12 @@
+-- Deleted products are dropped for good, as they could otherwise break the
+-- restored unique constraints
+DELETE FROM products WHERE deleted_at IS NOT NULL;
+
+DROP INDEX products_deleted_at;
+DROP INDEX products_sku_key;
+DROP INDEX products_name_key;
+
+ALTER TABLE products
+    ADD CONSTRAINT products_name_key UNIQUE (name),
+    ADD CONSTRAINT products_sku_key UNIQUE (sku),
+    DROP COLUMN deleted_at;
@@ -0,0 +1,12 @@
+-- Deleted products keep their row until purged. Only live products need
+-- unique names and SKUs, so the unique constraints become partial indexes
+-- under the same names, which UniqueViolation maps back to the column.
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE products
+    DROP CONSTRAINT products_name_key,
+    DROP CONSTRAINT products_sku_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(sku) WHERE deleted_at IS NULL;
+CREATE INDEX products_deleted_at ON products(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE product_audit;
+DROP FUNCTION product_audit_append_only();
@@ -0,0 +1,24 @@
+-- Every change to a product, written in the same transaction as the change.
+-- Rows are never changed or removed, not even when their product is purged.
+CREATE TABLE product_audit (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    version BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    before_data JSONB,
+    after_data JSONB,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX product_audit_product_id ON product_audit(product_id, id);
+
+CREATE FUNCTION product_audit_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'product_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_audit_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON product_audit
+    FOR EACH STATEMENT EXECUTE FUNCTION product_audit_append_only();
@@ -0,0 +1,10 @@
+-- Keys clients authenticate with. Only a SHA-256 hash of each key is kept;
+-- the key itself is shown once, when it is created.
+CREATE TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
@@ -0,0 +1,9 @@
+-- API keys are given roles instead of scopes. Each key keeps the role
+-- closest to the broadest scope it had.
+ALTER TABLE api_keys RENAME COLUMN scopes TO roles;
+
+UPDATE api_keys SET roles = CASE
+    WHEN ' ' || roles || ' ' LIKE '% admin %' THEN 'catalog-admin'
+    WHEN ' ' || roles || ' ' LIKE '% write %' THEN 'editor'
+    ELSE 'viewer'
+END;
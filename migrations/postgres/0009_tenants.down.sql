@@ -0,0 +1,23 @@
+-- Rolling back fails while two tenants have live products with the same
+-- name or SKU; those have to be renamed or deleted first
+DELETE FROM idempotency_keys WHERE tenant_id <> 'default';
+
+ALTER TABLE idempotency_keys
+    DROP CONSTRAINT idempotency_keys_pkey,
+    ADD PRIMARY KEY (idempotency_key),
+    DROP COLUMN tenant_id;
+
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+
+DROP INDEX product_audit_product_id;
+CREATE INDEX product_audit_product_id ON product_audit(product_id, id);
+
+ALTER TABLE product_audit DROP COLUMN tenant_id;
+
+DROP INDEX products_sku_key;
+DROP INDEX products_name_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(sku) WHERE deleted_at IS NULL;
+
+ALTER TABLE products DROP COLUMN tenant_id;
@@ -0,0 +1,25 @@
+-- Every product belongs to one tenant's catalog, and names and SKUs only
+-- need to be unique within it. Existing rows join the default tenant. The
+-- indexes keep their names, which UniqueViolation maps back to the column.
+ALTER TABLE products ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX products_name_key;
+DROP INDEX products_sku_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(tenant_id, name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(tenant_id, sku) WHERE deleted_at IS NULL;
+
+ALTER TABLE product_audit ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX product_audit_product_id;
+CREATE INDEX product_audit_product_id ON product_audit(tenant_id, product_id, id);
+
+-- A key only ever acts on the catalog of the tenant it was issued for
+ALTER TABLE api_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+-- Two tenants may send the same Idempotency-Key
+ALTER TABLE idempotency_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+ALTER TABLE idempotency_keys
+    DROP CONSTRAINT idempotency_keys_pkey,
+    ADD PRIMARY KEY (tenant_id, idempotency_key);
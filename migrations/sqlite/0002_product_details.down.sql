@@ -0,0 +1,13 @@
+-- The search index triggers reference the new columns and would block
+-- DROP COLUMN; the server recreates them on start.
+DROP TRIGGER IF EXISTS products_fts_insert;
+DROP TRIGGER IF EXISTS products_fts_delete;
+DROP TRIGGER IF EXISTS products_fts_update;
+
+DROP INDEX products_sku_key;
+ALTER TABLE products DROP COLUMN updated_at;
+ALTER TABLE products DROP COLUMN created_at;
+ALTER TABLE products DROP COLUMN sku;
+ALTER TABLE products DROP COLUMN currency;
+ALTER TABLE products DROP COLUMN price;
+ALTER TABLE products DROP COLUMN description;
@@ -0,0 +1,14 @@
+-- SQLite only accepts constant defaults in ADD COLUMN, so existing rows are
+-- stamped with the migration time afterwards. Timestamps use the fixed width
+-- layout of sqliteTimeLayout so they compare correctly as text.
+ALTER TABLE products ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN price INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN sku TEXT;
+ALTER TABLE products ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00.000000';
+ALTER TABLE products ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00.000000';
+
+UPDATE products SET created_at = strftime('%Y-%m-%d %H:%M:%f000', 'now');
+UPDATE products SET updated_at = created_at;
+
+CREATE UNIQUE INDEX products_sku_key ON products(sku);
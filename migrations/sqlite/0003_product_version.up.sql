@@ -0,0 +1,2 @@
+-- version is bumped on every write and served as the product's ETag
+ALTER TABLE products ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
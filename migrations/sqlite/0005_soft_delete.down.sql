@@ -0,0 +1,12 @@
+-- Deleted products are dropped for good, as they could otherwise break the
+-- restored unique indexes
+DELETE FROM products WHERE deleted_at IS NOT NULL;
+
+DROP INDEX products_deleted_at;
+DROP INDEX products_sku_key;
+DROP INDEX products_name_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(name);
+CREATE UNIQUE INDEX products_sku_key ON products(sku);
+
+ALTER TABLE products DROP COLUMN deleted_at;
@@ -0,0 +1,30 @@
+-- Deleted products keep their row until purged. Only live products need
+-- unique names and SKUs, but the UNIQUE on name from the original table
+-- cannot be dropped, so the table is rebuilt with partial unique indexes
+-- instead. Ids and the AUTOINCREMENT counter carry over; the search index
+-- triggers go with the old table and are recreated by the server on start.
+CREATE TABLE products_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT,
+    description TEXT NOT NULL DEFAULT '',
+    price INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT '',
+    sku TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00.000000',
+    updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00.000000',
+    version INTEGER NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP
+);
+
+INSERT INTO products_new (id, name, description, price, currency, sku, created_at, updated_at, version)
+SELECT id, name, description, price, currency, sku, created_at, updated_at, version FROM products;
+
+UPDATE sqlite_sequence SET seq = (SELECT seq FROM sqlite_sequence WHERE name = 'products')
+WHERE name = 'products_new' AND EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'products');
+
+DROP TABLE products;
+ALTER TABLE products_new RENAME TO products;
+
+CREATE UNIQUE INDEX products_name_key ON products(name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(sku) WHERE deleted_at IS NULL;
+CREATE INDEX products_deleted_at ON products(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,23 @@
+-- Every change to a product, written in the same transaction as the change.
+-- Rows are never changed or removed, not even when their product is purged.
+CREATE TABLE product_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    product_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    before_data TEXT,
+    after_data TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX product_audit_product_id ON product_audit(product_id, id);
+
+CREATE TRIGGER product_audit_no_update BEFORE UPDATE ON product_audit BEGIN
+    SELECT RAISE(ABORT, 'product_audit is append-only');
+END;
+
+CREATE TRIGGER product_audit_no_delete BEFORE DELETE ON product_audit BEGIN
+    SELECT RAISE(ABORT, 'product_audit is append-only');
+END;
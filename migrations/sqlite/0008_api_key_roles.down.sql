@@ -0,0 +1,7 @@
+UPDATE api_keys SET roles = CASE
+    WHEN ' ' || roles || ' ' LIKE '% catalog-admin %' THEN 'admin'
+    WHEN ' ' || roles || ' ' LIKE '% editor %' THEN 'write'
+    ELSE 'read'
+END;
+
+ALTER TABLE api_keys RENAME COLUMN roles TO scopes;
@@ -0,0 +1,35 @@
+-- Rolling back fails while two tenants have live products with the same
+-- name or SKU; those have to be renamed or deleted first
+CREATE TABLE idempotency_keys_old (
+    idempotency_key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status INTEGER NOT NULL DEFAULT 0,
+    headers TEXT NOT NULL DEFAULT '{}',
+    body BLOB,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO idempotency_keys_old (idempotency_key, request_hash, status, headers, body, created_at, expires_at)
+SELECT idempotency_key, request_hash, status, headers, body, created_at, expires_at FROM idempotency_keys
+WHERE tenant_id = 'default';
+
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_old RENAME TO idempotency_keys;
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+
+DROP INDEX product_audit_product_id;
+CREATE INDEX product_audit_product_id ON product_audit(product_id, id);
+
+ALTER TABLE product_audit DROP COLUMN tenant_id;
+
+DROP INDEX products_sku_key;
+DROP INDEX products_name_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(sku) WHERE deleted_at IS NULL;
+
+ALTER TABLE products DROP COLUMN tenant_id;
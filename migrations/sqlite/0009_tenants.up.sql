@@ -0,0 +1,39 @@
+-- Every product belongs to one tenant's catalog, and names and SKUs only
+-- need to be unique within it. Existing rows join the default tenant.
+ALTER TABLE products ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX products_name_key;
+DROP INDEX products_sku_key;
+
+CREATE UNIQUE INDEX products_name_key ON products(tenant_id, name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX products_sku_key ON products(tenant_id, sku) WHERE deleted_at IS NULL;
+
+ALTER TABLE product_audit ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX product_audit_product_id;
+CREATE INDEX product_audit_product_id ON product_audit(tenant_id, product_id, id);
+
+-- A key only ever acts on the catalog of the tenant it was issued for
+ALTER TABLE api_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+-- Two tenants may send the same Idempotency-Key. The primary key cannot be
+-- altered in place, so the table is rebuilt.
+CREATE TABLE idempotency_keys_new (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    idempotency_key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status INTEGER NOT NULL DEFAULT 0,
+    headers TEXT NOT NULL DEFAULT '{}',
+    body BLOB,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (tenant_id, idempotency_key)
+);
+
+INSERT INTO idempotency_keys_new (idempotency_key, request_hash, status, headers, body, created_at, expires_at)
+SELECT idempotency_key, request_hash, status, headers, body, created_at, expires_at FROM idempotency_keys;
+
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_new RENAME TO idempotency_keys;
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);
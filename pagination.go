@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ProductList is the paginated response of GET /products
+type ProductList struct {
+	Items      []Product `json:"items"`                 //	@Description	The products on this page
+	NextCursor string    `json:"next_cursor,omitempty"` //	@Description	Opaque cursor for the next page, absent on the last page
+	Total      int       `json:"total"`                 //	@Description	The number of products across all pages
+}
+
+// pageCursor is the decoded form of the opaque cursor handed to clients.
+// It carries the sort it was issued for so it cannot be replayed against
+// a different ordering.
+type pageCursor struct {
+	Sort  string            `json:"sort"`
+	After []json.RawMessage `json:"after"`
+}
+
+func encodeCursor(keys []SortKey, values []any) string {
+	cursor := pageCursor{Sort: sortString(keys)}
+	for _, value := range values {
+		raw, _ := json.Marshal(value)
+		cursor.After = append(cursor.After, raw)
+	}
+
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string, keys []SortKey) ([]any, error) {
+	invalid := errors.New("Invalid cursor")
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil || len(cursor.After) != len(keys) {
+		return nil, invalid
+	}
+	if cursor.Sort != sortString(keys) {
+		return nil, errors.New("cursor was issued for a different sort order")
+	}
+
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		value, err := unmarshalFieldValue(productFields[key.Field], cursor.After[i])
+		if err != nil {
+			return nil, invalid
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// parseListOptions reads filters, sort, limit, offset and cursor from the
+// query string. Limits above maxPageSize are clamped rather than rejected.
+func parseListOptions(c *gin.Context) (ListOptions, error) {
+	var opts ListOptions
+
+	if err := parseFilters(c, &opts); err != nil {
+		return opts, err
+	}
+
+	limit, offset, err := parseLimitOffset(c)
+	if err != nil {
+		return opts, err
+	}
+	opts.Limit, opts.Offset = limit, offset
+
+	if raw := c.Query("cursor"); raw != "" {
+		if opts.Offset > 0 {
+			return opts, errors.New("cursor and offset cannot be combined")
+		}
+		after, err := decodeCursor(raw, sortKeys(opts))
+		if err != nil {
+			return opts, err
+		}
+		opts.After = after
+	}
+
+	return opts, nil
+}
+
+// parseLimitOffset reads the limit and offset query parameters
+func parseLimitOffset(c *gin.Context) (limit, offset int, err error) {
+	limit = defaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer, got '%s'", raw)
+		}
+		limit = min(limit, maxPageSize)
+	}
+
+	if raw := c.Query("offset"); raw != "" {
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer, got '%s'", raw)
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// newProductList wraps a page in the response envelope and sets the Link header
+func newProductList(c *gin.Context, page ProductPage, opts ListOptions) ProductList {
+	list := ProductList{Items: page.Items, Total: page.Total}
+
+	var links []string
+	if page.HasMore && len(page.Items) > 0 {
+		keys := sortKeys(opts)
+		list.NextCursor = encodeCursor(keys, keyValues(page.Items[len(page.Items)-1], keys))
+		links = append(links, pageLink(c, "next", map[string]string{"cursor": list.NextCursor}))
+	}
+	if len(opts.After) == 0 && opts.Offset > 0 {
+		prev := strconv.Itoa(max(opts.Offset-opts.Limit, 0))
+		links = append(links, pageLink(c, "prev", map[string]string{"offset": prev}))
+	}
+	if len(opts.After) > 0 || opts.Offset > 0 {
+		links = append(links, pageLink(c, "first", nil))
+	}
+
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+	return list
+}
+
+// pageLink renders one RFC 8288 link to the current URL with the paging
+// parameters replaced by set
+func pageLink(c *gin.Context, rel string, set map[string]string) string {
+	query := c.Request.URL.Query()
+	query.Del("cursor")
+	query.Del("offset")
+	for key, value := range set {
+		query.Set(key, value)
+	}
+
+	u := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// Patch media types accepted by PATCH /products/{id}, advertised in the
+// Accept-Patch header
+const (
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+var acceptPatch = mediaTypeMergePatch + ", " + mediaTypeJSONPatch
+
+// patchError carries the problem a patch failed with out of the store's
+// transaction, which it rolls back
+type patchError struct {
+	problem *Problem
+}
+
+func (e *patchError) Error() string {
+	return e.problem.Detail
+}
+
+func newPatchError(status int, problemType, detail string) *patchError {
+	return &patchError{problem: newProblem(status, problemType, detail)}
+}
+
+// productPatch is a parsed PATCH body that can be applied to a product
+type productPatch struct {
+	mediaType string
+	merge     []byte
+	ops       jsonpatch.Patch
+}
+
+// parseProductPatch checks a PATCH body against its media type. Problems with
+// the document itself are found here, before any row is locked.
+func parseProductPatch(mediaType string, body []byte) (*productPatch, error) {
+	patch := &productPatch{mediaType: mediaType}
+
+	switch mediaType {
+	case mediaTypeMergePatch:
+		if !json.Valid(body) {
+			return nil, newPatchError(http.StatusBadRequest, problemInvalidPatch, "Merge patch is not valid JSON")
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			return nil, newPatchError(http.StatusBadRequest, problemInvalidPatch, "Merge patch must be a JSON object")
+		}
+		patch.merge = body
+	case mediaTypeJSONPatch:
+		ops, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, newPatchError(http.StatusBadRequest, problemInvalidPatch, "JSON Patch must be an array of operations")
+		}
+		for i, op := range ops {
+			if _, err := op.Path(); err != nil {
+				return nil, newPatchError(http.StatusBadRequest, problemInvalidPatch, fmt.Sprintf("Operation %d has no path", i))
+			}
+			switch op.Kind() {
+			case "add", "remove", "replace", "move", "copy", "test":
+			default:
+				return nil, newPatchError(http.StatusBadRequest, problemInvalidPatch, fmt.Sprintf("Operation %d has unknown op '%s'", i, op.Kind()))
+			}
+		}
+		patch.ops = ops
+	default:
+		return nil, newPatchError(http.StatusUnsupportedMediaType, problemUnsupportedMedia, "PATCH bodies must be "+strings.Replace(acceptPatch, ", ", " or ", 1))
+	}
+
+	return patch, nil
+}
+
+// Apply returns current with the patch applied and revalidated. A patch
+// that changes a read-only field is rejected; one that leaves them as they
+// are, say with a test operation, is fine.
+func (p *productPatch) Apply(current Product) (Product, error) {
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if p.mediaType == mediaTypeMergePatch {
+		doc, err = jsonpatch.MergePatch(doc, p.merge)
+	} else {
+		doc, err = p.ops.Apply(doc)
+	}
+	if err != nil {
+		return Product{}, newPatchError(http.StatusUnprocessableEntity, problemPatchFailed, err.Error())
+	}
+
+	var patched Product
+	if err := decodeStrictJSON(bytes.NewReader(doc), &patched); err != nil {
+		problem := jsonProblem(err, 0)
+		problem.Type, problem.Title, problem.Status = "/problems/"+problemPatchFailed, problemTitles[problemPatchFailed], http.StatusUnprocessableEntity
+		problem.Detail = "The patched product is not a valid product document"
+		return Product{}, &patchError{problem: problem}
+	}
+
+	if problem := readOnlyProblem(current, patched); problem != nil {
+		return Product{}, &patchError{problem: problem}
+	}
+
+	if err := validate.Struct(patched); err != nil {
+		if problem := validationProblem(err); problem != nil {
+			return Product{}, &patchError{problem: problem}
+		}
+		return Product{}, err
+	}
+	return patched, nil
+}
+
+// readOnlyProblem describes the read-only fields patched changes from
+// current, or returns nil if it changes none
+func readOnlyProblem(current, patched Product) *Problem {
+	p := newProblem(http.StatusUnprocessableEntity, problemPatchFailed, "The patch changes read-only fields")
+	for _, f := range []struct {
+		field   string
+		changed bool
+	}{
+		{"id", patched.Id != current.Id},
+		{"created_at", !patched.CreatedAt.Equal(current.CreatedAt)},
+		{"updated_at", !patched.UpdatedAt.Equal(current.UpdatedAt)},
+		{"version", patched.Version != current.Version},
+		{"deleted_at", (patched.DeletedAt == nil) != (current.DeletedAt == nil)},
+	} {
+		if f.changed {
+			p.Errors = append(p.Errors, FieldError{Field: f.field, Code: "read_only", Message: "cannot be patched"})
+		}
+	}
+	if len(p.Errors) == 0 {
+		return nil
+	}
+	return p
+}
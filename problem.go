@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Problem types are stable identifiers clients can branch on. They are
+// relative URIs, rendered as /problems/<type>.
+const (
+	problemInvalidBody           = "invalid-body"
+	problemBodyTooLarge          = "body-too-large"
+	problemInvalidId             = "invalid-id"
+	problemInvalidPatch          = "invalid-patch"
+	problemPatchFailed           = "patch-failed"
+	problemUnsupportedMedia      = "unsupported-media-type"
+	problemInvalidPrecondition   = "invalid-precondition"
+	problemPreconditionFailed    = "precondition-failed"
+	problemPreconditionRequired  = "precondition-required"
+	problemInvalidIdempotencyKey = "invalid-idempotency-key"
+	problemIdempotencyKeyReused  = "idempotency-key-reused"
+	problemIdempotencyKeyInUse   = "idempotency-key-in-use"
+	problemBatchFailed           = "batch-failed"
+	problemValidation            = "validation-failed"
+	problemInvalidQuery          = "invalid-query"
+	problemInvalidTenant         = "invalid-tenant"
+	problemUnauthorized          = "unauthorized"
+	problemForbidden             = "forbidden"
+	problemCORSRejected          = "cors-rejected"
+	problemNotFound              = "not-found"
+	problemMethodNotAllowed      = "method-not-allowed"
+	problemProductNotFound       = "product-not-found"
+	problemProductConflict       = "product-conflict"
+	problemRateLimited           = "rate-limited"
+	problemSearchUnavailable     = "search-unavailable"
+	problemInternal              = "internal-error"
+)
+
+var problemTitles = map[string]string{
+	problemInvalidBody:           "Malformed request body",
+	problemBodyTooLarge:          "Request body too large",
+	problemInvalidId:             "Invalid product id",
+	problemInvalidPatch:          "Malformed patch document",
+	problemPatchFailed:           "Patch could not be applied",
+	problemUnsupportedMedia:      "Unsupported media type",
+	problemInvalidPrecondition:   "Invalid precondition header",
+	problemPreconditionFailed:    "Precondition failed",
+	problemPreconditionRequired:  "Precondition required",
+	problemInvalidIdempotencyKey: "Invalid idempotency key",
+	problemIdempotencyKeyReused:  "Idempotency key reused",
+	problemIdempotencyKeyInUse:   "Idempotency key in use",
+	problemBatchFailed:           "Batch failed",
+	problemValidation:            "Validation failed",
+	problemInvalidQuery:          "Invalid query parameter",
+	problemInvalidTenant:         "Invalid tenant",
+	problemUnauthorized:          "Authentication required",
+	problemForbidden:             "Insufficient permissions",
+	problemCORSRejected:          "Cross-origin request refused",
+	problemNotFound:              "Resource not found",
+	problemMethodNotAllowed:      "Method not allowed",
+	problemProductNotFound:       "Product not found",
+	problemProductConflict:       "Product already exists",
+	problemRateLimited:           "Too many requests",
+	problemSearchUnavailable:     "Search unavailable",
+	problemInternal:              "Internal server error",
+}
+
+// Problem is an RFC 7807 problem details object, served as application/problem+json
+type Problem struct {
+	Type     string       `json:"type" example:"/problems/validation-failed"` //	@Description	Stable URI reference identifying the kind of problem
+	Title    string       `json:"title" example:"Validation failed"`          //	@Description	Short summary of the problem type
+	Status   int          `json:"status" example:"400"`                       //	@Description	The HTTP status code
+	Detail   string       `json:"detail,omitempty"`                           //	@Description	Explanation specific to this occurrence
+	Instance string       `json:"instance,omitempty" example:"/products"`     //	@Description	The request path the problem occurred on
+	Errors   []FieldError `json:"errors,omitempty"`                           //	@Description	Per-field problems, for validation failures
+}
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field" example:"currency"`                            //	@Description	JSON name of the offending field
+	Code    string `json:"code" example:"iso4217"`                              //	@Description	Machine-readable rule that failed
+	Message string `json:"message" example:"must be an ISO 4217 currency code"` //	@Description	Human-readable explanation
+}
+
+func newProblem(status int, problemType, detail string) *Problem {
+	return &Problem{
+		Type:   "/problems/" + problemType,
+		Title:  problemTitles[problemType],
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// writeProblem renders p as application/problem+json and aborts the chain
+func writeProblem(c *gin.Context, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = c.Request.URL.Path
+	}
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+func badRequest(c *gin.Context, problemType, detail string) {
+	writeProblem(c, newProblem(http.StatusBadRequest, problemType, detail))
+}
+
+func productNotFound(c *gin.Context, detail string) {
+	writeProblem(c, newProblem(http.StatusNotFound, problemProductNotFound, detail))
+}
+
+// unauthorized expects the caller to have set WWW-Authenticate
+func unauthorized(c *gin.Context, detail string) {
+	writeProblem(c, newProblem(http.StatusUnauthorized, problemUnauthorized, detail))
+}
+
+func forbidden(c *gin.Context, detail string) {
+	writeProblem(c, newProblem(http.StatusForbidden, problemForbidden, detail))
+}
+
+func conflict(c *gin.Context, err error) {
+	writeProblem(c, conflictProblem(err))
+}
+
+// conflictProblem describes a unique constraint violation reported by the store
+func conflictProblem(err error) *Problem {
+	field := conflictField(err)
+	p := newProblem(http.StatusConflict, problemProductConflict, fmt.Sprintf("A product with this %s already exists", field))
+	p.Errors = []FieldError{{Field: field, Code: "unique", Message: "is already used by another product"}}
+	return p
+}
+
+// internalError hides the cause from the client; gin's logger records it
+func internalError(c *gin.Context, detail string, err error) {
+	c.Error(err)
+	writeProblem(c, newProblem(http.StatusInternalServerError, problemInternal, detail))
+}
+
+// validationFailed renders the result of validate.Struct
+func validationFailed(c *gin.Context, err error) {
+	p := validationProblem(err)
+	if p == nil {
+		internalError(c, "Unable to validate the request", err)
+		return
+	}
+	writeProblem(c, p)
+}
+
+// validationProblem describes validator.ValidationErrors, or returns nil
+// for any other error
+func validationProblem(err error) *Problem {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return nil
+	}
+
+	p := newProblem(http.StatusBadRequest, problemValidation, "One or more fields are invalid")
+	for _, fieldErr := range validationErrors {
+		p.Errors = append(p.Errors, FieldError{
+			Field:   fieldErr.Field(),
+			Code:    fieldErr.Tag(),
+			Message: validationMessage(fieldErr),
+		})
+	}
+	return p
+}
+
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "required_with":
+		return fmt.Sprintf("is required when %s is set", strings.ToLower(fieldErr.Param()))
+	case "max":
+		return fmt.Sprintf("must be at most %s characters long", fieldErr.Param())
+	case "gte":
+		return fmt.Sprintf("must be greater than or equal to %s", fieldErr.Param())
+	case "iso4217":
+		return "must be an ISO 4217 currency code"
+	case "sku":
+		return "may only contain letters, digits, '.', '_' and '-', starting with a letter or digit"
+	}
+	return fmt.Sprintf("failed the '%s' rule", fieldErr.Tag())
+}
+
+// jsonFieldName makes validator report fields by their JSON name
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fieldKind decides which operators a filterable field accepts and how its
+// query string values are parsed
+type fieldKind int
+
+const (
+	kindInt fieldKind = iota
+	kindText
+	kindTime
+)
+
+// productField whitelists a Product field for filtering and sorting
+type productField struct {
+	// Column is the SQL column the field is stored in
+	Column string
+	Kind   fieldKind
+	// Value reads the field from a product for in-memory filtering and cursors
+	Value func(Product) any
+}
+
+var productFields = map[string]productField{
+	"id":          {Column: "id", Kind: kindInt, Value: func(p Product) any { return p.Id }},
+	"name":        {Column: "name", Kind: kindText, Value: func(p Product) any { return p.Name }},
+	"description": {Column: "description", Kind: kindText, Value: func(p Product) any { return p.Description }},
+	"price":       {Column: "price", Kind: kindInt, Value: func(p Product) any { return int(p.Price) }},
+	"currency":    {Column: "currency", Kind: kindText, Value: func(p Product) any { return p.Currency }},
+	"sku":         {Column: "COALESCE(sku, '')", Kind: kindText, Value: func(p Product) any { return p.Sku }},
+	"created_at":  {Column: "created_at", Kind: kindTime, Value: func(p Product) any { return p.CreatedAt }},
+	"updated_at":  {Column: "updated_at", Kind: kindTime, Value: func(p Product) any { return p.UpdatedAt }},
+}
+
+var operatorsByKind = map[fieldKind][]string{
+	kindInt:  {"eq", "ne", "gt", "gte", "lt", "lte", "in"},
+	kindText: {"eq", "ne", "contains", "prefix", "in"},
+	kindTime: {"gt", "gte", "lt", "lte"},
+}
+
+// Filter is one whitelisted field comparison. Value holds a []any for "in".
+// Text "contains" and "prefix" comparisons ignore case; "eq" is exact.
+type Filter struct {
+	Field string
+	Op    string
+	Value any
+}
+
+// SortKey orders a listing by one whitelisted field
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+var filterParam = regexp.MustCompile(`^([a-z_]+)\[([a-z]+)\]$`)
+
+// parseFilters reads q, sort and field[op]=value parameters into opts.
+// Any bracketed parameter naming an unknown field or operator is rejected.
+func parseFilters(c *gin.Context, opts *ListOptions) error {
+	query := c.Request.URL.Query()
+
+	if q := query.Get("q"); q != "" {
+		opts.Filters = append(opts.Filters, Filter{Field: "name", Op: "contains", Value: q})
+	}
+
+	// map iteration is random; sort so the compiled SQL is stable
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		match := filterParam.FindStringSubmatch(param)
+		if match == nil {
+			continue
+		}
+
+		fieldName, op := match[1], match[2]
+		field, ok := productFields[fieldName]
+		if !ok {
+			return fmt.Errorf("cannot filter on unknown field '%s'", fieldName)
+		}
+		if !hasOperator(field.Kind, op) {
+			return fmt.Errorf("operator '%s' is not supported for field '%s'", op, fieldName)
+		}
+
+		for _, raw := range query[param] {
+			value, err := parseFilterValue(field, op, raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", param, err)
+			}
+			opts.Filters = append(opts.Filters, Filter{Field: fieldName, Op: op, Value: value})
+		}
+	}
+
+	keys, err := parseSort(query.Get("sort"))
+	if err != nil {
+		return err
+	}
+	opts.Sort = keys
+
+	return parseDeletedScope(c, opts)
+}
+
+// parseDeletedScope reads the include_deleted flag
+func parseDeletedScope(c *gin.Context, opts *ListOptions) error {
+	raw := c.Query("include_deleted")
+	if raw == "" {
+		return nil
+	}
+	include, err := strconv.ParseBool(raw)
+	if err != nil {
+		return fmt.Errorf("include_deleted must be true or false, got '%s'", raw)
+	}
+	if include {
+		opts.Deleted = includeDeleted
+	}
+	return nil
+}
+
+func hasOperator(kind fieldKind, op string) bool {
+	for _, allowed := range operatorsByKind[kind] {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFilterValue(field productField, op, raw string) (any, error) {
+	if op != "in" {
+		return parseFieldValue(field, raw)
+	}
+
+	var values []any
+	for _, part := range strings.Split(raw, ",") {
+		value, err := parseFieldValue(field, part)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func parseFieldValue(field productField, raw string) (any, error) {
+	switch field.Kind {
+	case kindInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an integer", raw)
+		}
+		return n, nil
+	case kindTime:
+		return parseTimestamp(raw)
+	default:
+		return raw, nil
+	}
+}
+
+// parseTimestamp reads an RFC 3339 timestamp or a bare date, which means
+// midnight UTC at the start of that day
+func parseTimestamp(raw string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not an RFC 3339 timestamp or a YYYY-MM-DD date", raw)
+}
+
+// unmarshalFieldValue decodes a JSON encoded value of the field's kind
+func unmarshalFieldValue(field productField, raw json.RawMessage) (any, error) {
+	switch field.Kind {
+	case kindInt:
+		var n int
+		err := json.Unmarshal(raw, &n)
+		return n, err
+	case kindTime:
+		var t time.Time
+		err := json.Unmarshal(raw, &t)
+		return t.UTC(), err
+	default:
+		var text string
+		err := json.Unmarshal(raw, &text)
+		return text, err
+	}
+}
+
+// parseSort reads a comma separated list of fields, each optionally
+// prefixed with - for descending order, e.g. "-name,id"
+func parseSort(raw string) ([]SortKey, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		key := SortKey{Field: strings.TrimSpace(part)}
+		if rest, ok := strings.CutPrefix(key.Field, "-"); ok {
+			key.Field, key.Desc = rest, true
+		}
+		if _, ok := productFields[key.Field]; !ok {
+			return nil, fmt.Errorf("cannot sort on unknown field '%s'", key.Field)
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("field '%s' appears more than once in sort", key.Field)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortKeys returns the effective ordering of a listing: the requested keys
+// followed by id as a tiebreaker, so keyset cursors are unambiguous
+func sortKeys(opts ListOptions) []SortKey {
+	keys := append([]SortKey(nil), opts.Sort...)
+	for _, key := range keys {
+		if key.Field == "id" {
+			return keys
+		}
+	}
+	return append(keys, SortKey{Field: "id"})
+}
+
+// sortString is the canonical form of a sort, used to tie cursors to it
+func sortString(keys []SortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key.Field
+		if key.Desc {
+			parts[i] = "-" + key.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// compareValues orders two values of the same field kind
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	panic(fmt.Sprintf("compareValues: unsupported type %T", a))
+}
+
+// buildMatchQuery turns a search box query into a safe FTS5 MATCH expression.
+// Bare words and "quoted phrases" are ANDed together, and a trailing * makes
+// either a prefix query. Every term is quoted, so FTS5 operators and column
+// filters typed by the user are matched literally instead of interpreted.
+func buildMatchQuery(input string) (string, error) {
+	var terms []string
+	rest := strings.TrimSpace(input)
+
+	for rest != "" {
+		var term string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				term, rest = rest[1:], ""
+			} else {
+				term, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(rest, " \t\"")
+			if end < 0 {
+				end = len(rest)
+			}
+			term, rest = rest[:end], rest[end:]
+		}
+
+		prefix := false
+		if strings.HasPrefix(rest, "*") {
+			prefix, rest = true, rest[1:]
+		}
+		if trimmed, ok := strings.CutSuffix(term, "*"); ok {
+			prefix, term = true, trimmed
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		quoted := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			quoted += "*"
+		}
+		terms = append(terms, quoted)
+	}
+
+	if len(terms) == 0 {
+		return "", errors.New("search query must contain at least one word")
+	}
+	return strings.Join(terms, " "), nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route groups with a rate limit of their own
+const (
+	rateGroupRead  = "read"
+	rateGroupWrite = "write"
+	rateGroupBulk  = "bulk"
+	// rateGroupAuth counts the requests of each client IP whose credentials
+	// were refused
+	rateGroupAuth = "auth"
+)
+
+// defaultRateLimits apply unless RATE_LIMIT_<GROUP> says otherwise
+var defaultRateLimits = map[string]RateLimit{
+	rateGroupRead:  {Requests: 600, Per: time.Minute},
+	rateGroupWrite: {Requests: 120, Per: time.Minute},
+	rateGroupBulk:  {Requests: 10, Per: time.Minute},
+	rateGroupAuth:  {Requests: 20, Per: time.Minute},
+}
+
+// RateLimit is a token bucket holding Requests tokens, refilled at an even
+// pace so that an empty bucket is full again after Per. The zero value
+// means no limit.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// String formats l the way parseRateLimit reads it
+func (l RateLimit) String() string {
+	if !l.enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, formatDuration(l.Per))
+}
+
+// rate is how many tokens are added per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// parseRateLimit reads a limit such as 60/1m, or off
+func parseRateLimit(raw string) (RateLimit, error) {
+	if raw == "off" || raw == "0" {
+		return RateLimit{}, nil
+	}
+	count, per, ok := strings.Cut(raw, "/")
+	requests, err := strconv.Atoi(count)
+	if !ok || err != nil || requests < 1 {
+		return RateLimit{}, fmt.Errorf("%q is not a rate limit such as 60/1m", raw)
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return RateLimit{}, fmt.Errorf("%q is not a rate limit such as 60/1m", raw)
+	}
+	return RateLimit{Requests: requests, Per: window}, nil
+}
+
+// RateDecision is the outcome of taking a token
+type RateDecision struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket
+	Remaining int
+	// RetryAfter is how long until the next token, when none was left
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimiter keeps the token buckets. MemoryRateLimiter is enough for a
+// single server; replicas that should share their limits need one backed by
+// a shared store instead.
+type RateLimiter interface {
+	// Take removes a token from the bucket named key, which limit describes,
+	// and reports whether there was one to take
+	Take(ctx context.Context, key string, limit RateLimit) (RateDecision, error)
+	// Peek reports whether Take would find a token, without taking it
+	Peek(ctx context.Context, key string, limit RateLimit) (RateDecision, error)
+}
+
+// MemoryRateLimiter is a RateLimiter kept in process memory
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// now is the clock, swapped out by tests
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, and can be forgotten
+	full time.Time
+}
+
+// rateLimitSweepInterval is how often buckets that have refilled are dropped
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimiter returns a MemoryRateLimiter with every bucket full
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*tokenBucket{}, now: now}
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := l.now()
+	if t.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(t)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		// a bucket nobody has taken from for a while is as good as full
+		b = &tokenBucket{tokens: float64(limit.Requests), updated: t}
+		l.buckets[key] = b
+	}
+	b.tokens = b.refilled(t, limit)
+	b.updated = t
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	decision := decide(allowed, b.tokens, limit)
+	b.full = t.Add(decision.Reset)
+	return decision, nil
+}
+
+func (l *MemoryRateLimiter) Peek(ctx context.Context, key string, limit RateLimit) (RateDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := float64(limit.Requests)
+	if b, ok := l.buckets[key]; ok {
+		tokens = b.refilled(l.now(), limit)
+	}
+	return decide(tokens >= 1, tokens, limit), nil
+}
+
+// refilled is the number of tokens in the bucket at t
+func (b *tokenBucket) refilled(t time.Time, limit RateLimit) float64 {
+	return math.Min(float64(limit.Requests), b.tokens+t.Sub(b.updated).Seconds()*limit.rate())
+}
+
+// decide describes a bucket left holding tokens
+func decide(allowed bool, tokens float64, limit RateLimit) RateDecision {
+	rate := limit.rate()
+	decision := RateDecision{Allowed: allowed, Remaining: int(tokens)}
+	if !allowed {
+		decision.RetryAfter = secondsDuration((1 - tokens) / rate)
+	}
+	decision.Reset = secondsDuration((float64(limit.Requests) - tokens) / rate)
+	return decision
+}
+
+// sweep must be called with the lock held
+func (l *MemoryRateLimiter) sweep(t time.Time) {
+	for key, b := range l.buckets {
+		if !b.full.After(t) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = t
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// rateLimited lets a request through if its client has a token left in the
+// bucket of group, and answers 429 otherwise. Clients are told their quota
+// in RateLimit-* headers either way. If the limiter fails, requests are let
+// through rather than turned away.
+func rateLimited(limiter RateLimiter, group string, limit RateLimit) gin.HandlerFunc {
+	if !limit.enabled() {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		decision, err := limiter.Take(c.Request.Context(), group+" "+rateLimitClient(c), limit)
+		if err != nil {
+			log.Printf("Unable to apply the %s rate limit, letting the request through: %v", group, err)
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Per)))
+		if !decision.Allowed {
+			retryAfter := max(ceilSeconds(decision.RetryAfter), 1)
+			header.Set("Retry-After", strconv.Itoa(retryAfter))
+			writeProblem(c, newProblem(http.StatusTooManyRequests, problemRateLimited,
+				fmt.Sprintf("No more than %d %s requests are allowed per %s; retry in %ds", limit.Requests, group, limit.Per, retryAfter)))
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitFailedAuth counts the requests of each client IP whose credentials
+// authenticate refuses, and once there have been too many, turns away the
+// client's requests with credentials before they are checked. Guessing API
+// keys is slowed down that way, without a database lookup per guess. It runs
+// in front of authenticate; requests without credentials are not counted.
+func limitFailedAuth(limiter RateLimiter, limit RateLimit) gin.HandlerFunc {
+	if !limit.enabled() {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		if c.GetHeader(apiKeyHeader) == "" && c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+
+		key := rateGroupAuth + " ip:" + c.ClientIP()
+		decision, err := limiter.Peek(c.Request.Context(), key, limit)
+		if err != nil {
+			log.Printf("Unable to apply the %s rate limit, letting the request through: %v", rateGroupAuth, err)
+			c.Next()
+			return
+		}
+		if !decision.Allowed {
+			retryAfter := max(ceilSeconds(decision.RetryAfter), 1)
+			c.Writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeProblem(c, newProblem(http.StatusTooManyRequests, problemRateLimited,
+				fmt.Sprintf("Too many requests with invalid credentials came from your address; retry in %ds", retryAfter)))
+			return
+		}
+
+		c.Next()
+		if c.Writer.Status() == http.StatusUnauthorized {
+			if _, err := limiter.Take(c.Request.Context(), key, limit); err != nil {
+				log.Printf("Unable to count a failed authentication: %v", err)
+			}
+		}
+	}
+}
+
+// rateLimitClient names the bucket owner: the API key or token subject of
+// authenticated requests, and the client IP of anonymous ones
+func rateLimitClient(c *gin.Context) string {
+	if p, ok := principalFrom(c.Request.Context()); ok {
+		return p.Tenant + "/" + p.Actor
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		raw   string
+		want  RateLimit
+		valid bool
+	}{
+		{"60/1m", RateLimit{Requests: 60, Per: time.Minute}, true},
+		{"5/500ms", RateLimit{Requests: 5, Per: 500 * time.Millisecond}, true},
+		{"off", RateLimit{}, true},
+		{"0", RateLimit{}, true},
+		{"60", RateLimit{}, false},
+		{"60/m", RateLimit{}, false},
+		{"-1/1m", RateLimit{}, false},
+		{"60/0s", RateLimit{}, false},
+	}
+	for _, tc := range tests {
+		got, err := parseRateLimit(tc.raw)
+		if tc.valid && (err != nil || got != tc.want) {
+			t.Errorf("%q: got %+v, %v expected %+v", tc.raw, got, err, tc.want)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%q: expected an error", tc.raw)
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	clock := now()
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return clock }
+	limit := RateLimit{Requests: 3, Per: 3 * time.Second}
+
+	// a full bucket allows a burst of its whole capacity
+	for i := 2; i >= 0; i-- {
+		decision, err := limiter.Take(ctx, "a", limit)
+		if err != nil || !decision.Allowed || decision.Remaining != i {
+			t.Fatalf("burst: got %+v, %v expected %d remaining", decision, err, i)
+		}
+	}
+	decision, err := limiter.Peek(ctx, "a", limit)
+	if err != nil || decision.Allowed || decision.RetryAfter != time.Second {
+		t.Fatalf("peek at an empty bucket: got %+v, %v", decision, err)
+	}
+	if decision, _ := limiter.Peek(ctx, "new", limit); !decision.Allowed || decision.Remaining != 3 || len(limiter.buckets) != 1 {
+		t.Errorf("peek at a new bucket: got %+v", decision)
+	}
+	decision, err = limiter.Take(ctx, "a", limit)
+	if err != nil || decision.Allowed || decision.RetryAfter != time.Second || decision.Reset != 3*time.Second {
+		t.Fatalf("empty bucket: got %+v, %v", decision, err)
+	}
+
+	// buckets are separate
+	if decision, _ := limiter.Take(ctx, "b", limit); !decision.Allowed {
+		t.Error("expected another key to have its own bucket")
+	}
+
+	// tokens come back at an even pace
+	clock = clock.Add(1500 * time.Millisecond)
+	if decision, _ := limiter.Take(ctx, "a", limit); !decision.Allowed || decision.Remaining != 0 {
+		t.Errorf("after a refill: got %+v", decision)
+	}
+	decision, _ = limiter.Take(ctx, "a", limit)
+	if decision.Allowed || decision.RetryAfter != 500*time.Millisecond {
+		t.Errorf("after using the refill: got %+v", decision)
+	}
+
+	// buckets that have refilled are dropped
+	clock = clock.Add(time.Hour)
+	limiter.Take(ctx, "c", limit)
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected refilled buckets to be swept, got %d", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Permissions are what routes require. Roles grant them through a policy.
+const (
+	permRead   = "products.read"
+	permCreate = "products.create"
+	permUpdate = "products.update"
+	permDelete = "products.delete"
+	permTrash  = "products.trash"
+	permBulk   = "products.bulk"
+	permAll    = "*"
+)
+
+var permissions = []string{permRead, permCreate, permUpdate, permDelete, permTrash, permBulk}
+
+// Built-in roles
+const (
+	roleViewer       = "viewer"
+	roleEditor       = "editor"
+	roleCatalogAdmin = "catalog-admin"
+)
+
+// policy maps roles to the permissions they grant
+type policy struct {
+	roles map[string][]string
+}
+
+// defaultPolicy lets viewers read, editors also create and change products,
+// and catalog admins do anything, including deleting products
+func defaultPolicy() *policy {
+	return &policy{roles: map[string][]string{
+		roleViewer:       {permRead},
+		roleEditor:       {permRead, permCreate, permUpdate},
+		roleCatalogAdmin: {permAll},
+	}}
+}
+
+// loadPolicy reads a policy file, YAML or JSON, of the form
+//
+//	roles:
+//	  viewer: [products.read]
+//	  editor: [products.read, products.create, products.update]
+//
+// A role granting "*" has every permission. The file replaces the default
+// policy as a whole.
+func loadPolicy(path string) (*policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	var file struct {
+		Roles map[string][]string `yaml:"roles"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("policy: %s: %w", path, err)
+	}
+	if len(file.Roles) == 0 {
+		return nil, fmt.Errorf("policy: %s defines no roles", path)
+	}
+	for role, granted := range file.Roles {
+		for _, permission := range granted {
+			if permission != permAll && !slices.Contains(permissions, permission) {
+				return nil, fmt.Errorf("policy: role %q grants unknown permission %q", role, permission)
+			}
+		}
+	}
+	return &policy{roles: file.Roles}, nil
+}
+
+// allows reports whether any of roles grants permission. Roles the policy
+// does not know grant nothing.
+func (p *policy) allows(roles []string, permission string) bool {
+	for _, role := range roles {
+		granted := p.roles[role]
+		if slices.Contains(granted, permission) || slices.Contains(granted, permAll) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *policy) hasRole(role string) bool {
+	_, ok := p.roles[role]
+	return ok
+}
+
+// roleNames lists the roles in the policy, sorted
+func (p *policy) roleNames() []string {
+	names := make([]string, 0, len(p.roles))
+	for role := range p.roles {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	p := defaultPolicy()
+	tests := []struct {
+		roles      []string
+		permission string
+		want       bool
+	}{
+		{[]string{roleViewer}, permRead, true},
+		{[]string{roleViewer}, permCreate, false},
+		{[]string{roleEditor}, permUpdate, true},
+		{[]string{roleEditor}, permDelete, false},
+		{[]string{roleViewer, roleEditor}, permCreate, true},
+		{[]string{roleCatalogAdmin}, permDelete, true},
+		{[]string{roleCatalogAdmin}, permBulk, true},
+		{[]string{"owner"}, permRead, false},
+		{nil, permRead, false},
+	}
+	for _, tc := range tests {
+		if got := p.allows(tc.roles, tc.permission); got != tc.want {
+			t.Errorf("allows(%v, %s) = %v expected %v", tc.roles, tc.permission, got, tc.want)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "policy.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	p, err := loadPolicy(write(`
+roles:
+  auditor: [products.read, products.trash]
+  owner: ["*"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.allows([]string{"auditor"}, permTrash) || p.allows([]string{"auditor"}, permUpdate) || !p.allows([]string{"owner"}, permBulk) {
+		t.Errorf("unexpected policy %+v", p.roles)
+	}
+	// the file replaces the built-in roles
+	if p.hasRole(roleViewer) || strings.Join(p.roleNames(), ",") != "auditor,owner" {
+		t.Errorf("got roles %v", p.roleNames())
+	}
+
+	if _, err := loadPolicy(write(`{"roles": {"viewer": ["products.read"]}}`)); err != nil {
+		t.Errorf("expected a JSON policy to load, got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Unknown permission", "roles:\n  viewer: [products.drop]\n", `unknown permission "products.drop"`},
+		{"Unknown field", "roles:\n  viewer: [products.read]\nusers: {}\n", "field users not found"},
+		{"No roles", "roles: {}\n", "defines no roles"},
+		{"Not YAML", "roles: [", "policy:"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadPolicy(write(tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v expected an error containing %q", err, tc.want)
+			}
+		})
+	}
+	if _, err := loadPolicy(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected a missing file to fail")
+	}
+}
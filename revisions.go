@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProductDiff lists the fields that differ between two revisions of a product
+type ProductDiff struct {
+	From    int64         `json:"from" example:"2"` //	@Description	The older revision
+	To      int64         `json:"to" example:"5"`   //	@Description	The newer revision
+	Changes []FieldChange `json:"changes"`          //	@Description	Fields that differ; empty when the revisions are alike
+}
+
+// FieldChange is one field that differs between two revisions
+type FieldChange struct {
+	Field string `json:"field" example:"name"` //	@Description	The product field
+	From  any    `json:"from"`                 //	@Description	Its value in the older revision
+	To    any    `json:"to"`                   //	@Description	Its value in the newer revision
+}
+
+// diffProducts compares the fields a client can change, plus whether the
+// product was deleted
+func diffProducts(from, to Product) []FieldChange {
+	changes := []FieldChange{}
+	add := func(field string, a, b any) {
+		if a != b {
+			changes = append(changes, FieldChange{Field: field, From: a, To: b})
+		}
+	}
+	add("name", from.Name, to.Name)
+	add("description", from.Description, to.Description)
+	add("price", from.Price, to.Price)
+	add("currency", from.Currency, to.Currency)
+	add("sku", from.Sku, to.Sku)
+
+	deletedAt := func(p Product) any {
+		if p.DeletedAt == nil {
+			return nil
+		}
+		return p.DeletedAt.Format(time.RFC3339Nano)
+	}
+	add("deleted_at", deletedAt(from), deletedAt(to))
+	return changes
+}
+
+// revertTo copies the fields a client can change from an earlier revision
+// onto the current product
+func revertTo(current, revision Product) Product {
+	current.Name = revision.Name
+	current.Description = revision.Description
+	current.Price = revision.Price
+	current.Currency = revision.Currency
+	current.Sku = revision.Sku
+	return current
+}
+
+// parseRevision reads a revision number from a path or query parameter. On
+// failure it writes a 400 problem and returns false.
+func parseRevision(c *gin.Context, name, raw string) (int64, bool) {
+	revision, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || revision < 1 {
+		p := newProblem(http.StatusBadRequest, problemInvalidQuery, fmt.Sprintf("'%s' is not a valid revision", raw))
+		p.Errors = []FieldError{{Field: name, Code: "positive_integer", Message: "must be a positive integer"}}
+		writeProblem(c, p)
+		return 0, false
+	}
+	return revision, true
+}
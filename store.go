@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrProductNotFound is returned when no product matches a lookup
+	ErrProductNotFound = errors.New("product not found")
+	// ErrProductConflict is returned when a write would duplicate a unique product field
+	ErrProductConflict = errors.New("product already exists")
+	// ErrVersionMismatch is returned when a conditional write names a version
+	// other than the stored one
+	ErrVersionMismatch = errors.New("product version does not match")
+)
+
+// ConflictError reports the unique field a write collided on.
+// It matches ErrProductConflict under errors.Is.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return "product " + e.Field + " already exists"
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrProductConflict
+}
+
+// conflictField names the field behind a conflict, defaulting to name
+func conflictField(err error) string {
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return conflict.Field
+	}
+	return "name"
+}
+
+// now is the timestamp stores record on writes. Microsecond precision is
+// what PostgreSQL keeps, so every backend returns identical values.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// ProductStore is the storage contract the HTTP handlers depend on.
+// Implementations translate backend-specific failures into ErrProductNotFound
+// and ErrProductConflict so handlers never inspect driver errors.
+//
+// Delete and DeleteByName only mark a product as deleted. Deleted products
+// are invisible to every other method, and free their name and sku for
+// reuse, until Restore brings them back or Purge removes them for good.
+//
+// Every method works on the catalog of the tenant in its context, see
+// withTenant. Products of other tenants do not exist as far as it is
+// concerned, and names and skus only need to be unique within a tenant.
+//
+// Every write is recorded in the product's history, attributed to the actor
+// in the write's context, in the same transaction as the write itself.
+//
+// Every write bumps the product's Version. Update and UpdateByName only
+// succeed when product.Version is zero or equal to the stored version, and
+// Delete and DeleteByName likewise take the version to expect, or zero;
+// otherwise they fail with ErrVersionMismatch.
+type ProductStore interface {
+	Get(ctx context.Context, id int) (Product, error)
+	GetByName(ctx context.Context, name string) (Product, error)
+	List(ctx context.Context, opts ListOptions) (ProductPage, error)
+	// Each calls fn with every product matching opts.Filters, in opts.Sort
+	// order, reading them as it goes rather than collecting a page. Limit,
+	// Offset and After are ignored. An error from fn stops the iteration and
+	// is returned as is.
+	Each(ctx context.Context, opts ListOptions, fn func(Product) error) error
+	Create(ctx context.Context, product Product) (Product, error)
+	Update(ctx context.Context, id int, product Product) (Product, error)
+	UpdateByName(ctx context.Context, name string, product Product) (Product, error)
+	// Patch reads a product, passes it to apply and stores the result, all
+	// atomically. An error from apply aborts the write and is returned as is.
+	// The write is conditional on the version apply was given.
+	Patch(ctx context.Context, id int, apply func(Product) (Product, error)) (Product, error)
+	Delete(ctx context.Context, id int, version int64) error
+	DeleteByName(ctx context.Context, name string, version int64) error
+	// Restore undeletes a deleted product, failing with ErrProductNotFound
+	// when there is no deleted product with id and with ErrProductConflict
+	// when its name or sku has been taken since
+	Restore(ctx context.Context, id int, version int64) (Product, error)
+	// Purge permanently removes products deleted before the given time, of
+	// every tenant, and reports how many it removed
+	Purge(ctx context.Context, before time.Time) (int64, error)
+	// History lists the audit trail of a product, newest entry first. It
+	// fails with ErrProductNotFound only for ids no product has ever had.
+	History(ctx context.Context, productId int, opts HistoryOptions) (HistoryPage, error)
+	// Revision returns a product as it was at one of its versions, deleted
+	// or not, and RevisionAt as it was at a point in time. Both fail with
+	// ErrProductNotFound when the history does not cover it.
+	Revision(ctx context.Context, id int, version int64) (Product, error)
+	RevisionAt(ctx context.Context, id int, at time.Time) (Product, error)
+	// Batch runs operations in order in a single transaction. Failures of
+	// individual operations are reported in their result; when atomic is set
+	// the first one stops the batch and rolls every operation back.
+	Batch(ctx context.Context, ops []BatchOperation, atomic bool) ([]BatchResult, error)
+}
+
+// deletedScope selects which products a listing includes by whether they
+// are deleted
+type deletedScope int
+
+const (
+	excludeDeleted deletedScope = iota
+	includeDeleted
+	onlyDeleted
+)
+
+// ListOptions filters, orders and pages a product listing
+type ListOptions struct {
+	// Deleted selects live products, the default, deleted ones or both
+	Deleted deletedScope
+	// Filters must all match; fields are keys of productFields
+	Filters []Filter
+	// Sort orders the listing; id is always appended as a tiebreaker
+	Sort []SortKey
+	// Limit caps the number of items returned; zero returns every match
+	Limit int
+	// Offset skips that many matches before the page starts
+	Offset int
+	// After resumes a keyset listing after the row holding these values,
+	// one per key returned by sortKeys
+	After []any
+}
+
+// ProductPage is one page of a product listing
+type ProductPage struct {
+	Items []Product
+	// Total counts every match, ignoring Limit, Offset and After
+	Total int
+	// HasMore is set when further items follow this page
+	HasMore bool
+}
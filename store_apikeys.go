@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned for keys that do not exist or were revoked
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKeyStore is implemented by stores that can hold API keys
+type APIKeyStore interface {
+	// CreateAPIKey stores a new key, of which only the hash is given
+	CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error)
+	// APIKeyByHash finds the live key with the given hash
+	APIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	// ListAPIKeys returns every key, revoked ones included, oldest first
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey stops a key from being accepted
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+// APIKey is a stored key. The key itself is never stored, only its hash.
+type APIKey struct {
+	Id        int64
+	Name      string
+	Hash      string
+	Roles     []string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+	// Tenant is the only tenant whose catalog the key gives access to
+	Tenant string
+}
+
+const apiKeyColumns = "id, name, key_hash, tenant_id, roles, created_at, revoked_at"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var roles string
+	var revokedAt sql.NullTime
+	if err := row.Scan(&key.Id, &key.Name, &key.Hash, &key.Tenant, &roles, &key.CreatedAt, &revokedAt); err != nil {
+		return APIKey{}, err
+	}
+	key.Roles = strings.Fields(roles)
+	key.CreatedAt = key.CreatedAt.UTC()
+	if revokedAt.Valid {
+		revokedAt.Time = revokedAt.Time.UTC()
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+func (s *SQLStore) CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	key.CreatedAt = now()
+	err := s.db.QueryRowContext(ctx, s.rebind("INSERT INTO api_keys (name, key_hash, tenant_id, roles, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id"),
+		s.bind([]any{key.Name, key.Hash, key.Tenant, strings.Join(key.Roles, " "), key.CreatedAt})...).Scan(&key.Id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (s *SQLStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, s.rebind("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL"), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *SQLStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, s.rebind("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL"), s.bind([]any{now(), id})...)
+	if err != nil {
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.apiKeys {
+		if other.Hash == key.Hash {
+			return APIKey{}, errors.New("api key hash already exists")
+		}
+	}
+	key.Id = int64(len(s.apiKeys) + 1)
+	key.Roles = append([]string(nil), key.Roles...)
+	key.CreatedAt = now()
+	s.apiKeys = append(s.apiKeys, key)
+	return key, nil
+}
+
+func (s *MemoryStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash && key.RevokedAt == nil {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+func (s *MemoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]APIKey{}, s.apiKeys...), nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > int64(len(s.apiKeys)) || s.apiKeys[id-1].RevokedAt != nil {
+		return ErrAPIKeyNotFound
+	}
+	revokedAt := now()
+	s.apiKeys[id-1].RevokedAt = &revokedAt
+	return nil
+}
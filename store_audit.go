@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Actions recorded in the audit trail
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// AuditRecord is one immutable entry of a product's history
+type AuditRecord struct {
+	Id        int64     `json:"id" example:"42"`                                                    //	@Description	The unique ID of the entry
+	ProductId int       `json:"product_id" example:"3"`                                             //	@Description	The product that changed
+	Version   int64     `json:"version" example:"2"`                                                //	@Description	The product's version after the change, or before it for a purge
+	Action    string    `json:"action" enums:"create,update,delete,restore,purge" example:"update"` //	@Description	What happened to the product
+	Actor     string    `json:"actor" example:"anonymous"`                                          //	@Description	Who made the change
+	RequestId string    `json:"request_id,omitempty" example:"4f1c2a9e0b7d4e3a8c6f5b2d1e0a9c8b"`    //	@Description	The X-Request-Id of the request that made the change
+	Before    *Product  `json:"before,omitempty"`                                                   //	@Description	The product before the change; absent for a create
+	After     *Product  `json:"after,omitempty"`                                                    //	@Description	The product after the change; absent for a purge
+	CreatedAt time.Time `json:"created_at"`                                                         //	@Description	When the change was made
+
+	// tenant owns the product; histories are only ever read within it
+	tenant string
+}
+
+// HistoryOptions pages through a product's history, newest entry first
+type HistoryOptions struct {
+	// Limit caps the number of entries returned; zero returns all of them
+	Limit int
+	// Before resumes the history after the entry with this id
+	Before int64
+}
+
+// HistoryPage is one page of a product's history
+type HistoryPage struct {
+	Items []AuditRecord
+	// HasMore is set when older entries follow this page
+	HasMore bool
+}
+
+// auditInfo says who is behind the writes made with a context
+type auditInfo struct {
+	Actor     string
+	RequestId string
+}
+
+type auditInfoKey struct{}
+
+// systemActor is recorded for writes made outside a request, such as purges
+const systemActor = "system"
+
+func withAuditInfo(ctx context.Context, info auditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+func auditInfoFrom(ctx context.Context) auditInfo {
+	info, ok := ctx.Value(auditInfoKey{}).(auditInfo)
+	if !ok || info.Actor == "" {
+		info.Actor = systemActor
+	}
+	return info
+}
+
+// newAuditRecord describes a change made with ctx. It has no id yet.
+func newAuditRecord(ctx context.Context, action string, before, after *Product) AuditRecord {
+	info := auditInfoFrom(ctx)
+	record := AuditRecord{Action: action, Actor: info.Actor, RequestId: info.RequestId, Before: before, After: after, CreatedAt: now(), tenant: tenantFrom(ctx)}
+	if after != nil {
+		record.ProductId, record.Version = after.Id, after.Version
+	} else {
+		record.ProductId, record.Version = before.Id, before.Version
+	}
+	return record
+}
+
+// audit records a change in the same transaction as the change itself
+func (s *SQLStore) audit(ctx context.Context, q querier, action string, before, after *Product) error {
+	record := newAuditRecord(ctx, action, before, after)
+	beforeData, err := marshalAuditProduct(record.Before)
+	if err != nil {
+		return err
+	}
+	afterData, err := marshalAuditProduct(record.After)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, s.rebind(`INSERT INTO product_audit (tenant_id, product_id, version, action, actor, request_id, before_data, after_data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		s.bind([]any{record.tenant, record.ProductId, record.Version, record.Action, record.Actor, record.RequestId, beforeData, afterData, record.CreatedAt})...)
+	return err
+}
+
+func marshalAuditProduct(product *Product) (any, error) {
+	if product == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(product)
+	return string(raw), err
+}
+
+func (s *SQLStore) History(ctx context.Context, productId int, opts HistoryOptions) (HistoryPage, error) {
+	query := `SELECT id, product_id, version, action, actor, request_id, before_data, after_data, created_at
+		FROM product_audit WHERE tenant_id = ? AND product_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC`
+	args := []any{tenantFrom(ctx), productId, opts.Before, opts.Before}
+	if opts.Limit > 0 {
+		// one extra row tells us whether more entries follow
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	defer rows.Close()
+
+	page := HistoryPage{Items: []AuditRecord{}}
+	for rows.Next() {
+		var record AuditRecord
+		var beforeData, afterData sql.NullString
+		if err := rows.Scan(&record.Id, &record.ProductId, &record.Version, &record.Action, &record.Actor, &record.RequestId, &beforeData, &afterData, &record.CreatedAt); err != nil {
+			return HistoryPage{}, err
+		}
+		record.CreatedAt = record.CreatedAt.UTC()
+		if record.Before, err = unmarshalAuditProduct(beforeData); err != nil {
+			return HistoryPage{}, err
+		}
+		if record.After, err = unmarshalAuditProduct(afterData); err != nil {
+			return HistoryPage{}, err
+		}
+		page.Items = append(page.Items, record)
+	}
+	if err := rows.Err(); err != nil {
+		return HistoryPage{}, err
+	}
+
+	if opts.Limit > 0 && len(page.Items) > opts.Limit {
+		page.Items = page.Items[:opts.Limit]
+		page.HasMore = true
+	}
+	if len(page.Items) == 0 && opts.Before == 0 {
+		// products created before the audit trail existed have no history
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, s.rebind("SELECT EXISTS (SELECT 1 FROM products WHERE tenant_id = ? AND id = ?)"), tenantFrom(ctx), productId).Scan(&exists); err != nil {
+			return HistoryPage{}, err
+		}
+		if !exists {
+			return HistoryPage{}, ErrProductNotFound
+		}
+	}
+	return page, nil
+}
+
+func (s *SQLStore) Revision(ctx context.Context, id int, version int64) (Product, error) {
+	var data sql.NullString
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT after_data FROM product_audit WHERE tenant_id = ? AND product_id = ? AND version = ? AND after_data IS NOT NULL ORDER BY id DESC LIMIT 1"), tenantFrom(ctx), id, version).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		// products created before the audit trail existed still have their
+		// current version
+		return s.scanOne(ctx, s.db, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND id = ? AND version = ?", tenantFrom(ctx), id, version)
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	product, err := unmarshalAuditProduct(data)
+	if err != nil {
+		return Product{}, err
+	}
+	return *product, nil
+}
+
+func (s *SQLStore) RevisionAt(ctx context.Context, id int, at time.Time) (Product, error) {
+	var data sql.NullString
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT after_data FROM product_audit WHERE tenant_id = ? AND product_id = ? AND created_at <= ? ORDER BY id DESC LIMIT 1"), s.bind([]any{tenantFrom(ctx), id, at})...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	product, err := unmarshalAuditProduct(data)
+	if err != nil {
+		return Product{}, err
+	}
+	if product == nil {
+		// the product had been purged by then
+		return Product{}, ErrProductNotFound
+	}
+	return *product, nil
+}
+
+func unmarshalAuditProduct(data sql.NullString) (*Product, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var product Product
+	if err := json.Unmarshal([]byte(data.String), &product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// audit must be called with the write lock held
+func (s *MemoryStore) audit(ctx context.Context, action string, before, after *Product) {
+	record := newAuditRecord(ctx, action, before, after)
+	record.Id = int64(len(s.auditLog) + 1)
+	s.auditLog = append(s.auditLog, record)
+}
+
+func (s *MemoryStore) Revision(ctx context.Context, id int, version int64) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantFrom(ctx)
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		record := s.auditLog[i]
+		if record.tenant == tenant && record.ProductId == id && record.Version == version && record.After != nil {
+			return *record.After, nil
+		}
+	}
+	return Product{}, ErrProductNotFound
+}
+
+func (s *MemoryStore) RevisionAt(ctx context.Context, id int, at time.Time) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantFrom(ctx)
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		record := s.auditLog[i]
+		if record.tenant != tenant || record.ProductId != id || record.CreatedAt.After(at) {
+			continue
+		}
+		if record.After == nil {
+			return Product{}, ErrProductNotFound
+		}
+		return *record.After, nil
+	}
+	return Product{}, ErrProductNotFound
+}
+
+func (s *MemoryStore) History(ctx context.Context, productId int, opts HistoryOptions) (HistoryPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantFrom(ctx)
+	page := HistoryPage{Items: []AuditRecord{}}
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		record := s.auditLog[i]
+		if record.tenant != tenant || record.ProductId != productId || (opts.Before != 0 && record.Id >= opts.Before) {
+			continue
+		}
+		if opts.Limit > 0 && len(page.Items) == opts.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Items = append(page.Items, record)
+	}
+
+	if _, ok := s.owned(tenant, productId); !ok && len(page.Items) == 0 && opts.Before == 0 {
+		return HistoryPage{}, ErrProductNotFound
+	}
+	return page, nil
+}
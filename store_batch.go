@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Operations accepted in a batch
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// BatchOperation is one write in a batch
+type BatchOperation struct {
+	Op      string   `json:"op" enums:"create,update,delete" example:"update"` //	@Description	What to do: create, update or delete
+	Id      int      `json:"id,omitempty" example:"3"`                         //	@Description	The product to update or delete
+	Version int64    `json:"version,omitempty" example:"2"`                    //	@Description	Version the product must still have, like If-Match; omit to write unconditionally
+	Product *Product `json:"product,omitempty"`                                //	@Description	The new product, for create and update
+}
+
+// BatchResult is the outcome of one BatchOperation. Err is nil on success
+// and otherwise one of the store errors.
+type BatchResult struct {
+	Product Product
+	Err     error
+}
+
+// isItemError reports whether err is the failure of a single operation
+// rather than of the database
+func isItemError(err error) bool {
+	return errors.Is(err, ErrProductNotFound) || errors.Is(err, ErrProductConflict) || errors.Is(err, ErrVersionMismatch)
+}
+
+// errBatchAborted rolls back an atomic batch after an operation failed
+var errBatchAborted = errors.New("batch aborted")
+
+func (s *SQLStore) Batch(ctx context.Context, ops []BatchOperation, atomic bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(ops))
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for i, op := range ops {
+			// a savepoint per operation undoes just that one on failure,
+			// which PostgreSQL needs before the transaction can continue
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_operation"); err != nil {
+				return err
+			}
+
+			product, err := s.runBatchOperation(ctx, tx, op)
+			if err != nil {
+				if _, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_operation"); rollbackErr != nil {
+					return rollbackErr
+				}
+				if !isItemError(err) {
+					return err
+				}
+				results[i].Err = err
+				if atomic {
+					return errBatchAborted
+				}
+				continue
+			}
+
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_operation"); err != nil {
+				return err
+			}
+			results[i].Product = product
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchAborted) {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *SQLStore) runBatchOperation(ctx context.Context, tx *sql.Tx, op BatchOperation) (Product, error) {
+	switch op.Op {
+	case batchCreate:
+		return s.create(ctx, tx, *op.Product)
+	case batchUpdate:
+		product := *op.Product
+		product.Version = op.Version
+		return s.update(ctx, tx, "id = ?", op.Id, product)
+	case batchDelete:
+		return Product{}, s.delete(ctx, tx, "id = ?", op.Id, op.Version)
+	}
+	return Product{}, fmt.Errorf("unknown batch operation %q", op.Op)
+}
+
+func (s *MemoryStore) Batch(ctx context.Context, ops []BatchOperation, atomic bool) ([]BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// an atomic batch that fails is undone by restoring this snapshot
+	snapshot := make(map[int]Product, len(s.products))
+	tenants := make(map[int]string, len(s.tenants))
+	for id, product := range s.products {
+		snapshot[id], tenants[id] = product, s.tenants[id]
+	}
+	nextId, audited := s.nextId, len(s.auditLog)
+	rollback := func() {
+		s.products, s.tenants, s.nextId, s.auditLog = snapshot, tenants, nextId, s.auditLog[:audited]
+	}
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		product, err := s.runBatchOperation(ctx, op)
+		if err != nil {
+			if !isItemError(err) {
+				rollback()
+				return nil, err
+			}
+			results[i].Err = err
+			if atomic {
+				rollback()
+				break
+			}
+			continue
+		}
+		results[i].Product = product
+	}
+	return results, nil
+}
+
+// runBatchOperation must be called with the write lock held
+func (s *MemoryStore) runBatchOperation(ctx context.Context, op BatchOperation) (Product, error) {
+	switch op.Op {
+	case batchCreate:
+		return s.create(ctx, *op.Product)
+	case batchUpdate:
+		product := *op.Product
+		product.Version = op.Version
+		return s.update(ctx, op.Id, product)
+	case batchDelete:
+		return Product{}, s.delete(ctx, op.Id, op.Version)
+	}
+	return Product{}, fmt.Errorf("unknown batch operation %q", op.Op)
+}
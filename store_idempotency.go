@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// IdempotencyStore is implemented by stores that can remember responses to
+// requests sent with an Idempotency-Key. Keys are scoped to the tenant of the
+// context, so tenants cannot see each other's responses.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims key for a request. When the key is already
+	// held and has not expired it returns the existing record and false.
+	ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the response to a reserved key
+	CompleteIdempotencyKey(ctx context.Context, key string, status int, header http.Header, body []byte) error
+	// ReleaseIdempotencyKey forgets a reserved key so the request can be retried
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	// SweepIdempotencyKeys deletes keys that expired before now, of every
+	// tenant
+	SweepIdempotencyKeys(ctx context.Context, now time.Time) (int64, error)
+}
+
+// IdempotencyRecord is the stored outcome of a request with an Idempotency-Key
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	// Status is zero while the first request is still in progress
+	Status    int
+	Header    http.Header
+	Body      []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (s *SQLStore) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (IdempotencyRecord, bool, error) {
+	// an expired key is taken over as if it did not exist
+	result, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO idempotency_keys (tenant_id, idempotency_key, request_hash, status, headers, body, created_at, expires_at)
+		VALUES (?, ?, ?, 0, '{}', NULL, ?, ?)
+		ON CONFLICT (tenant_id, idempotency_key) DO UPDATE
+		SET request_hash = excluded.request_hash, status = 0, headers = '{}', body = NULL, created_at = excluded.created_at, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= excluded.created_at`),
+		s.bind([]any{tenantFrom(ctx), key, requestHash, now(), expiresAt})...)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if reserved, err := result.RowsAffected(); err != nil || reserved == 1 {
+		return IdempotencyRecord{}, err == nil, err
+	}
+
+	var record IdempotencyRecord
+	var header string
+	err = s.db.QueryRowContext(ctx, s.rebind(`SELECT idempotency_key, request_hash, status, headers, body, created_at, expires_at
+		FROM idempotency_keys WHERE tenant_id = ? AND idempotency_key = ?`), tenantFrom(ctx), key).
+		Scan(&record.Key, &record.RequestHash, &record.Status, &header, &record.Body, &record.CreatedAt, &record.ExpiresAt)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	record.CreatedAt, record.ExpiresAt = record.CreatedAt.UTC(), record.ExpiresAt.UTC()
+	if err := json.Unmarshal([]byte(header), &record.Header); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	return record, false, nil
+}
+
+func (s *SQLStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, header http.Header, body []byte) error {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind("UPDATE idempotency_keys SET status = ?, headers = ?, body = ? WHERE tenant_id = ? AND idempotency_key = ?"),
+		status, string(encoded), body, tenantFrom(ctx), key)
+	return err
+}
+
+func (s *SQLStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM idempotency_keys WHERE tenant_id = ? AND idempotency_key = ?"), tenantFrom(ctx), key)
+	return err
+}
+
+func (s *SQLStore) SweepIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM idempotency_keys WHERE expires_at <= ?"), s.bind([]any{now})...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timestamp := now()
+	scoped := tenantKeyOf(ctx, key)
+	if existing, ok := s.idempotencyKeys[scoped]; ok && existing.ExpiresAt.After(timestamp) {
+		return existing, false, nil
+	}
+	s.idempotencyKeys[scoped] = IdempotencyRecord{Key: key, RequestHash: requestHash, Header: http.Header{}, CreatedAt: timestamp, ExpiresAt: expiresAt}
+	return IdempotencyRecord{}, true, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, header http.Header, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scoped := tenantKeyOf(ctx, key)
+	record, ok := s.idempotencyKeys[scoped]
+	if !ok {
+		return nil
+	}
+	record.Status, record.Header, record.Body = status, header.Clone(), append([]byte(nil), body...)
+	s.idempotencyKeys[scoped] = record
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotencyKeys, tenantKeyOf(ctx, key))
+	return nil
+}
+
+func (s *MemoryStore) SweepIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var swept int64
+	for key, record := range s.idempotencyKeys {
+		if !record.ExpiresAt.After(now) {
+			delete(s.idempotencyKeys, key)
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+// tenantIdempotencyKey is an Idempotency-Key qualified by the tenant that
+// sent it
+type tenantIdempotencyKey struct {
+	tenant string
+	key    string
+}
+
+func tenantKeyOf(ctx context.Context, key string) tenantIdempotencyKey {
+	return tenantIdempotencyKey{tenant: tenantFrom(ctx), key: key}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a ProductStore kept entirely in process memory.
+// It is intended for tests and local experiments.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	products map[int]Product
+	// tenants records the tenant owning each product in products
+	tenants map[int]string
+	nextId  int
+	// idempotencyKeys backs the IdempotencyStore methods
+	idempotencyKeys map[tenantIdempotencyKey]IdempotencyRecord
+	// auditLog holds every change in order; entry ids are their position
+	// plus one
+	auditLog []AuditRecord
+	// apiKeys backs the APIKeyStore methods; key ids are their position plus
+	// one
+	apiKeys []APIKey
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{products: map[int]Product{}, tenants: map[int]string{}, nextId: 1, idempotencyKeys: map[tenantIdempotencyKey]IdempotencyRecord{}}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id int) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, ok := s.live(tenantFrom(ctx), id)
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	return product, nil
+}
+
+func (s *MemoryStore) GetByName(ctx context.Context, name string) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.idByName(tenantFrom(ctx), name)
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	return s.products[id], nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, opts ListOptions) (ProductPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantFrom(ctx)
+	keys := sortKeys(opts)
+	matches := make([]Product, 0, len(s.products))
+	for id, product := range s.products {
+		if s.tenants[id] == tenant && inDeletedScope(product, opts.Deleted) && matchesFilters(product, opts.Filters) {
+			matches = append(matches, product)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return compareByKeys(matches[i], keyValues(matches[j], keys), keys) < 0 })
+
+	total := len(matches)
+	if len(opts.After) > 0 {
+		after := matches[:0:0]
+		for _, product := range matches {
+			if compareByKeys(product, opts.After, keys) > 0 {
+				after = append(after, product)
+			}
+		}
+		matches = after
+	}
+
+	return paginate(matches, total, opts), nil
+}
+
+func (s *MemoryStore) Each(ctx context.Context, opts ListOptions, fn func(Product) error) error {
+	page, err := s.List(ctx, ListOptions{Deleted: opts.Deleted, Filters: opts.Filters, Sort: opts.Sort})
+	if err != nil {
+		return err
+	}
+
+	// fn runs without the lock held so a slow reader does not block writers
+	for _, product := range page.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Create(ctx context.Context, product Product) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.create(ctx, product)
+}
+
+// create must be called with the write lock held
+func (s *MemoryStore) create(ctx context.Context, product Product) (Product, error) {
+	tenant := tenantFrom(ctx)
+	if err := s.checkUnique(tenant, 0, product); err != nil {
+		return Product{}, err
+	}
+
+	product.Id = s.nextId
+	product.CreatedAt = now()
+	product.UpdatedAt = product.CreatedAt
+	product.Version = 1
+	s.nextId++
+	s.products[product.Id] = product
+	s.tenants[product.Id] = tenant
+	s.audit(ctx, auditCreate, nil, &product)
+
+	return product, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, id int, product Product) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(ctx, id, product)
+}
+
+func (s *MemoryStore) UpdateByName(ctx context.Context, name string, product Product) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.idByName(tenantFrom(ctx), name)
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	return s.update(ctx, id, product)
+}
+
+func (s *MemoryStore) Patch(ctx context.Context, id int, apply func(Product) (Product, error)) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.live(tenantFrom(ctx), id)
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	product, err := apply(current)
+	if err != nil {
+		return Product{}, err
+	}
+	product.Version = current.Version
+	return s.update(ctx, id, product)
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id int, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(ctx, id, version)
+}
+
+func (s *MemoryStore) DeleteByName(ctx context.Context, name string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.idByName(tenantFrom(ctx), name)
+	if !ok {
+		return ErrProductNotFound
+	}
+	return s.delete(ctx, id, version)
+}
+
+// delete must be called with the write lock held
+func (s *MemoryStore) delete(ctx context.Context, id int, version int64) error {
+	existing, ok := s.live(tenantFrom(ctx), id)
+	if !ok {
+		return ErrProductNotFound
+	}
+	if version != 0 && existing.Version != version {
+		return ErrVersionMismatch
+	}
+	deleted := existing
+	deletedAt := now()
+	deleted.DeletedAt = &deletedAt
+	deleted.Version++
+	s.products[id] = deleted
+	s.audit(ctx, auditDelete, &existing, &deleted)
+	return nil
+}
+
+func (s *MemoryStore) Restore(ctx context.Context, id int, version int64) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := tenantFrom(ctx)
+	existing, ok := s.owned(tenant, id)
+	if !ok || existing.DeletedAt == nil {
+		return Product{}, ErrProductNotFound
+	}
+	if version != 0 && existing.Version != version {
+		return Product{}, ErrVersionMismatch
+	}
+	if err := s.checkUnique(tenant, id, existing); err != nil {
+		return Product{}, err
+	}
+	restored := existing
+	restored.DeletedAt = nil
+	restored.Version++
+	s.products[id] = restored
+	s.audit(ctx, auditRestore, &existing, &restored)
+	return restored, nil
+}
+
+func (s *MemoryStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for id, product := range s.products {
+		if product.DeletedAt != nil && product.DeletedAt.Before(before) {
+			// each purge lands in the history of the tenant that owned it
+			s.audit(withTenant(ctx, s.tenants[id]), auditPurge, &product, nil)
+			delete(s.products, id)
+			delete(s.tenants, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// update must be called with the write lock held
+func (s *MemoryStore) update(ctx context.Context, id int, product Product) (Product, error) {
+	tenant := tenantFrom(ctx)
+	existing, ok := s.live(tenant, id)
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	if product.Version != 0 && existing.Version != product.Version {
+		return Product{}, ErrVersionMismatch
+	}
+	if err := s.checkUnique(tenant, id, product); err != nil {
+		return Product{}, err
+	}
+
+	product.Id = id
+	product.CreatedAt = existing.CreatedAt
+	product.UpdatedAt = now()
+	product.Version = existing.Version + 1
+	product.DeletedAt = nil
+	s.products[id] = product
+	s.audit(ctx, auditUpdate, &existing, &product)
+	return product, nil
+}
+
+// checkUnique enforces the unique name and sku constraints against every
+// live product of tenant other than the one with id
+func (s *MemoryStore) checkUnique(tenant string, id int, product Product) error {
+	for otherId, other := range s.products {
+		if otherId == id || other.DeletedAt != nil || s.tenants[otherId] != tenant {
+			continue
+		}
+		if other.Name == product.Name {
+			return &ConflictError{Field: "name"}
+		}
+		if product.Sku != "" && other.Sku == product.Sku {
+			return &ConflictError{Field: "sku"}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) idByName(tenant, name string) (int, bool) {
+	for id, product := range s.products {
+		if product.Name == name && product.DeletedAt == nil && s.tenants[id] == tenant {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// owned returns the product with id, deleted or not, if tenant owns it
+func (s *MemoryStore) owned(tenant string, id int) (Product, bool) {
+	product, ok := s.products[id]
+	return product, ok && s.tenants[id] == tenant
+}
+
+// live returns the product with id unless tenant does not own it or it is
+// deleted
+func (s *MemoryStore) live(tenant string, id int) (Product, bool) {
+	product, ok := s.owned(tenant, id)
+	return product, ok && product.DeletedAt == nil
+}
+
+func inDeletedScope(product Product, scope deletedScope) bool {
+	switch scope {
+	case includeDeleted:
+		return true
+	case onlyDeleted:
+		return product.DeletedAt != nil
+	}
+	return product.DeletedAt == nil
+}
+
+// paginate applies Offset and Limit to an already filtered and ordered slice
+func paginate(products []Product, total int, opts ListOptions) ProductPage {
+	page := ProductPage{Items: []Product{}, Total: total}
+	if opts.Offset >= len(products) {
+		return page
+	}
+	products = products[opts.Offset:]
+
+	if opts.Limit > 0 && len(products) > opts.Limit {
+		products = products[:opts.Limit]
+		page.HasMore = true
+	}
+	page.Items = append(page.Items, products...)
+	return page
+}
+
+func matchesFilters(product Product, filters []Filter) bool {
+	for _, filter := range filters {
+		value := productFields[filter.Field].Value(product)
+
+		var ok bool
+		switch filter.Op {
+		case "eq":
+			ok = compareValues(value, filter.Value) == 0
+		case "ne":
+			ok = compareValues(value, filter.Value) != 0
+		case "gt":
+			ok = compareValues(value, filter.Value) > 0
+		case "gte":
+			ok = compareValues(value, filter.Value) >= 0
+		case "lt":
+			ok = compareValues(value, filter.Value) < 0
+		case "lte":
+			ok = compareValues(value, filter.Value) <= 0
+		case "contains":
+			ok = strings.Contains(strings.ToLower(value.(string)), strings.ToLower(filter.Value.(string)))
+		case "prefix":
+			ok = strings.HasPrefix(strings.ToLower(value.(string)), strings.ToLower(filter.Value.(string)))
+		case "in":
+			for _, candidate := range filter.Value.([]any) {
+				if compareValues(value, candidate) == 0 {
+					ok = true
+					break
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// keyValues reads the values of the sort keys from a product
+func keyValues(product Product, keys []SortKey) []any {
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		values[i] = productFields[key.Field].Value(product)
+	}
+	return values
+}
+
+// compareByKeys orders a product against key values in the listing order
+func compareByKeys(product Product, values []any, keys []SortKey) int {
+	for i, key := range keys {
+		cmp := compareValues(productFields[key.Field].Value(product), values[i])
+		if key.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"strings"
+)
+
+// ErrSearchUnavailable is returned when the store has no full-text index,
+// e.g. on PostgreSQL or when go-sqlite3 was built without the sqlite_fts5 tag
+var ErrSearchUnavailable = errors.New("full-text search is not available")
+
+// ProductSearcher is implemented by stores that can run full-text queries
+type ProductSearcher interface {
+	Search(ctx context.Context, match string, limit, offset int) (SearchPage, error)
+}
+
+// SearchResult is a product matched by a full-text query
+type SearchResult struct {
+	Product Product `json:"product"` //	@Description	The matching product
+	Snippet string  `json:"snippet"` //	@Description	HTML-escaped excerpt with matched terms wrapped in <mark> tags
+	Rank    float64 `json:"rank"`    //	@Description	BM25 score; lower is a better match
+}
+
+// SearchPage is one page of full-text search results, best match first
+type SearchPage struct {
+	Items []SearchResult `json:"items"` //	@Description	The results on this page
+	Total int            `json:"total"` //	@Description	The number of matching products across all pages
+}
+
+// The index is an external-content FTS5 table over products, kept in sync by
+// triggers. The statements are kept without IF NOT EXISTS because that is
+// how SQLite records them, which lets EnableSearch spot an outdated index.
+const productsFTSTable = `CREATE VIRTUAL TABLE products_fts USING fts5(name, description, content='products', content_rowid='id', tokenize='unicode61 remove_diacritics 2', prefix='2 3')`
+
+var productsFTSTriggers = []string{
+	`CREATE TRIGGER products_fts_insert AFTER INSERT ON products BEGIN
+	INSERT INTO products_fts(rowid, name, description) VALUES (new.id, new.name, new.description);
+END`,
+	`CREATE TRIGGER products_fts_delete AFTER DELETE ON products BEGIN
+	INSERT INTO products_fts(products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+END`,
+	`CREATE TRIGGER products_fts_update AFTER UPDATE ON products BEGIN
+	INSERT INTO products_fts(products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+	INSERT INTO products_fts(rowid, name, description) VALUES (new.id, new.name, new.description);
+END`,
+}
+
+// Snippet markers that cannot appear in product text; they are swapped for
+// <mark> tags after the snippet has been HTML-escaped
+const (
+	snippetOpen  = "\x02"
+	snippetClose = "\x03"
+)
+
+// EnableSearch creates or refreshes the FTS5 index when the backend supports
+// it. It returns ErrSearchUnavailable otherwise, leaving the store usable.
+func (s *SQLStore) EnableSearch(ctx context.Context) error {
+	if _, ok := s.dialect.(sqliteDialect); !ok {
+		return ErrSearchUnavailable
+	}
+
+	var fts5 bool
+	if err := s.db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+	if !fts5 {
+		return ErrSearchUnavailable
+	}
+
+	var current string
+	err := s.db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE name = 'products_fts'").Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	triggersPresent := 0
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'products_fts_%'").Scan(&triggersPresent); err != nil {
+		return err
+	}
+
+	if current != productsFTSTable || triggersPresent != len(productsFTSTriggers) {
+		if err := s.rebuildSearchIndex(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.searchEnabled = true
+	return nil
+}
+
+// rebuildSearchIndex recreates the FTS table and its triggers and reindexes
+// every product, in one transaction
+func (s *SQLStore) rebuildSearchIndex(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"DROP TRIGGER IF EXISTS products_fts_insert",
+		"DROP TRIGGER IF EXISTS products_fts_delete",
+		"DROP TRIGGER IF EXISTS products_fts_update",
+		"DROP TABLE IF EXISTS products_fts",
+		productsFTSTable,
+	}
+	statements = append(statements, productsFTSTriggers...)
+	statements = append(statements, "INSERT INTO products_fts(products_fts) VALUES ('rebuild')")
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Search(ctx context.Context, match string, limit, offset int) (SearchPage, error) {
+	if !s.searchEnabled {
+		return SearchPage{}, ErrSearchUnavailable
+	}
+
+	page := SearchPage{Items: []SearchResult{}}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM products_fts JOIN products p ON p.id = products_fts.rowid
+		WHERE products_fts MATCH ? AND p.tenant_id = ? AND p.deleted_at IS NULL`, match, tenantFrom(ctx)).Scan(&page.Total); err != nil {
+		return SearchPage{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+productColumnsOf("p")+`, snippet(products_fts, -1, ?, ?, '…', 12), products_fts.rank
+		FROM products_fts JOIN products p ON p.id = products_fts.rowid
+		WHERE products_fts MATCH ? AND p.tenant_id = ? AND p.deleted_at IS NULL
+		ORDER BY products_fts.rank, p.id
+		LIMIT ? OFFSET ?`, snippetOpen, snippetClose, match, tenantFrom(ctx), limit, offset)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result SearchResult
+		product, err := scanProduct(rows, &result.Snippet, &result.Rank)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		result.Product = product
+		result.Snippet = highlightSnippet(result.Snippet)
+		page.Items = append(page.Items, result)
+	}
+
+	return page, rows.Err()
+}
+
+func highlightSnippet(snippet string) string {
+	return strings.NewReplacer(snippetOpen, "<mark>", snippetClose, "</mark>").Replace(html.EscapeString(snippet))
+}
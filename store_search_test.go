@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// setupSearchStore returns a SQLite store with the FTS5 index enabled, or
+// skips the test when go-sqlite3 was built without the sqlite_fts5 tag
+func setupSearchStore(t *testing.T) *SQLStore {
+	store := NewSQLiteStore(setupTestDB(t))
+	if err := store.EnableSearch(context.Background()); err != nil {
+		if errors.Is(err, ErrSearchUnavailable) {
+			t.Skip("FTS5 is not compiled in; run the tests with -tags sqlite_fts5")
+		}
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBuildMatchQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"pen", `"pen"`},
+		{"blue pen", `"blue" "pen"`},
+		{"note*", `"note"*`},
+		{`"blue pen"`, `"blue pen"`},
+		{`"blue pe"* ink`, `"blue pe"* "ink"`},
+		{`name:pen OR NOT`, `"name:pen" "OR" "NOT"`},
+		{`say "hi`, `"say" "hi"`},
+		{`a"b`, `"a" "b"`},
+	}
+
+	for _, tc := range tests {
+		got, err := buildMatchQuery(tc.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %s expected %s", tc.input, got, tc.want)
+		}
+	}
+
+	for _, input := range []string{"", "   ", `""`, "*"} {
+		if _, err := buildMatchQuery(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestSearchIndexFollowsWrites(t *testing.T) {
+	ctx := context.Background()
+	store := setupSearchStore(t)
+	seedProducts(t, store, "Blue Ballpoint Pen", "Red Pen", "Notebook <A5>")
+
+	search := func(query string) []SearchResult {
+		match, err := buildMatchQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := store.Search(ctx, match, 10, 0)
+		if err != nil {
+			t.Fatalf("search %q: %v", query, err)
+		}
+		return page.Items
+	}
+
+	if results := search("pen"); len(results) != 2 {
+		t.Errorf("expected 2 results for pen, got %+v", results)
+	}
+	if results := search(`"ballpoint pen"`); len(results) != 1 || results[0].Product.Name != "Blue Ballpoint Pen" {
+		t.Errorf("unexpected phrase results %+v", results)
+	}
+	if results := search("note*"); len(results) != 1 || results[0].Snippet != "<mark>Notebook</mark> &lt;A5&gt;" {
+		t.Errorf("unexpected prefix results %+v", results)
+	}
+
+	if _, err := store.UpdateByName(ctx, "Red Pen", Product{Name: "Red Marker"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteByName(ctx, "Blue Ballpoint Pen", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if results := search("pen"); len(results) != 0 {
+		t.Errorf("expected the index to drop updated and deleted rows, got %+v", results)
+	}
+	if results := search("marker"); len(results) != 1 {
+		t.Errorf("expected the index to pick up the rename, got %+v", results)
+	}
+
+	// other tenants' catalogs are searched separately
+	if _, err := store.Create(withTenant(ctx, "acme"), Product{Name: "Green Marker"}); err != nil {
+		t.Fatal(err)
+	}
+	if results := search("marker"); len(results) != 1 || results[0].Product.Name != "Red Marker" {
+		t.Errorf("expected only the default tenant's marker, got %+v", results)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLStore is a ProductStore backed by a database/sql connection.
+// Queries are written with ? placeholders and rebound by the dialect.
+type SQLStore struct {
+	db      *sql.DB
+	dialect dialect
+	// searchEnabled is set by EnableSearch once the FTS5 index is in place
+	searchEnabled bool
+}
+
+// NewSQLStore wraps an open database. The schema must already exist.
+func NewSQLStore(db *sql.DB, d dialect) *SQLStore {
+	return &SQLStore{db: db, dialect: d}
+}
+
+// NewSQLiteStore wraps an open mattn/go-sqlite3 database
+func NewSQLiteStore(db *sql.DB) *SQLStore {
+	return NewSQLStore(db, sqliteDialect{})
+}
+
+// NewPostgresStore wraps an open lib/pq database
+func NewPostgresStore(db *sql.DB) *SQLStore {
+	return NewSQLStore(db, postgresDialect{})
+}
+
+// productColumns lists the columns scanProduct expects, in order
+var productColumns = productColumnsOf("")
+
+// productColumnsOf is productColumns qualified with a table alias
+func productColumnsOf(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	return fmt.Sprintf("%[1]sid, %[1]sname, %[1]sdescription, %[1]sprice, %[1]scurrency, COALESCE(%[1]ssku, ''), %[1]screated_at, %[1]supdated_at, %[1]sversion, %[1]sdeleted_at", prefix)
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner, extra ...any) (Product, error) {
+	var product Product
+	var deletedAt sql.NullTime
+	dest := []any{&product.Id, &product.Name, &product.Description, &product.Price, &product.Currency, &product.Sku, &product.CreatedAt, &product.UpdatedAt, &product.Version, &deletedAt}
+	err := row.Scan(append(dest, extra...)...)
+	product.CreatedAt, product.UpdatedAt = product.CreatedAt.UTC(), product.UpdatedAt.UTC()
+	if deletedAt.Valid {
+		deletedAt.Time = deletedAt.Time.UTC()
+		product.DeletedAt = &deletedAt.Time
+	}
+	return product, err
+}
+
+// notDeleted restricts a query to live products
+const notDeleted = " AND deleted_at IS NULL"
+
+// deletedCondition is the WHERE condition selecting products in scope, if any
+func deletedCondition(scope deletedScope) []string {
+	switch scope {
+	case includeDeleted:
+		return nil
+	case onlyDeleted:
+		return []string{"deleted_at IS NOT NULL"}
+	}
+	return []string{"deleted_at IS NULL"}
+}
+
+// querier is satisfied by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *SQLStore) Get(ctx context.Context, id int) (Product, error) {
+	return s.scanOne(ctx, s.db, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND id = ?"+notDeleted, tenantFrom(ctx), id)
+}
+
+func (s *SQLStore) GetByName(ctx context.Context, name string) (Product, error) {
+	return s.scanOne(ctx, s.db, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND name = ?"+notDeleted, tenantFrom(ctx), name)
+}
+
+func (s *SQLStore) List(ctx context.Context, opts ListOptions) (ProductPage, error) {
+	where, args := compileFilters(opts.Filters)
+	where, args = append(where, "tenant_id = ?"), append(args, tenantFrom(ctx))
+	where = append(where, deletedCondition(opts.Deleted)...)
+
+	page := ProductPage{Items: []Product{}}
+	if err := s.db.QueryRowContext(ctx, s.rebind("SELECT COUNT(*) FROM products"+whereClause(where)), s.bind(args)...).Scan(&page.Total); err != nil {
+		return ProductPage{}, err
+	}
+
+	keys := sortKeys(opts)
+	if len(opts.After) > 0 {
+		keyset, keysetArgs := compileKeyset(keys, opts.After)
+		where = append(where, keyset)
+		args = append(args, keysetArgs...)
+	}
+
+	query := "SELECT " + productColumns + " FROM products" + whereClause(where) + " ORDER BY " + compileOrder(keys)
+	if opts.Limit > 0 {
+		// one extra row tells us whether another page follows
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, opts.Limit+1, opts.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), s.bind(args)...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return ProductPage{}, err
+		}
+		page.Items = append(page.Items, product)
+	}
+	if err := rows.Err(); err != nil {
+		return ProductPage{}, err
+	}
+
+	if opts.Limit > 0 && len(page.Items) > opts.Limit {
+		page.Items = page.Items[:opts.Limit]
+		page.HasMore = true
+	}
+	return page, nil
+}
+
+func (s *SQLStore) Each(ctx context.Context, opts ListOptions, fn func(Product) error) error {
+	where, args := compileFilters(opts.Filters)
+	where, args = append(where, "tenant_id = ?"), append(args, tenantFrom(ctx))
+	where = append(where, deletedCondition(opts.Deleted)...)
+	query := "SELECT " + productColumns + " FROM products" + whereClause(where) + " ORDER BY " + compileOrder(sortKeys(opts))
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), s.bind(args)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) Create(ctx context.Context, product Product) (Product, error) {
+	var created Product
+	err := s.inTx(ctx, func(tx *sql.Tx) (err error) {
+		created, err = s.create(ctx, tx, product)
+		return err
+	})
+	return created, err
+}
+
+func (s *SQLStore) create(ctx context.Context, q querier, product Product) (Product, error) {
+	timestamp := now()
+
+	var id int
+	err := q.QueryRowContext(ctx, s.rebind(`INSERT INTO products (tenant_id, name, description, price, currency, sku, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?) RETURNING id`),
+		s.bind([]any{tenantFrom(ctx), product.Name, product.Description, product.Price, product.Currency, product.Sku, timestamp, timestamp})...).Scan(&id)
+	if err != nil {
+		return Product{}, s.translate(err)
+	}
+
+	created, err := s.scanOne(ctx, q, "SELECT "+productColumns+" FROM products WHERE id = ?", id)
+	if err != nil {
+		return Product{}, err
+	}
+	return created, s.audit(ctx, q, auditCreate, nil, &created)
+}
+
+func (s *SQLStore) Update(ctx context.Context, id int, product Product) (Product, error) {
+	return s.updateTx(ctx, "id = ?", id, product)
+}
+
+func (s *SQLStore) UpdateByName(ctx context.Context, name string, product Product) (Product, error) {
+	return s.updateTx(ctx, "name = ?", name, product)
+}
+
+func (s *SQLStore) updateTx(ctx context.Context, where string, key any, product Product) (Product, error) {
+	var updated Product
+	err := s.inTx(ctx, func(tx *sql.Tx) (err error) {
+		updated, err = s.update(ctx, tx, where, key, product)
+		return err
+	})
+	return updated, err
+}
+
+func (s *SQLStore) Patch(ctx context.Context, id int, apply func(Product) (Product, error)) (Product, error) {
+	var patched Product
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := s.scanOne(ctx, tx, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND id = ?"+notDeleted+s.dialect.ForUpdate(), tenantFrom(ctx), id)
+		if err != nil {
+			return err
+		}
+		product, err := apply(current)
+		if err != nil {
+			return err
+		}
+		product.Version = current.Version
+		patched, err = s.update(ctx, tx, "id = ?", id, product)
+		return err
+	})
+	return patched, err
+}
+
+// update replaces every writable field of the live row matching where and
+// records the change. The version check is repeated in the statement so no
+// other write can slip in between reading and updating.
+func (s *SQLStore) update(ctx context.Context, q querier, where string, key any, product Product) (Product, error) {
+	before, err := s.lockLive(ctx, q, where, key, product.Version)
+	if err != nil {
+		return Product{}, err
+	}
+
+	result, err := q.ExecContext(ctx, s.rebind(`UPDATE products
+		SET name = ?, description = ?, price = ?, currency = ?, sku = NULLIF(?, ''), updated_at = ?, version = version + 1
+		WHERE id = ? AND version = ?`),
+		s.bind([]any{product.Name, product.Description, product.Price, product.Currency, product.Sku, now(), before.Id, before.Version})...)
+	if err := s.checkWritten(result, err); err != nil {
+		return Product{}, err
+	}
+
+	after, err := s.scanOne(ctx, q, "SELECT "+productColumns+" FROM products WHERE id = ?", before.Id)
+	if err != nil {
+		return Product{}, err
+	}
+	return after, s.audit(ctx, q, auditUpdate, &before, &after)
+}
+
+func (s *SQLStore) Delete(ctx context.Context, id int, version int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.delete(ctx, tx, "id = ?", id, version)
+	})
+}
+
+func (s *SQLStore) DeleteByName(ctx context.Context, name string, version int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.delete(ctx, tx, "name = ?", name, version)
+	})
+}
+
+func (s *SQLStore) delete(ctx context.Context, q querier, where string, key any, version int64) error {
+	before, err := s.lockLive(ctx, q, where, key, version)
+	if err != nil {
+		return err
+	}
+
+	result, err := q.ExecContext(ctx, s.rebind("UPDATE products SET deleted_at = ?, version = version + 1 WHERE id = ? AND version = ?"),
+		s.bind([]any{now(), before.Id, before.Version})...)
+	if err := s.checkWritten(result, err); err != nil {
+		return err
+	}
+
+	after, err := s.scanOne(ctx, q, "SELECT "+productColumns+" FROM products WHERE id = ?", before.Id)
+	if err != nil {
+		return err
+	}
+	return s.audit(ctx, q, auditDelete, &before, &after)
+}
+
+func (s *SQLStore) Restore(ctx context.Context, id int, version int64) (Product, error) {
+	var restored Product
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		before, err := s.scanOne(ctx, tx, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND id = ? AND deleted_at IS NOT NULL"+s.dialect.ForUpdate(), tenantFrom(ctx), id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && before.Version != version {
+			return ErrVersionMismatch
+		}
+
+		result, err := tx.ExecContext(ctx, s.rebind("UPDATE products SET deleted_at = NULL, version = version + 1 WHERE id = ? AND version = ?"), id, before.Version)
+		if err := s.checkWritten(result, err); err != nil {
+			return err
+		}
+
+		restored, err = s.scanOne(ctx, tx, "SELECT "+productColumns+" FROM products WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return s.audit(ctx, tx, auditRestore, &before, &restored)
+	})
+	return restored, err
+}
+
+func (s *SQLStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, s.rebind("SELECT "+productColumns+", tenant_id FROM products WHERE deleted_at IS NOT NULL AND deleted_at < ?"+s.dialect.ForUpdate()), s.bind([]any{before})...)
+		if err != nil {
+			return err
+		}
+		var products []Product
+		var tenants []string
+		for rows.Next() {
+			var tenant string
+			product, err := scanProduct(rows, &tenant)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			products = append(products, product)
+			tenants = append(tenants, tenant)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i, product := range products {
+			if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM products WHERE id = ?"), product.Id); err != nil {
+				return err
+			}
+			// each purge lands in the history of the tenant that owned it
+			if err := s.audit(withTenant(ctx, tenants[i]), tx, auditPurge, &product, nil); err != nil {
+				return err
+			}
+		}
+		purged = int64(len(products))
+		return nil
+	})
+	return purged, err
+}
+
+// lockLive reads the live row of the tenant of ctx matching where for a
+// write, locking it where the backend can, and checks it has the version the
+// write expects
+func (s *SQLStore) lockLive(ctx context.Context, q querier, where string, key any, version int64) (Product, error) {
+	product, err := s.scanOne(ctx, q, "SELECT "+productColumns+" FROM products WHERE tenant_id = ? AND "+where+notDeleted+s.dialect.ForUpdate(), tenantFrom(ctx), key)
+	if err != nil {
+		return Product{}, err
+	}
+	if version != 0 && product.Version != version {
+		return Product{}, ErrVersionMismatch
+	}
+	return product, nil
+}
+
+// checkWritten maps the outcome of a single-row write to the store errors.
+// The row was read in the same transaction, so a write that matched nothing
+// lost a race with another writer.
+func (s *SQLStore) checkWritten(result sql.Result, err error) error {
+	if err := s.checkAffected(result, err); errors.Is(err, ErrProductNotFound) {
+		return ErrVersionMismatch
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) scanOne(ctx context.Context, q querier, query string, args ...any) (Product, error) {
+	product, err := scanProduct(q.QueryRowContext(ctx, s.rebind(query), s.bind(args)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrProductNotFound
+	}
+	return product, err
+}
+
+// inTx runs fn in a transaction, committing only if it succeeds
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkAffected maps the outcome of a single-row write to the store errors
+func (s *SQLStore) checkAffected(result sql.Result, err error) error {
+	if err != nil {
+		return s.translate(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) rebind(query string) string {
+	return s.dialect.Rebind(query)
+}
+
+// bind converts arguments the driver cannot store faithfully on its own
+func (s *SQLStore) bind(args []any) []any {
+	bound := make([]any, len(args))
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			arg = s.dialect.TimeValue(t)
+		}
+		bound[i] = arg
+	}
+	return bound
+}
+
+func (s *SQLStore) translate(err error) error {
+	if column, ok := s.dialect.UniqueViolation(err); ok {
+		return &ConflictError{Field: column}
+	}
+	return err
+}
+
+var comparisonOperators = map[string]string{"eq": "=", "ne": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// compileFilters renders filters as parameterized conditions. Column names
+// only ever come from productFields, never from the request.
+func compileFilters(filters []Filter) ([]string, []any) {
+	var conditions []string
+	var args []any
+
+	for _, filter := range filters {
+		column := productFields[filter.Field].Column
+
+		switch filter.Op {
+		case "contains":
+			conditions = append(conditions, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(strings.ToLower(filter.Value.(string)))+"%")
+		case "prefix":
+			conditions = append(conditions, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+			args = append(args, escapeLike(strings.ToLower(filter.Value.(string)))+"%")
+		case "in":
+			values := filter.Value.([]any)
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+			conditions = append(conditions, column+" IN ("+placeholders+")")
+			args = append(args, values...)
+		default:
+			conditions = append(conditions, column+" "+comparisonOperators[filter.Op]+" ?")
+			args = append(args, filter.Value)
+		}
+	}
+
+	return conditions, args
+}
+
+// compileKeyset selects the rows that sort strictly after the given key values
+func compileKeyset(keys []SortKey, after []any) (string, []any) {
+	var branches []string
+	var args []any
+
+	for i, key := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, productFields[keys[j].Field].Column+" = ?")
+			args = append(args, after[j])
+		}
+
+		operator := " > ?"
+		if key.Desc {
+			operator = " < ?"
+		}
+		parts = append(parts, productFields[key.Field].Column+operator)
+		args = append(args, after[i])
+
+		branches = append(branches, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return "(" + strings.Join(branches, " OR ") + ")", args
+}
+
+func compileOrder(keys []SortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = productFields[key.Field].Column + " ASC"
+		if key.Desc {
+			parts[i] = productFields[key.Field].Column + " DESC"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+}
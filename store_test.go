@@ -0,0 +1,923 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeFactories lists every ProductStore implementation the contract tests run against.
+// PostgreSQL is only included when TEST_DATABASE_URL points at a disposable database.
+func storeFactories() map[string]func(t *testing.T) ProductStore {
+	factories := map[string]func(t *testing.T) ProductStore{
+		"sqlite": setupTestStore,
+		"memory": func(t *testing.T) ProductStore { return NewMemoryStore() },
+	}
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		factories["postgres"] = setupPostgresStore
+	}
+	return factories
+}
+
+func setupPostgresStore(t *testing.T) ProductStore {
+	db, err := sql.Open("postgres", os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("failed to open postgres test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatalf("failed to reset postgres test db: %v", err)
+	}
+	migrateTestDB(t, db, postgresDialect{})
+	return NewPostgresStore(db)
+}
+
+func TestPostgresRebind(t *testing.T) {
+	got := postgresDialect{}.Rebind("UPDATE products SET name = ? WHERE id = ?")
+	want := "UPDATE products SET name = $1 WHERE id = $2"
+	if got != want {
+		t.Errorf("expected %q but got %q", want, got)
+	}
+}
+
+func TestProductStoreContract(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			created, err := store.Create(ctx, Product{Name: "Kettle"})
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			if created.Id == 0 || created.Name != "Kettle" {
+				t.Fatalf("unexpected created product %+v", created)
+			}
+
+			if _, err := store.Create(ctx, Product{Name: "Kettle"}); !errors.Is(err, ErrProductConflict) {
+				t.Errorf("expected ErrProductConflict on duplicate create, got %v", err)
+			}
+
+			got, err := store.Get(ctx, created.Id)
+			if err != nil || got != created {
+				t.Errorf("get: got %+v, %v", got, err)
+			}
+
+			other, err := store.Create(ctx, Product{Name: "Toaster"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Update(ctx, other.Id, Product{Name: "Kettle"}); !errors.Is(err, ErrProductConflict) {
+				t.Errorf("expected ErrProductConflict on rename to taken name, got %v", err)
+			}
+
+			updated, err := store.UpdateByName(ctx, "Toaster", Product{Name: "Grill"})
+			if err != nil || updated.Id != other.Id || updated.Name != "Grill" {
+				t.Errorf("update by name: got %+v, %v", updated, err)
+			}
+
+			if _, err := store.Update(ctx, 9999, Product{Name: "Ghost"}); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("expected ErrProductNotFound on missing update, got %v", err)
+			}
+
+			page, err := store.List(ctx, ListOptions{})
+			if err != nil || len(page.Items) != 2 || page.Total != 2 {
+				t.Fatalf("list: got %+v, %v", page, err)
+			}
+
+			if err := store.Delete(ctx, created.Id, 0); err != nil {
+				t.Errorf("delete: %v", err)
+			}
+			if err := store.DeleteByName(ctx, "Grill", 0); err != nil {
+				t.Errorf("delete by name: %v", err)
+			}
+			if err := store.Delete(ctx, created.Id, 0); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("expected ErrProductNotFound on second delete, got %v", err)
+			}
+			if _, err := store.GetByName(ctx, "Grill"); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("expected ErrProductNotFound after delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProductStorePagination(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			seedProducts(t, store, "A", "B", "C", "D", "E")
+
+			page, err := store.List(ctx, ListOptions{Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Items) != 2 || !page.HasMore || page.Total != 5 {
+				t.Fatalf("first page: %+v", page)
+			}
+
+			page, err = store.List(ctx, ListOptions{Limit: 2, After: []any{page.Items[1].Id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Items) != 2 || page.Items[0].Name != "C" || !page.HasMore {
+				t.Fatalf("cursor page: %+v", page)
+			}
+
+			page, err = store.List(ctx, ListOptions{Limit: 2, Offset: 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Items) != 1 || page.Items[0].Name != "E" || page.HasMore {
+				t.Fatalf("last offset page: %+v", page)
+			}
+		})
+	}
+}
+
+func TestProductStoreFilterAndSort(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			seedProducts(t, store, "Blue Pen", "Red Pen", "Pencil", "Notebook", "100% Cotton", "Pen_Holder")
+
+			cases := []struct {
+				name  string
+				opts  ListOptions
+				want  string
+				total int
+			}{
+				{"contains ignores case", ListOptions{Filters: []Filter{{"name", "contains", "PEN"}}}, "Blue Pen,Red Pen,Pencil,Pen_Holder", 4},
+				{"prefix", ListOptions{Filters: []Filter{{"name", "prefix", "pen"}}}, "Pencil,Pen_Holder", 2},
+				{"like wildcards are literal", ListOptions{Filters: []Filter{{"name", "contains", "%"}}}, "100% Cotton", 1},
+				{"underscore is literal", ListOptions{Filters: []Filter{{"name", "prefix", "pen_"}}}, "Pen_Holder", 1},
+				{"id range", ListOptions{Filters: []Filter{{"id", "gte", 2}, {"id", "lt", 4}}}, "Red Pen,Pencil", 2},
+				{"in", ListOptions{Filters: []Filter{{"id", "in", []any{1, 4}}}}, "Blue Pen,Notebook", 2},
+				{"sort descending", ListOptions{Sort: []SortKey{{Field: "name", Desc: true}}, Limit: 3}, "Red Pen,Pencil,Pen_Holder", 6},
+				{"keyset after sorted value", ListOptions{Sort: []SortKey{{Field: "name"}}, After: []any{"Notebook", 4}}, "Pen_Holder,Pencil,Red Pen", 6},
+			}
+
+			for _, tc := range cases {
+				page, err := store.List(ctx, tc.opts)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+
+				var names []string
+				for _, product := range page.Items {
+					names = append(names, product.Name)
+				}
+				if got := strings.Join(names, ","); got != tc.want || page.Total != tc.total {
+					t.Errorf("%s: got %q (total %d), expected %q (total %d)", tc.name, got, page.Total, tc.want, tc.total)
+				}
+			}
+		})
+	}
+}
+
+func TestProductStoreDetails(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			created, err := store.Create(ctx, Product{Name: "Mug", Description: "Stoneware", Price: 850, Currency: "GBP", Sku: "MUG-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.CreatedAt.IsZero() || created.CreatedAt.Location() != time.UTC {
+				t.Errorf("expected a UTC created_at, got %v", created.CreatedAt)
+			}
+
+			got, err := store.Get(ctx, created.Id)
+			if err != nil || !reflect.DeepEqual(got, created) {
+				t.Errorf("get: got %+v, %v, expected %+v", got, err, created)
+			}
+
+			// several products may leave sku empty
+			for _, productName := range []string{"Plate", "Bowl"} {
+				if _, err := store.Create(ctx, Product{Name: productName}); err != nil {
+					t.Fatalf("create %s without sku: %v", productName, err)
+				}
+			}
+
+			_, err = store.Create(ctx, Product{Name: "Cup", Sku: "MUG-1"})
+			if !errors.Is(err, ErrProductConflict) || conflictField(err) != "sku" {
+				t.Errorf("expected a sku conflict, got %v", err)
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			updated, err := store.Update(ctx, created.Id, Product{Name: "Mug", Price: 900, Currency: "GBP"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !updated.CreatedAt.Equal(created.CreatedAt) || !updated.UpdatedAt.After(created.UpdatedAt) {
+				t.Errorf("expected created_at kept and updated_at bumped, got %+v", updated)
+			}
+			if updated.Sku != "" || updated.Description != "" {
+				t.Errorf("expected replaced fields to be cleared, got %+v", updated)
+			}
+
+			page, err := store.List(ctx, ListOptions{Filters: []Filter{{"price", "gte", 100}, {"created_at", "gte", created.CreatedAt}}})
+			if err != nil || len(page.Items) != 1 || page.Items[0].Id != created.Id {
+				t.Errorf("filter on price and created_at: got %+v, %v", page, err)
+			}
+		})
+	}
+}
+
+func TestProductStorePatch(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			created, err := store.Create(ctx, Product{Name: "Lamp", Description: "Brass", Price: 4000, Currency: "EUR"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Create(ctx, Product{Name: "Shade"}); err != nil {
+				t.Fatal(err)
+			}
+
+			patched, err := store.Patch(ctx, created.Id, func(p Product) (Product, error) {
+				p.Price = 3500
+				return p, nil
+			})
+			if err != nil || patched.Price != 3500 || patched.Description != "Brass" {
+				t.Errorf("patch price: got %+v, %v", patched, err)
+			}
+
+			// an error from apply leaves the row untouched
+			applyErr := errors.New("rejected")
+			_, err = store.Patch(ctx, created.Id, func(p Product) (Product, error) {
+				return Product{}, applyErr
+			})
+			if !errors.Is(err, applyErr) {
+				t.Errorf("expected the apply error back, got %v", err)
+			}
+
+			_, err = store.Patch(ctx, created.Id, func(p Product) (Product, error) {
+				p.Name = "Shade"
+				return p, nil
+			})
+			if !errors.Is(err, ErrProductConflict) {
+				t.Errorf("expected a conflict, got %v", err)
+			}
+
+			got, err := store.Get(ctx, created.Id)
+			if err != nil || got.Name != "Lamp" || got.Price != 3500 {
+				t.Errorf("after failed patches: got %+v, %v", got, err)
+			}
+
+			_, err = store.Patch(ctx, 999, func(p Product) (Product, error) { return p, nil })
+			if !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("expected not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProductStoreVersions(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			created, err := store.Create(ctx, Product{Name: "Chair"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Version != 1 {
+				t.Errorf("expected version 1 on create, got %d", created.Version)
+			}
+
+			updated, err := store.Update(ctx, created.Id, Product{Name: "Armchair", Version: 1})
+			if err != nil || updated.Version != 2 {
+				t.Fatalf("conditional update: got %+v, %v", updated, err)
+			}
+
+			if _, err := store.Update(ctx, created.Id, Product{Name: "Stool", Version: 1}); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("stale update: expected a version mismatch, got %v", err)
+			}
+			if _, err := store.UpdateByName(ctx, "Armchair", Product{Name: "Stool", Version: 1}); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("stale update by name: expected a version mismatch, got %v", err)
+			}
+			if _, err := store.Update(ctx, 999, Product{Name: "Ghost", Version: 1}); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("missing product: expected not found, got %v", err)
+			}
+
+			// unconditional writes still bump the version
+			patched, err := store.Patch(ctx, created.Id, func(p Product) (Product, error) {
+				p.Description = "Upholstered"
+				p.Version = 42
+				return p, nil
+			})
+			if err != nil || patched.Version != 3 {
+				t.Fatalf("patch: got %+v, %v", patched, err)
+			}
+
+			if err := store.Delete(ctx, created.Id, 2); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("stale delete: expected a version mismatch, got %v", err)
+			}
+			if err := store.DeleteByName(ctx, "Armchair", 2); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("stale delete by name: expected a version mismatch, got %v", err)
+			}
+			if err := store.Delete(ctx, created.Id, 3); err != nil {
+				t.Errorf("conditional delete: %v", err)
+			}
+			if err := store.Delete(ctx, created.Id, 3); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("deleted product: expected not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			keys, ok := newStore(t).(IdempotencyStore)
+			if !ok {
+				t.Fatal("store does not implement IdempotencyStore")
+			}
+			expiresAt := now().Add(time.Hour)
+
+			if _, reserved, err := keys.ReserveIdempotencyKey(ctx, "k1", "hash-a", expiresAt); err != nil || !reserved {
+				t.Fatalf("first reserve: reserved=%v, %v", reserved, err)
+			}
+
+			existing, reserved, err := keys.ReserveIdempotencyKey(ctx, "k1", "hash-b", expiresAt)
+			if err != nil || reserved || existing.RequestHash != "hash-a" || existing.Status != 0 {
+				t.Fatalf("reserve while in progress: got %+v, reserved=%v, %v", existing, reserved, err)
+			}
+
+			header := http.Header{"Etag": {`"1"`}}
+			if err := keys.CompleteIdempotencyKey(ctx, "k1", http.StatusCreated, header, []byte(`{"id":1}`)); err != nil {
+				t.Fatal(err)
+			}
+			existing, _, err = keys.ReserveIdempotencyKey(ctx, "k1", "hash-a", expiresAt)
+			if err != nil || existing.Status != http.StatusCreated || string(existing.Body) != `{"id":1}` || existing.Header.Get("ETag") != `"1"` {
+				t.Errorf("reserve after completion: got %+v, %v", existing, err)
+			}
+
+			if err := keys.ReleaseIdempotencyKey(ctx, "k1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, reserved, err := keys.ReserveIdempotencyKey(ctx, "k1", "hash-b", expiresAt); err != nil || !reserved {
+				t.Errorf("reserve after release: reserved=%v, %v", reserved, err)
+			}
+
+			// an expired key is taken over by the next request
+			if _, _, err := keys.ReserveIdempotencyKey(ctx, "k2", "hash-a", now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, reserved, err := keys.ReserveIdempotencyKey(ctx, "k2", "hash-b", expiresAt); err != nil || !reserved {
+				t.Errorf("reserve expired key: reserved=%v, %v", reserved, err)
+			}
+
+			if _, _, err := keys.ReserveIdempotencyKey(ctx, "k3", "hash-a", now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			swept, err := keys.SweepIdempotencyKeys(ctx, now())
+			if err != nil || swept != 1 {
+				t.Errorf("sweep: got %d, %v expected 1", swept, err)
+			}
+		})
+	}
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			keys, ok := newStore(t).(APIKeyStore)
+			if !ok {
+				t.Fatal("store does not implement APIKeyStore")
+			}
+
+			created, err := keys.CreateAPIKey(ctx, APIKey{Name: "ci", Hash: "hash-a", Roles: []string{roleViewer, roleEditor}})
+			if err != nil || created.Id == 0 || created.CreatedAt.IsZero() {
+				t.Fatalf("create: got %+v, %v", created, err)
+			}
+			if _, err := keys.CreateAPIKey(ctx, APIKey{Name: "ci", Hash: "hash-a", Roles: []string{roleViewer}}); err == nil {
+				t.Error("expected a duplicate hash to be rejected")
+			}
+
+			found, err := keys.APIKeyByHash(ctx, "hash-a")
+			if err != nil || found.Id != created.Id || !reflect.DeepEqual(found.Roles, []string{roleViewer, roleEditor}) {
+				t.Errorf("by hash: got %+v, %v", found, err)
+			}
+			if _, err := keys.APIKeyByHash(ctx, "hash-b"); !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("unknown hash: expected ErrAPIKeyNotFound, got %v", err)
+			}
+
+			if err := keys.RevokeAPIKey(ctx, created.Id); err != nil {
+				t.Fatal(err)
+			}
+			if err := keys.RevokeAPIKey(ctx, created.Id); !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("revoke twice: expected ErrAPIKeyNotFound, got %v", err)
+			}
+			if _, err := keys.APIKeyByHash(ctx, "hash-a"); !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("revoked key: expected ErrAPIKeyNotFound, got %v", err)
+			}
+
+			list, err := keys.ListAPIKeys(ctx)
+			if err != nil || len(list) != 1 || list[0].RevokedAt == nil {
+				t.Errorf("list: got %+v, %v", list, err)
+			}
+		})
+	}
+}
+
+func TestProductStoreEach(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			for i, name := range []string{"Kettle", "Teapot", "Mug", "Toaster"} {
+				if _, err := store.Create(ctx, Product{Name: name, Price: int64(i * 100), Currency: "EUR"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// paging options are ignored
+			opts := ListOptions{
+				Filters: []Filter{{Field: "price", Op: "gte", Value: 100}},
+				Sort:    []SortKey{{Field: "name"}},
+				Limit:   1,
+				Offset:  1,
+			}
+			var names []string
+			err := store.Each(ctx, opts, func(product Product) error {
+				names = append(names, product.Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(names, ","); got != "Mug,Teapot,Toaster" {
+				t.Errorf("got %q", got)
+			}
+
+			stop := errors.New("stop")
+			calls := 0
+			err = store.Each(ctx, ListOptions{}, func(product Product) error {
+				calls++
+				return stop
+			})
+			if !errors.Is(err, stop) || calls != 1 {
+				t.Errorf("expected the first error to stop the iteration, got %v after %d calls", err, calls)
+			}
+		})
+	}
+}
+
+func TestProductStoreSoftDelete(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			kettle, err := store.Create(ctx, Product{Name: "Kettle", Sku: "KTL-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete(ctx, kettle.Id, kettle.Version); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+
+			if _, err := store.Get(ctx, kettle.Id); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("get of a deleted product: expected ErrProductNotFound, got %v", err)
+			}
+			if _, err := store.GetByName(ctx, "Kettle"); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("get by name of a deleted product: expected ErrProductNotFound, got %v", err)
+			}
+			if _, err := store.Update(ctx, kettle.Id, Product{Name: "Kettle"}); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("update of a deleted product: expected ErrProductNotFound, got %v", err)
+			}
+			if err := store.Delete(ctx, kettle.Id, 0); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("second delete: expected ErrProductNotFound, got %v", err)
+			}
+
+			for scope, want := range map[deletedScope]int{excludeDeleted: 0, includeDeleted: 1, onlyDeleted: 1} {
+				page, err := store.List(ctx, ListOptions{Deleted: scope})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != want || len(page.Items) != want {
+					t.Errorf("scope %d: expected %d products, got %+v", scope, want, page)
+				}
+				if want == 1 && (page.Items[0].DeletedAt == nil || page.Items[0].Version != 2) {
+					t.Errorf("scope %d: expected the deleted product at version 2, got %+v", scope, page.Items[0])
+				}
+			}
+
+			// the name and sku are free while the product is in the trash
+			replacement, err := store.Create(ctx, Product{Name: "Kettle", Sku: "KTL-1"})
+			if err != nil {
+				t.Fatalf("create with a deleted product's name: %v", err)
+			}
+			if _, err := store.Restore(ctx, kettle.Id, 0); !errors.Is(err, ErrProductConflict) {
+				t.Errorf("restore over a live name: expected ErrProductConflict, got %v", err)
+			}
+			if err := store.Delete(ctx, replacement.Id, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.Restore(ctx, kettle.Id, 1); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("restore with a stale version: expected ErrVersionMismatch, got %v", err)
+			}
+			restored, err := store.Restore(ctx, kettle.Id, 2)
+			if err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			if restored.DeletedAt != nil || restored.Version != 3 || restored.Name != "Kettle" {
+				t.Errorf("unexpected restored product %+v", restored)
+			}
+			if _, err := store.Restore(ctx, kettle.Id, 0); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("restore of a live product: expected ErrProductNotFound, got %v", err)
+			}
+
+			purged, err := store.Purge(ctx, now().Add(-time.Hour))
+			if err != nil || purged != 0 {
+				t.Errorf("purge before the deletion: expected nothing purged, got %d, %v", purged, err)
+			}
+			purged, err = store.Purge(ctx, now().Add(time.Second))
+			if err != nil || purged != 1 {
+				t.Errorf("purge: expected the replacement purged, got %d, %v", purged, err)
+			}
+			if _, err := store.Restore(ctx, replacement.Id, 0); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("restore of a purged product: expected ErrProductNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProductStoreHistory(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := withAuditInfo(context.Background(), auditInfo{Actor: "alice", RequestId: "req-1"})
+			store := newStore(t)
+
+			kettle, err := store.Create(ctx, Product{Name: "Kettle"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Update(ctx, kettle.Id, Product{Name: "Steel kettle"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Update(ctx, kettle.Id, Product{Name: "Kettle", Version: 1}); !errors.Is(err, ErrVersionMismatch) {
+				t.Fatalf("expected a stale update to fail, got %v", err)
+			}
+			if err := store.Delete(ctx, kettle.Id, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Restore(ctx, kettle.Id, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete(ctx, kettle.Id, 0); err != nil {
+				t.Fatal(err)
+			}
+			// writes outside a request are attributed to the system
+			if _, err := store.Purge(context.Background(), now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			page, err := store.History(ctx, kettle.Id, HistoryOptions{})
+			if err != nil {
+				t.Fatalf("history: %v", err)
+			}
+			var entries []string
+			for _, record := range page.Items {
+				entries = append(entries, fmt.Sprintf("%s:%d:%s", record.Action, record.Version, record.Actor))
+				if record.ProductId != kettle.Id || (record.Actor == "alice" && record.RequestId != "req-1") {
+					t.Errorf("unexpected record %+v", record)
+				}
+			}
+			want := "purge:5:system,delete:5:alice,restore:4:alice,delete:3:alice,update:2:alice,create:1:alice"
+			if got := strings.Join(entries, ","); got != want {
+				t.Errorf("got history %s expected %s", got, want)
+			}
+
+			update := page.Items[4]
+			if update.Before == nil || update.Before.Name != "Kettle" || update.After == nil || update.After.Name != "Steel kettle" {
+				t.Errorf("expected the update to hold both sides, got %+v", update)
+			}
+			if page.Items[5].Before != nil || page.Items[0].After != nil || page.Items[0].Before.DeletedAt == nil {
+				t.Errorf("unexpected create or purge records %+v %+v", page.Items[5], page.Items[0])
+			}
+
+			first, err := store.History(ctx, kettle.Id, HistoryOptions{Limit: 4})
+			if err != nil || len(first.Items) != 4 || !first.HasMore {
+				t.Fatalf("expected a first page of 4 with more to follow, got %+v, %v", first, err)
+			}
+			rest, err := store.History(ctx, kettle.Id, HistoryOptions{Limit: 4, Before: first.Items[3].Id})
+			if err != nil || len(rest.Items) != 2 || rest.HasMore || rest.Items[1].Action != auditCreate {
+				t.Errorf("expected the last 2 entries, got %+v, %v", rest, err)
+			}
+
+			if _, err := store.History(ctx, 99, HistoryOptions{}); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("history of an unknown product: expected ErrProductNotFound, got %v", err)
+			}
+
+			// an atomic batch that fails leaves no trace
+			chair, err := store.Create(ctx, Product{Name: "Chair"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.Batch(ctx, []BatchOperation{
+				{Op: batchUpdate, Id: chair.Id, Product: &Product{Name: "Stool"}},
+				{Op: batchDelete, Id: 99},
+			}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err = store.History(ctx, chair.Id, HistoryOptions{})
+			if err != nil || len(page.Items) != 1 {
+				t.Errorf("expected only the create to be recorded, got %+v, %v", page, err)
+			}
+		})
+	}
+}
+
+func TestProductStoreRevisions(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			beforeCreate := now()
+			lamp, err := store.Create(ctx, Product{Name: "Lamp", Price: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			afterCreate := now()
+			if _, err := store.Update(ctx, lamp.Id, Product{Name: "Desk lamp", Price: 150}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete(ctx, lamp.Id, 0); err != nil {
+				t.Fatal(err)
+			}
+			afterDelete := now()
+
+			first, err := store.Revision(ctx, lamp.Id, 1)
+			if err != nil || first.Name != "Lamp" || first.Price != 100 || first.Version != 1 {
+				t.Errorf("revision 1: got %+v, %v", first, err)
+			}
+			deleted, err := store.Revision(ctx, lamp.Id, 3)
+			if err != nil || deleted.Name != "Desk lamp" || deleted.DeletedAt == nil {
+				t.Errorf("revision 3: got %+v, %v", deleted, err)
+			}
+			if _, err := store.Revision(ctx, lamp.Id, 4); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("revision 4: expected ErrProductNotFound, got %v", err)
+			}
+
+			if _, err := store.RevisionAt(ctx, lamp.Id, beforeCreate); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("before create: expected ErrProductNotFound, got %v", err)
+			}
+			if product, err := store.RevisionAt(ctx, lamp.Id, afterCreate); err != nil || product.Version != 1 {
+				t.Errorf("after create: got %+v, %v", product, err)
+			}
+			if product, err := store.RevisionAt(ctx, lamp.Id, afterDelete); err != nil || product.Version != 3 || product.DeletedAt == nil {
+				t.Errorf("after delete: got %+v, %v", product, err)
+			}
+
+			if _, err := store.Purge(ctx, now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.RevisionAt(ctx, lamp.Id, now()); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("after purge: expected ErrProductNotFound, got %v", err)
+			}
+			// earlier revisions outlive the product
+			if product, err := store.Revision(ctx, lamp.Id, 2); err != nil || product.Name != "Desk lamp" {
+				t.Errorf("revision 2 after purge: got %+v, %v", product, err)
+			}
+		})
+	}
+}
+
+func TestProductStoreBatch(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			existing, err := store.Create(ctx, Product{Name: "Sofa"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ops := []BatchOperation{
+				{Op: batchCreate, Product: &Product{Name: "Rug"}},
+				{Op: batchUpdate, Id: existing.Id, Version: 1, Product: &Product{Name: "Couch"}},
+				{Op: batchCreate, Product: &Product{Name: "Rug"}},
+				{Op: batchDelete, Id: 999},
+				{Op: batchUpdate, Id: existing.Id, Version: 1, Product: &Product{Name: "Settee"}},
+			}
+
+			// atomic: the duplicate Rug stops the batch and undoes the rest
+			results, err := store.Batch(ctx, ops, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Err != nil || !errors.Is(results[2].Err, ErrProductConflict) || results[3].Err != nil {
+				t.Errorf("atomic results: %+v", results)
+			}
+			page, err := store.List(ctx, ListOptions{})
+			if err != nil || page.Total != 1 || page.Items[0].Name != "Sofa" {
+				t.Fatalf("after a failed atomic batch: got %+v, %v", page.Items, err)
+			}
+
+			// partial: each operation stands on its own
+			results, err = store.Batch(ctx, ops, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Err != nil || results[0].Product.Name != "Rug" {
+				t.Errorf("create: got %+v", results[0])
+			}
+			if results[1].Err != nil || results[1].Product.Name != "Couch" || results[1].Product.Version != 2 {
+				t.Errorf("update: got %+v", results[1])
+			}
+			if !errors.Is(results[2].Err, ErrProductConflict) || conflictField(results[2].Err) != "name" {
+				t.Errorf("duplicate create: got %+v", results[2])
+			}
+			if !errors.Is(results[3].Err, ErrProductNotFound) {
+				t.Errorf("missing delete: got %+v", results[3])
+			}
+			if !errors.Is(results[4].Err, ErrVersionMismatch) {
+				t.Errorf("stale update: got %+v", results[4])
+			}
+
+			page, err = store.List(ctx, ListOptions{})
+			if err != nil || page.Total != 2 {
+				t.Errorf("after a partial batch: got %+v, %v", page.Items, err)
+			}
+
+			// the store stays usable for new rows after a rollback
+			if _, err := store.Create(ctx, Product{Name: "Ottoman"}); err != nil {
+				t.Errorf("create after batches: %v", err)
+			}
+		})
+	}
+}
+
+func TestProductStoreTenantIsolation(t *testing.T) {
+	for name, newStore := range storeFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			acme := withTenant(context.Background(), "acme")
+			globex := withTenant(context.Background(), "globex")
+
+			// names and skus are unique per tenant only
+			ours, err := store.Create(acme, Product{Name: "Kettle", Sku: "KT-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			theirs, err := store.Create(globex, Product{Name: "Kettle", Sku: "KT-1"})
+			if err != nil {
+				t.Fatalf("another tenant should be free to use the same name and sku: %v", err)
+			}
+			if _, err := store.Create(acme, Product{Name: "Kettle"}); conflictField(err) != "name" || !errors.Is(err, ErrProductConflict) {
+				t.Errorf("expected a name conflict within a tenant, got %v", err)
+			}
+			if _, err := store.Create(acme, Product{Name: "Toaster", Sku: "KT-1"}); conflictField(err) != "sku" || !errors.Is(err, ErrProductConflict) {
+				t.Errorf("expected a sku conflict within a tenant, got %v", err)
+			}
+
+			// every way of reaching another tenant's product finds nothing
+			notFound := map[string]error{}
+			_, notFound["get"] = store.Get(acme, theirs.Id)
+			_, notFound["update"] = store.Update(acme, theirs.Id, Product{Name: "Stolen"})
+			_, notFound["patch"] = store.Patch(acme, theirs.Id, func(p Product) (Product, error) { return p, nil })
+			notFound["delete"] = store.Delete(acme, theirs.Id, 0)
+			_, notFound["restore"] = store.Restore(acme, theirs.Id, 0)
+			_, notFound["history"] = store.History(acme, theirs.Id, HistoryOptions{})
+			_, notFound["revision"] = store.Revision(acme, theirs.Id, 1)
+			_, notFound["revision at"] = store.RevisionAt(acme, theirs.Id, now())
+			for op, err := range notFound {
+				if !errors.Is(err, ErrProductNotFound) {
+					t.Errorf("%s: got %v expected ErrProductNotFound", op, err)
+				}
+			}
+			results, err := store.Batch(acme, []BatchOperation{
+				{Op: batchUpdate, Id: theirs.Id, Product: &Product{Name: "Stolen"}},
+				{Op: batchDelete, Id: theirs.Id},
+			}, false)
+			if err != nil || !errors.Is(results[0].Err, ErrProductNotFound) || !errors.Is(results[1].Err, ErrProductNotFound) {
+				t.Errorf("batch: got %+v, %v", results, err)
+			}
+
+			// by name, each tenant reaches its own product
+			if _, err := store.UpdateByName(globex, "Kettle", Product{Name: "Kettle", Price: 500}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteByName(acme, "Kettle", 0); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.Get(globex, theirs.Id); err != nil || got.Price != 500 || got.Version != 2 {
+				t.Errorf("expected globex's product to be untouched by acme, got %+v, %v", got, err)
+			}
+
+			for tenant, ctx := range map[string]context.Context{"acme": acme, "globex": globex} {
+				page, err := store.List(ctx, ListOptions{Deleted: includeDeleted})
+				if err != nil || page.Total != 1 {
+					t.Errorf("%s: expected to list only its own product, got %+v, %v", tenant, page.Items, err)
+				}
+			}
+			page, err := store.List(context.Background(), ListOptions{Deleted: includeDeleted})
+			if err != nil || page.Total != 0 {
+				t.Errorf("default tenant: expected an empty catalog, got %+v, %v", page.Items, err)
+			}
+
+			// purges cover every tenant and land in the owner's history
+			purged, err := store.Purge(context.Background(), now().Add(time.Second))
+			if err != nil || purged != 1 {
+				t.Fatalf("purge: got %d, %v", purged, err)
+			}
+			history, err := store.History(acme, ours.Id, HistoryOptions{})
+			if err != nil || len(history.Items) != 3 || history.Items[0].Action != auditPurge {
+				t.Errorf("expected the purge in acme's history, got %+v, %v", history.Items, err)
+			}
+			if _, err := store.History(globex, ours.Id, HistoryOptions{}); !errors.Is(err, ErrProductNotFound) {
+				t.Errorf("expected acme's history to stay hidden from globex, got %v", err)
+			}
+
+			if keys, ok := store.(IdempotencyStore); ok {
+				expiresAt := now().Add(time.Hour)
+				if _, reserved, err := keys.ReserveIdempotencyKey(acme, "k1", "hash-a", expiresAt); err != nil || !reserved {
+					t.Fatalf("reserve: reserved=%v, %v", reserved, err)
+				}
+				if _, reserved, err := keys.ReserveIdempotencyKey(globex, "k1", "hash-b", expiresAt); err != nil || !reserved {
+					t.Errorf("expected tenants to have separate idempotency keys, reserved=%v, %v", reserved, err)
+				}
+			}
+		})
+	}
+}
+
+// TestSQLiteConcurrentWriters runs writers against a database file, where
+// each gets a connection of its own, unlike the single connection of the
+// in-memory test databases
+func TestSQLiteConcurrentWriters(t *testing.T) {
+	db, d, err := openDatabase("", filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrateTestDB(t, db, d)
+	store := NewSQLStore(db, d)
+
+	ctx := context.Background()
+	created, err := store.Create(ctx, Product{Name: "Kettle", Price: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 100
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				_, err = store.Update(ctx, created.Id, Product{Name: "Kettle", Price: int64(i)})
+			} else {
+				_, err = store.Patch(ctx, created.Id, func(p Product) (Product, error) {
+					p.Price++
+					return p, nil
+				})
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write: %v", err)
+		}
+	}
+
+	got, err := store.Get(ctx, created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != created.Version+writers {
+		t.Errorf("got version %d expected %d", got.Version, created.Version+writers)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"regexp"
+)
+
+// defaultTenant owns the catalog of deployments that run a single
+// storefront, and every product created before catalogs had tenants
+const defaultTenant = "default"
+
+const tenantHeader = "X-Tenant-Id"
+
+// tenantPattern keeps tenant ids short and safe to log and put in URLs
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+type tenantKey struct{}
+
+// withTenant scopes every store call made with ctx to one tenant's catalog
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant of ctx, or the default tenant for contexts
+// no request set one on, such as the CLI's
+func tenantFrom(ctx context.Context) string {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	if !ok || tenant == "" {
+		return defaultTenant
+	}
+	return tenant
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// getIncludingDeleted reads a product by id, also finding it in the trash
+// when scope allows
+func getIncludingDeleted(ctx context.Context, store ProductStore, id int, scope deletedScope) (Product, error) {
+	if scope == excludeDeleted {
+		return store.Get(ctx, id)
+	}
+
+	page, err := store.List(ctx, ListOptions{Filters: []Filter{{Field: "id", Op: "eq", Value: id}}, Deleted: scope, Limit: 1})
+	if err != nil {
+		return Product{}, err
+	}
+	if len(page.Items) == 0 {
+		return Product{}, ErrProductNotFound
+	}
+	return page.Items[0], nil
+}
+
+// purgeDeletedProducts removes products that have been in the trash longer
+// than retention, every interval until ctx is done
+func purgeDeletedProducts(ctx context.Context, store ProductStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := store.Purge(ctx, now().Add(-retention))
+			if err != nil {
+				log.Printf("Unable to purge deleted products: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted products", purged)
+			}
+		}
+	}
+}
+
+// runPurgeCommand purges deleted products once, keeping those deleted
+// within the retention given as the only argument or else the configured one
+func runPurgeCommand(ctx context.Context, store ProductStore, args []string, retention time.Duration, out io.Writer) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: purge [retention]")
+	}
+	if len(args) == 0 && retention == 0 {
+		return fmt.Errorf("purge: DELETED_PRODUCT_RETENTION is not set, so pass the retention to purge with, e.g. purge 720h")
+	}
+	if len(args) == 1 {
+		var err error
+		retention, err = time.ParseDuration(args[0])
+		if err != nil || retention < 0 {
+			return fmt.Errorf("purge: retention must be a duration such as 720h, got %q", args[0])
+		}
+	}
+
+	purged, err := store.Purge(ctx, now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "purged %d products deleted more than %s ago\n", purged, retention)
+	return nil
+}
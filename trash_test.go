@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunPurgeCommand(t *testing.T) {
+	ctx := context.Background()
+	store := setupTestStore(t)
+	seedProducts(t, store, "Desk", "Chair")
+	if err := store.Delete(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runPurgeCommand(ctx, store, nil, 720*time.Hour, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "purged 0 products") {
+		t.Errorf("a product deleted just now is within the retention, got %q", out.String())
+	}
+
+	if err := runPurgeCommand(ctx, store, nil, 0, &out); err == nil {
+		t.Error("expected an error when no retention is configured or given")
+	}
+	if err := runPurgeCommand(ctx, store, []string{"a while"}, time.Hour, &out); err == nil {
+		t.Error("expected an error for an invalid retention")
+	}
+
+	out.Reset()
+	if err := runPurgeCommand(ctx, store, []string{"0s"}, 720*time.Hour, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "purged 1 products") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	page, err := store.List(ctx, ListOptions{Deleted: includeDeleted})
+	if err != nil || page.Total != 1 {
+		t.Errorf("expected only the live product left, got %+v, %v", page, err)
+	}
+}
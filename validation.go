@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxProductBodyBytes caps single-product request bodies. The largest valid
+// product is well under this, even with a full length description.
+const maxProductBodyBytes = 64 << 10
+
+// parseIdParam reads the :id path parameter as a positive integer. On
+// failure it writes a 400 problem and returns false.
+func parseIdParam(c *gin.Context) (int, bool) {
+	raw := c.Param("id")
+	id, err := strconv.Atoi(raw)
+	if err != nil || id < 1 {
+		p := newProblem(http.StatusBadRequest, problemInvalidId, fmt.Sprintf("'%s' is not a valid product id", raw))
+		p.Errors = []FieldError{{Field: "id", Code: "positive_integer", Message: "must be a positive integer"}}
+		writeProblem(c, p)
+		return 0, false
+	}
+	return id, true
+}
+
+// requireNameQuery reads the name query parameter used by the by-name
+// routes. On failure it writes a 400 problem and returns false.
+func requireNameQuery(c *gin.Context) (string, bool) {
+	name := c.Query("name")
+	if strings.TrimSpace(name) == "" {
+		badRequest(c, problemInvalidQuery, "The name query parameter is required")
+		return "", false
+	}
+	return name, true
+}
+
+// bindProduct decodes and validates a product request body. On failure it
+// writes the matching problem and returns false.
+func bindProduct(c *gin.Context, product *Product) bool {
+	if !decodeJSONBody(c, product, maxProductBodyBytes) {
+		return false
+	}
+	if err := validate.Struct(product); err != nil {
+		validationFailed(c, err)
+		return false
+	}
+	return true
+}
+
+// decodeJSONBody strictly decodes a request body of at most limit bytes
+// into dst. On failure it writes the matching problem and returns false.
+func decodeJSONBody(c *gin.Context, dst any, limit int64) bool {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	if err := decodeStrictJSON(body, dst); err != nil {
+		writeProblem(c, jsonProblem(err, limit))
+		return false
+	}
+	return true
+}
+
+// decodeStrictJSON decodes exactly one JSON value from r into dst. Unknown
+// fields, trailing data and wrong types are rejected.
+func decodeStrictJSON(r io.Reader, dst any) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("request body must contain a single JSON value")
+	}
+	// drain so an oversized trailer is still reported as too large
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// jsonProblem describes an error from decodeStrictJSON
+func jsonProblem(err error, limit int64) *Problem {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	p := newProblem(http.StatusBadRequest, problemInvalidBody, "")
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		p = newProblem(http.StatusRequestEntityTooLarge, problemBodyTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", limit))
+	case errors.Is(err, io.EOF):
+		p.Detail = "Request body must not be empty"
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		p.Detail = "Request body is not valid JSON"
+	case errors.As(err, &typeErr):
+		p.Detail = "Request body has a field of the wrong type"
+		if typeErr.Field == "" {
+			p.Detail = fmt.Sprintf("Request body must be a JSON object, not %s", typeErr.Value)
+		} else {
+			p.Errors = []FieldError{{Field: typeErr.Field, Code: "type", Message: "must be a JSON " + jsonTypeName(typeErr.Type)}}
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		p.Detail = "Request body has an unknown field"
+		p.Errors = []FieldError{{Field: field, Code: "unknown", Message: "is not a recognised field"}}
+	default:
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+// jsonTypeName names the JSON type a Go field decodes from
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map:
+		return "object"
+	}
+	// strings, and time.Time which is decoded from an RFC 3339 string
+	return "string"
+}